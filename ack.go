@@ -0,0 +1,71 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import "sync"
+
+// ackQueue sends acknowledgements of received messages in the order the
+// messages were received, whatever the order the application acknowledges
+// them in [MQTT-4.6.0-2] [MQTT-4.6.0-3]. It is used in manual
+// acknowledgement mode.
+// It is safe for concurrent use.
+type ackQueue struct {
+	mu sync.Mutex
+	// sender returns the sender of the current connection: The application
+	// can acknowledge a message after the client has reconnected.
+	sender  func() sender
+	pending []*ackTicket
+}
+
+// ackTicket is the pending acknowledgement of a received message.
+type ackTicket struct {
+	queue  *ackQueue
+	packet Packet // PUBACK or PUBREC
+	// Application acknowledged the message
+	acked bool
+	// Ack packet has been passed to the sender
+	sent bool
+}
+
+func newAckQueue(sender func() sender) *ackQueue {
+	return &ackQueue{sender: sender}
+}
+
+// add queues ack packet, to be sent when its ticket is acknowledged.
+func (q *ackQueue) add(packet Packet) *ackTicket {
+	t := &ackTicket{queue: q, packet: packet}
+	q.mu.Lock()
+	q.pending = append(q.pending, t)
+	q.mu.Unlock()
+	return t
+}
+
+// ack marks the message as acknowledged by the application and sends all
+// acknowledgements that are not waiting for a previous message anymore.
+func (t *ackTicket) ack() {
+	q := t.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t.acked {
+		return
+	}
+	t.acked = true
+
+	i := 0
+	if len(q.pending) > 0 && q.pending[0].acked {
+		s := q.sender()
+		for ; i < len(q.pending) && q.pending[i].acked; i++ {
+			s.send(q.pending[i].packet)
+			q.pending[i].sent = true
+			q.pending[i] = nil
+		}
+	}
+	q.pending = q.pending[i:]
+}
+
+// isSent reports whether the ack packet has been sent, that is, the
+// application acknowledged the message and all the messages received
+// before it.
+func (t *ackTicket) isSent() bool {
+	t.queue.mu.Lock()
+	defer t.queue.mu.Unlock()
+	return t.sent
+}
@@ -0,0 +1,75 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"testing"
+)
+
+func TestAckQueueOrder(t *testing.T) {
+	s, out := newTestSender()
+	q := newAckQueue(func() sender { return s })
+	t1 := q.add(PubAckPacket{ID: 1})
+	t2 := q.add(PubRecPacket{ID: 2})
+	t3 := q.add(PubAckPacket{ID: 3})
+
+	// Acknowledgement of last message waits for previous ones.
+	t3.ack()
+	assertNoPacket(t, out)
+
+	t1.ack()
+	assertPacket(t, out, PubAckPacket{ID: 1})
+	assertNoPacket(t, out)
+
+	t2.ack()
+	assertPacket(t, out, PubRecPacket{ID: 2})
+	assertPacket(t, out, PubAckPacket{ID: 3})
+
+	// Acknowledging twice does not send packet again.
+	t2.ack()
+	assertNoPacket(t, out)
+	if len(q.pending) != 0 {
+		t.Errorf("incorrect pending acks (%d) = %d", len(q.pending), 0)
+	}
+}
+
+func TestAckQueueReconnect(t *testing.T) {
+	s1, out1 := newTestSender()
+	current := s1
+	q := newAckQueue(func() sender { return current })
+	t1 := q.add(PubAckPacket{ID: 1})
+
+	// Message acknowledged after reconnection: Ack is sent on the new
+	// connection.
+	s2, out2 := newTestSender()
+	current = s2
+	t1.ack()
+	assertNoPacket(t, out1)
+	assertPacket(t, out2, PubAckPacket{ID: 1})
+}
+
+// Helpers
+
+func newTestSender() (sender, chan Packet) {
+	out := make(chan Packet, 10)
+	return sender{out: out, done: make(chan struct{})}, out
+}
+
+func assertPacket(t *testing.T, out <-chan Packet, expected Packet) {
+	t.Helper()
+	select {
+	case p := <-out:
+		if p != expected {
+			t.Errorf("incorrect sent packet (%s) = %s", p, expected)
+		}
+	default:
+		t.Errorf("packet %s was not sent", expected)
+	}
+}
+
+func assertNoPacket(t *testing.T, out <-chan Packet) {
+	t.Helper()
+	select {
+	case p := <-out:
+		t.Errorf("unexpected packet sent: %s", p)
+	default:
+	}
+}
@@ -0,0 +1,253 @@
+/*
+Package bridge forwards messages between two MQTT brokers, for example from
+an on-site broker to a cloud broker.
+
+A Bridge connects to both brokers with mqtt.Client, supervised by an
+mqtt.ClientManager, and subscribes on each side to the topics of its
+mappings:
+
+	local := mqtt.NewClient("tcp://localhost:1883")
+	remote := mqtt.NewClient("tls://cloud.example.com:8883")
+	b := bridge.New(local, remote,
+		bridge.Mapping{Topic: "#", Direction: bridge.Out, QOS: 1, LocalPrefix: "sensors/", RemotePrefix: "site1/sensors/"},
+		bridge.Mapping{Topic: "#", Direction: bridge.In, QOS: 1, LocalPrefix: "commands/", RemotePrefix: "site1/commands/"},
+	)
+	if err := b.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+Connections are restored after network failures. QOS 1 and 2 messages
+forwarded while the destination broker is unreachable, including the remote
+broker when the bridge starts, are kept by its client and sent when it
+connects. For messages to be acknowledged to the source
+broker only once forwarded, enable OptInbound.ManualAck on both clients.
+Messages that cannot be forwarded, for example because the destination
+client is stopped, are then not acknowledged: As acknowledgements are sent
+in order, the source broker sends them again after reconnection, with the
+messages received after them.
+*/
+package bridge // import "gosrc.io/mqtt/bridge"
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gosrc.io/mqtt"
+	"gosrc.io/mqtt/topic"
+)
+
+var (
+	// ErrInvalidDirection is returned by Start when a mapping direction is
+	// not In, Out or Both.
+	ErrInvalidDirection = errors.New("mqtt: invalid bridge mapping direction")
+	// ErrInvalidQOS is returned by Start when a mapping QOS is not 0, 1 or 2.
+	ErrInvalidQOS = errors.New("mqtt: invalid bridge mapping qos")
+)
+
+// DefaultLoopWindow is the default time during which a message forwarded
+// to a broker is recognized if the bridge receives it back.
+const DefaultLoopWindow = 10 * time.Second
+
+// Direction defines which way messages are forwarded.
+type Direction int
+
+const (
+	// Out forwards messages from the local broker to the remote broker.
+	Out Direction = 1 << iota
+	// In forwards messages from the remote broker to the local broker.
+	In
+	// Both forwards messages in both directions.
+	Both = Out | In
+)
+
+// Mapping defines the messages forwarded by the bridge, in the way of
+// mosquitto bridge topic configuration.
+//
+// The bridge subscribes to prefix + Topic on the source broker, where prefix
+// is LocalPrefix for Out direction and RemotePrefix for In direction. The
+// source prefix of forwarded messages topics is then replaced by the
+// destination prefix: With LocalPrefix "sensors/" and RemotePrefix
+// "site1/sensors/", local message sensors/kitchen/temp is published on the
+// remote broker as site1/sensors/kitchen/temp.
+type Mapping struct {
+	Topic     string
+	Direction Direction
+	// QOS is the QOS of the subscription to the source broker and the
+	// maximum QOS of forwarded messages: Messages with a higher QOS are
+	// downgraded.
+	QOS          int
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+// Bridge forwards messages between a local and a remote broker.
+type Bridge struct {
+	Local    *mqtt.Client
+	Remote   *mqtt.Client
+	Mappings []Mapping
+	// LoopWindow is the time during which a message forwarded to a broker
+	// is dropped if it is received back from this broker. This prevents
+	// messages from looping between brokers when mappings overlap, for
+	// example with Both direction. Default is DefaultLoopWindow.
+	LoopWindow time.Duration
+	// Logger receives bridge log records. Default is to not log anything.
+	Logger mqtt.Logger
+
+	local  *mqtt.ClientManager
+	remote *mqtt.ClientManager
+	loops  *loopGuard
+}
+
+// New returns a bridge between local and remote brokers, forwarding
+// messages according to mappings.
+func New(local, remote *mqtt.Client, mappings ...Mapping) *Bridge {
+	return &Bridge{
+		Local:    local,
+		Remote:   remote,
+		Mappings: mappings,
+	}
+}
+
+// Start checks the mappings, connects to both brokers and subscribes to the
+// mapped topics. Like ClientManager Start, it blocks until the local broker
+// is connected. The remote broker is connected in the background, so that
+// local messages are forwarded while it is unreachable: QOS 1 and 2 messages
+// are kept by the remote client until it connects.
+func (b *Bridge) Start() error {
+	for _, m := range b.Mappings {
+		if m.Direction&Both == 0 || m.Direction&^Both != 0 {
+			return ErrInvalidDirection
+		}
+		if m.QOS < 0 || m.QOS > 2 {
+			return ErrInvalidQOS
+		}
+		for _, d := range []Direction{Out, In} {
+			if m.Direction&d == 0 {
+				continue
+			}
+			if err := topic.ValidateFilter(m.source(d)); err != nil {
+				return err
+			}
+		}
+	}
+
+	window := b.LoopWindow
+	if window <= 0 {
+		window = DefaultLoopWindow
+	}
+	b.loops = newLoopGuard(window)
+
+	b.remote = mqtt.NewClientManager(b.Remote, func(c *mqtt.Client) { b.subscribe(In) })
+	b.local = mqtt.NewClientManager(b.Local, func(c *mqtt.Client) { b.subscribe(Out) })
+	go b.remote.Start()
+	b.local.Start()
+	return nil
+}
+
+// Stop disconnects from both brokers.
+func (b *Bridge) Stop() {
+	if b.local != nil {
+		b.local.Stop()
+	}
+	if b.remote != nil {
+		b.remote.Stop()
+	}
+}
+
+// ============================================================================
+// Forwarding
+
+// subscribe subscribes on the source broker of direction d to the topics of
+// mappings in this direction. It is called on each connection, as
+// subscriptions are lost with clean sessions.
+func (b *Bridge) subscribe(d Direction) {
+	source, _ := b.clients(d)
+	for i := range b.Mappings {
+		m := b.Mappings[i]
+		if m.Direction&d == 0 {
+			continue
+		}
+		filter := m.source(d)
+		handler := mqtt.HandlerFunc(func(msg mqtt.Message) { b.forward(m, d, msg) })
+		if err := source.SubscribeHandler(mqtt.Topic{Name: filter, QOS: m.QOS}, handler); err != nil {
+			b.logger().Error("cannot subscribe", "topic", filter, "error", err)
+		}
+	}
+}
+
+// forward publishes message msg received for mapping m to the destination
+// broker of direction d. The source broker is only acknowledged once the
+// message is in the destination client inflight state: If it cannot be
+// published, it is not acknowledged, so that the source broker sends it
+// again after reconnection.
+func (b *Bridge) forward(m Mapping, d Direction, msg mqtt.Message) {
+	// Drop messages the bridge itself published to the source broker, in
+	// the reverse direction.
+	reverse := In
+	if d == In {
+		reverse = Out
+	}
+	if b.loops.echo(reverse, msg.Topic, msg.Payload) {
+		b.logger().Debug("forwarding loop prevented", "topic", msg.Topic)
+		msg.Ack()
+		return
+	}
+
+	out := mqtt.Message{
+		Topic: m.destination(d) + strings.TrimPrefix(msg.Topic, m.prefix(d)),
+		// Payload may be borrowed from the source client buffers.
+		Payload: append([]byte(nil), msg.Payload...),
+		QOS:     msg.QOS,
+		Retain:  msg.Retain,
+	}
+	if out.QOS > m.QOS {
+		out.QOS = m.QOS
+	}
+
+	b.loops.forwarded(d, out.Topic, out.Payload)
+	_, destination := b.clients(d)
+	if err := destination.PublishMessage(out); err != nil {
+		b.logger().Error("message not forwarded", "topic", out.Topic, "error", err)
+		return
+	}
+	msg.Ack()
+}
+
+// clients returns the source and destination clients of direction d.
+func (b *Bridge) clients(d Direction) (source, destination *mqtt.Client) {
+	if d == Out {
+		return b.Local, b.Remote
+	}
+	return b.Remote, b.Local
+}
+
+// prefix returns the topic prefix on the source broker of direction d.
+func (m Mapping) prefix(d Direction) string {
+	if d == Out {
+		return m.LocalPrefix
+	}
+	return m.RemotePrefix
+}
+
+// destination returns the topic prefix on the destination broker of
+// direction d.
+func (m Mapping) destination(d Direction) string {
+	if d == Out {
+		return m.RemotePrefix
+	}
+	return m.LocalPrefix
+}
+
+// source returns the topic filter subscribed on the source broker of
+// direction d.
+func (m Mapping) source(d Direction) string {
+	return m.prefix(d) + m.Topic
+}
+
+func (b *Bridge) logger() mqtt.Logger {
+	if b.Logger == nil {
+		return mqtt.NopLogger{}
+	}
+	return b.Logger
+}
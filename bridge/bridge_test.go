@@ -0,0 +1,283 @@
+package bridge // import "gosrc.io/mqtt/bridge"
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gosrc.io/mqtt"
+	"gosrc.io/mqtt/broker"
+	"gosrc.io/mqtt/mqtttest"
+)
+
+func TestBridge(t *testing.T) {
+	local, localAddr := startBroker(t)
+	defer local.Close()
+	remote, remoteAddr := startBroker(t)
+	defer remote.Close()
+
+	b := New(newClient(localAddr, "bridge"), newClient(remoteAddr, "bridge"),
+		Mapping{Topic: "#", Direction: Out, QOS: 0, LocalPrefix: "sensors/", RemotePrefix: "site1/sensors/"},
+		Mapping{Topic: "+", Direction: In, QOS: 1, LocalPrefix: "commands/", RemotePrefix: "site1/commands/"},
+	)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	mqtttest.WaitSubscription(t, b.Local, "sensors/#")
+	mqtttest.WaitSubscription(t, b.Remote, "site1/commands/+")
+
+	remoteMessages := subscribe(t, remoteAddr, "site1/sensors/#")
+	localMessages := subscribe(t, localAddr, "commands/#")
+
+	// Out: Prefix is replaced and QOS is downgraded.
+	publish(t, localAddr, mqtt.Message{Topic: "sensors/kitchen/temp", Payload: []byte("21"), QOS: 1})
+	expectMessage(t, remoteMessages, "site1/sensors/kitchen/temp", "21", 0)
+
+	// In
+	publish(t, remoteAddr, mqtt.Message{Topic: "site1/commands/reboot", Payload: []byte("now"), QOS: 1})
+	expectMessage(t, localMessages, "commands/reboot", "now", 1)
+
+	// Topics outside mappings are not forwarded.
+	publish(t, localAddr, mqtt.Message{Topic: "other/topic", Payload: []byte("not mapped")})
+	publish(t, remoteAddr, mqtt.Message{Topic: "site1/commands/a/b", Payload: []byte("not mapped")})
+	expectNoMessage(t, localMessages)
+	expectNoMessage(t, remoteMessages)
+}
+
+func TestBridgeLoop(t *testing.T) {
+	local, localAddr := startBroker(t)
+	defer local.Close()
+	remote, remoteAddr := startBroker(t)
+	defer remote.Close()
+
+	b := New(newClient(localAddr, "bridge"), newClient(remoteAddr, "bridge"),
+		Mapping{Topic: "test/#", Direction: Both, QOS: 1},
+	)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	mqtttest.WaitSubscription(t, b.Local, "test/#")
+	mqtttest.WaitSubscription(t, b.Remote, "test/#")
+
+	localMessages := subscribe(t, localAddr, "test/#")
+	remoteMessages := subscribe(t, remoteAddr, "test/#")
+
+	publish(t, localAddr, mqtt.Message{Topic: "test/1", Payload: []byte("Hi"), QOS: 1})
+	expectMessage(t, localMessages, "test/1", "Hi", 1)
+	expectMessage(t, remoteMessages, "test/1", "Hi", 1)
+	// Message is not sent back to the local broker.
+	expectNoMessage(t, localMessages)
+	expectNoMessage(t, remoteMessages)
+}
+
+func TestBridgeReconnect(t *testing.T) {
+	local, localAddr := startBroker(t)
+	defer local.Close()
+	remote, remoteAddr := startBroker(t)
+
+	b := New(newClient(localAddr, "bridge"), newClient(remoteAddr, "bridge"),
+		Mapping{Topic: "test/#", Direction: Out, QOS: 1},
+	)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	mqtttest.WaitSubscription(t, b.Local, "test/#")
+
+	// Message is forwarded while the remote broker is down.
+	remote.Close()
+	publish(t, localAddr, mqtt.Message{Topic: "test/1", Payload: []byte("Hi"), QOS: 1})
+	time.Sleep(50 * time.Millisecond)
+
+	// Subscriber session is set up before the remote broker accepts
+	// connections again.
+	remote = &broker.Server{}
+	defer remote.Close()
+	client, server := net.Pipe()
+	go remote.ServeConn(server)
+	mqtttest.WritePacket(t, client, mqtt.ConnectPacket{ClientID: "sub", CleanSession: true, ProtocolName: mqtt.ProtocolName, ProtocolLevel: mqtt.ProtocolLevel})
+	mqtttest.ReadPacket(t, client)
+	mqtttest.WritePacket(t, client, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "test/#", QOS: 1}}})
+	mqtttest.ReadPacket(t, client)
+	l, err := net.Listen("tcp", remoteAddr[len("tcp://"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	go remote.Serve(l)
+
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p, err := mqtt.PacketRead(client)
+	if err != nil {
+		t.Fatalf("message was not forwarded after reconnection: %s", err)
+	}
+	if publish, ok := p.(mqtt.PublishPacket); !ok || publish.Topic != "test/1" || string(publish.Payload) != "Hi" {
+		t.Errorf("incorrect forwarded message: %s", p)
+	}
+}
+
+func TestBridgeInvalidMapping(t *testing.T) {
+	for _, m := range []Mapping{
+		{Topic: "#", Direction: 0},
+		{Topic: "#", Direction: 4},
+		{Topic: "#", Direction: Out, QOS: 3},
+		{Topic: "a/#/b", Direction: In},
+		{Topic: "#", Direction: Out, LocalPrefix: "+a/"},
+	} {
+		b := New(nil, nil, m)
+		if err := b.Start(); err == nil {
+			t.Errorf("mapping %+v should be invalid", m)
+		}
+	}
+}
+
+func TestBridgeRemoteDown(t *testing.T) {
+	local, localAddr := startBroker(t)
+	defer local.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteAddr := l.Addr().String()
+	l.Close()
+
+	b := New(newClient(localAddr, "bridge"), newClient("tcp://"+remoteAddr, "bridge"),
+		Mapping{Topic: "test/#", Direction: Out, QOS: 1},
+	)
+	started := make(chan error, 1)
+	go func() { started <- b.Start() }()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start should not wait for the remote broker")
+	}
+	defer b.Stop()
+
+	// Local messages are forwarded while the remote broker is down, and
+	// sent when it becomes reachable.
+	mqtttest.WaitSubscription(t, b.Local, "test/#")
+	publish(t, localAddr, mqtt.Message{Topic: "test/1", Payload: []byte("Hi"), QOS: 1})
+	time.Sleep(50 * time.Millisecond)
+
+	remote := &broker.Server{}
+	defer remote.Close()
+	client, server := net.Pipe()
+	go remote.ServeConn(server)
+	mqtttest.WritePacket(t, client, mqtt.ConnectPacket{ClientID: "sub", CleanSession: true, ProtocolName: mqtt.ProtocolName, ProtocolLevel: mqtt.ProtocolLevel})
+	mqtttest.ReadPacket(t, client)
+	mqtttest.WritePacket(t, client, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "test/#", QOS: 1}}})
+	mqtttest.ReadPacket(t, client)
+	if l, err = net.Listen("tcp", remoteAddr); err != nil {
+		t.Fatal(err)
+	}
+	go remote.Serve(l)
+
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p, err := mqtt.PacketRead(client)
+	if err != nil {
+		t.Fatalf("message was not forwarded after connection: %s", err)
+	}
+	if publish, ok := p.(mqtt.PublishPacket); !ok || publish.Topic != "test/1" || string(publish.Payload) != "Hi" {
+		t.Errorf("incorrect forwarded message: %s", p)
+	}
+}
+
+func TestBridgeForwardFailed(t *testing.T) {
+	source := mqtttest.NewServer(t, mqtttest.Script{
+		mqtttest.Expect(mqtt.PacketConnect),
+		mqtttest.ConnAck(mqtt.ConnAccepted),
+		mqtttest.Expect(mqtt.PacketSubscribe),
+		mqtttest.SubAck(1),
+		mqtttest.Send(mqtt.PublishPacket{ID: 1, Qos: 1, Topic: "test/1", Payload: []byte("Hi")}),
+	})
+	defer source.Close()
+
+	local := newClient(source.Addr, "bridge")
+	local.ManualAck = true
+	// Messages cannot be published to a stopped client.
+	remote := newClient("tcp://127.0.0.1:1", "bridge")
+	remote.Disconnect()
+
+	b := New(local, remote, Mapping{Topic: "test/#", Direction: Out, QOS: 1})
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	if p := source.WaitFor(mqtt.PacketPubAck, 300*time.Millisecond); p != nil {
+		t.Errorf("message that was not forwarded should not be acknowledged: %s", p)
+	}
+}
+
+//=============================================================================
+// Helpers
+
+func startBroker(t *testing.T) (*broker.Server, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &broker.Server{SysInterval: -1}
+	go s.Serve(l)
+	return s, "tcp://" + l.Addr().String()
+}
+
+func newClient(address, clientID string) *mqtt.Client {
+	c := mqtt.NewClient(address)
+	c.ClientID = clientID
+	return c
+}
+
+// subscribe connects a client to the broker and returns the channel
+// receiving messages matching filter.
+func subscribe(t *testing.T, address, filter string) <-chan mqtt.Message {
+	t.Helper()
+	messages := make(chan mqtt.Message, 10)
+	c := newClient(address, "sub-"+filter)
+	if err := c.Connect(messages); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Subscribe(mqtt.Topic{Name: filter, QOS: 1}); err != nil {
+		t.Fatal(err)
+	}
+	mqtttest.WaitSubscription(t, c, filter)
+	return messages
+}
+
+func publish(t *testing.T, address string, m mqtt.Message) {
+	t.Helper()
+	c := newClient(address, "pub")
+	if err := c.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PublishMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	c.Disconnect()
+}
+
+func expectMessage(t *testing.T, messages <-chan mqtt.Message, topic, payload string, qos int) {
+	t.Helper()
+	select {
+	case m := <-messages:
+		if m.Topic != topic || string(m.Payload) != payload || m.QOS != qos {
+			t.Errorf("incorrect message (%s, %q, %d) = (%s, %q, %d)", m.Topic, m.Payload, m.QOS, topic, payload, qos)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message %s was not received", topic)
+	}
+}
+
+func expectNoMessage(t *testing.T, messages <-chan mqtt.Message) {
+	t.Helper()
+	select {
+	case m := <-messages:
+		t.Errorf("unexpected message received: %s", m.Topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,102 @@
+package bridge // import "gosrc.io/mqtt/bridge"
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// loopGuard remembers recently forwarded messages, to recognize them when
+// a broker sends them back to the bridge. MQTT 3.1.1 subscriptions receive
+// the messages published by the same client: Without the guard, a message
+// matching mappings in both directions would be forwarded forever.
+type loopGuard struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// Number of forwarded messages not received back yet, by key
+	counts map[loopKey]int
+	// Forwarded messages, in forwarding order
+	entries []loopEntry
+}
+
+// loopKey identifies a message forwarded in a direction. Payload is
+// identified by its hash.
+type loopKey struct {
+	direction Direction
+	topic     string
+	sum       uint64
+}
+
+type loopEntry struct {
+	key     loopKey
+	expires time.Time
+}
+
+func newLoopGuard(window time.Duration) *loopGuard {
+	return &loopGuard{
+		window: window,
+		counts: make(map[loopKey]int),
+	}
+}
+
+// forwarded records a message forwarded in direction d.
+func (g *loopGuard) forwarded(d Direction, topic string, payload []byte) {
+	now := time.Now()
+	key := loopKey{direction: d, topic: topic, sum: hash(payload)}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire(now)
+	g.counts[key]++
+	g.entries = append(g.entries, loopEntry{key: key, expires: now.Add(g.window)})
+}
+
+// echo reports whether a message was forwarded in direction d within the
+// loop window. Each forwarded message is recognized once.
+func (g *loopGuard) echo(d Direction, topic string, payload []byte) bool {
+	key := loopKey{direction: d, topic: topic, sum: hash(payload)}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire(time.Now())
+	if g.counts[key] == 0 {
+		return false
+	}
+	// The oldest matching entry is consumed, so that it does not expire
+	// later in place of a newer forwarded message.
+	for i, e := range g.entries {
+		if e.key == key {
+			g.entries = append(g.entries[:i], g.entries[i+1:]...)
+			break
+		}
+	}
+	g.decrement(key)
+	return true
+}
+
+// expire forgets messages forwarded before the loop window. g.mu must be
+// held.
+func (g *loopGuard) expire(now time.Time) {
+	i := 0
+	for ; i < len(g.entries) && now.After(g.entries[i].expires); i++ {
+		g.decrement(g.entries[i].key)
+	}
+	if i > 0 {
+		g.entries = append(g.entries[:0], g.entries[i:]...)
+	}
+}
+
+// decrement decreases the count of key. g.mu must be held.
+func (g *loopGuard) decrement(key loopKey) {
+	switch n := g.counts[key]; {
+	case n > 1:
+		g.counts[key] = n - 1
+	case n == 1:
+		delete(g.counts, key)
+	}
+}
+
+func hash(payload []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(payload)
+	return h.Sum64()
+}
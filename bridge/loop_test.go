@@ -0,0 +1,59 @@
+package bridge // import "gosrc.io/mqtt/bridge"
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoopGuard(t *testing.T) {
+	g := newLoopGuard(50 * time.Millisecond)
+	g.forwarded(Out, "test", []byte("1"))
+	g.forwarded(Out, "test", []byte("1"))
+
+	if g.echo(In, "test", []byte("1")) {
+		t.Error("message forwarded in other direction should not be an echo")
+	}
+	if g.echo(Out, "test", []byte("2")) {
+		t.Error("message with another payload should not be an echo")
+	}
+	// Each forwarded message is recognized once.
+	for i := 0; i < 2; i++ {
+		if !g.echo(Out, "test", []byte("1")) {
+			t.Errorf("forwarded message %d should be an echo", i)
+		}
+	}
+	if g.echo(Out, "test", []byte("1")) {
+		t.Error("message should be recognized only once")
+	}
+
+	g.forwarded(Out, "test", []byte("1"))
+	time.Sleep(60 * time.Millisecond)
+	if g.echo(Out, "test", []byte("1")) {
+		t.Error("message forwarded before loop window should not be an echo")
+	}
+	if len(g.counts) != 0 || len(g.entries) != 0 {
+		t.Errorf("incorrect number of remembered messages (%d, %d) = (0, 0)", len(g.counts), len(g.entries))
+	}
+}
+
+// TestLoopGuardExpiry checks that a consumed echo does not expire the
+// count of a message forwarded again later.
+func TestLoopGuardExpiry(t *testing.T) {
+	g := newLoopGuard(50 * time.Millisecond)
+	g.forwarded(Out, "test", []byte("1"))
+	if !g.echo(Out, "test", []byte("1")) {
+		t.Fatal("forwarded message should be an echo")
+	}
+
+	// Same message is forwarded again, and echoed after the first one
+	// would have expired.
+	time.Sleep(30 * time.Millisecond)
+	g.forwarded(Out, "test", []byte("1"))
+	time.Sleep(30 * time.Millisecond)
+	if !g.echo(Out, "test", []byte("1")) {
+		t.Error("message forwarded again should be an echo")
+	}
+	if len(g.counts) != 0 || len(g.entries) != 0 {
+		t.Errorf("incorrect number of remembered messages (%d, %d) = (0, 0)", len(g.counts), len(g.entries))
+	}
+}
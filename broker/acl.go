@@ -0,0 +1,190 @@
+package broker // import "gosrc.io/mqtt/broker"
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ACL is an Authorizer reading its rules from a mosquitto style access
+// control list:
+//
+//	# Rules before the first user line apply to anonymous clients.
+//	topic read $SYS/#
+//
+//	# Rules after a user line apply to this user.
+//	user dashboard
+//	topic read sensors/#
+//
+//	# Patterns apply to all clients: %c is replaced by the client ID and %u
+//	# by the username.
+//	pattern readwrite devices/%c/#
+//	pattern write sensors/%u/+
+//
+// Access is read (subscribe), write (publish) or readwrite, the default. A
+// subscription is allowed if its topic filter is contained in the filter of
+// a rule, for example sensors/+/temp in sensors/#. Everything that is not
+// allowed by a rule is denied.
+type ACL struct {
+	anonymous []aclRule
+	users     map[string][]aclRule
+	patterns  []aclRule
+}
+
+type aclRule struct {
+	topic  string
+	access Access
+}
+
+// LoadACL reads the access control list in file path.
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// ParseACL reads an access control list from r.
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{users: make(map[string][]aclRule)}
+	var user *string
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		keyword, value := splitField(text)
+		switch keyword {
+		case "user":
+			if value == "" {
+				return nil, fmt.Errorf("mqtt: acl line %d: missing username", line)
+			}
+			user = &value
+		case "topic", "pattern":
+			rule, err := parseRule(value)
+			if err != nil {
+				return nil, fmt.Errorf("mqtt: acl line %d: %s", line, err)
+			}
+			switch {
+			case keyword == "pattern":
+				acl.patterns = append(acl.patterns, rule)
+			case user == nil:
+				acl.anonymous = append(acl.anonymous, rule)
+			default:
+				acl.users[*user] = append(acl.users[*user], rule)
+			}
+		default:
+			return nil, fmt.Errorf("mqtt: acl line %d: unknown keyword %q", line, keyword)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Authorize implements Authorizer. QOS is not restricted by ACL rules.
+func (acl *ACL) Authorize(client Client, topic string, access Access, qos int) bool {
+	rules := acl.anonymous
+	if client.Username != "" {
+		rules = acl.users[client.Username]
+	}
+	for _, rule := range rules {
+		if rule.access&access != 0 && filterContains(rule.topic, topic) {
+			return true
+		}
+	}
+	for _, rule := range acl.patterns {
+		if rule.access&access == 0 {
+			continue
+		}
+		if filter, ok := expandPattern(rule.topic, client); ok && filterContains(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRule parses the value of topic and pattern lines: An optional access
+// followed by a topic filter.
+func parseRule(value string) (aclRule, error) {
+	rule := aclRule{topic: value, access: AccessPublish | AccessSubscribe}
+	access, filter := splitField(value)
+	switch access {
+	case "read":
+		rule = aclRule{topic: filter, access: AccessSubscribe}
+	case "write":
+		rule = aclRule{topic: filter, access: AccessPublish}
+	case "readwrite":
+		rule = aclRule{topic: filter, access: AccessPublish | AccessSubscribe}
+	}
+	if rule.topic == "" {
+		return rule, errors.New("missing topic")
+	}
+	if !validFilter(rule.topic) {
+		return rule, fmt.Errorf("invalid topic filter %q", rule.topic)
+	}
+	return rule, nil
+}
+
+// splitField returns the first space separated field of s and the rest of
+// s, which may contain spaces.
+func splitField(s string) (string, string) {
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+// expandPattern replaces %c and %u in pattern with client ID and username.
+// It reports false if the pattern cannot be used for client: Its username is
+// empty or the substituted values contain topic separators or wildcards.
+func expandPattern(pattern string, client Client) (string, bool) {
+	if strings.Contains(pattern, "%c") {
+		if strings.ContainsAny(client.ID, "/+#") {
+			return "", false
+		}
+		pattern = strings.Replace(pattern, "%c", client.ID, -1)
+	}
+	if strings.Contains(pattern, "%u") {
+		if client.Username == "" || strings.ContainsAny(client.Username, "/+#") {
+			return "", false
+		}
+		pattern = strings.Replace(pattern, "%u", client.Username, -1)
+	}
+	return pattern, true
+}
+
+// filterContains reports whether all topics matched by topic filter or
+// name t are matched by topic filter filter. Topics starting with $ are
+// not matched by a leading wildcard.
+func filterContains(filter string, t string) bool {
+	if strings.HasPrefix(t, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	levels := strings.Split(t, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(levels) {
+			return false
+		}
+		switch {
+		case levels[i] == "#":
+			return false
+		case level == "+", level == levels[i]:
+		default:
+			return false
+		}
+	}
+	return len(levels) == len(filterLevels)
+}
@@ -0,0 +1,78 @@
+package broker // import "gosrc.io/mqtt/broker"
+
+import (
+	"strings"
+	"testing"
+)
+
+const testACL = `
+# Anonymous clients
+topic read $SYS/#
+
+user dashboard
+topic read sensors/#
+topic home/lights
+
+pattern readwrite devices/%c/#
+pattern write sensors/%u/+
+`
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	anonymous := Client{ID: "anon"}
+	dashboard := Client{ID: "screen", Username: "dashboard"}
+	sensor := Client{ID: "kitchen", Username: "kitchen"}
+	tests := []struct {
+		client  Client
+		topic   string
+		access  Access
+		allowed bool
+	}{
+		{anonymous, "$SYS/#", AccessSubscribe, true},
+		{anonymous, "$SYS/broker/uptime", AccessPublish, false},
+		{anonymous, "sensors/#", AccessSubscribe, false},
+		{anonymous, "devices/anon/status", AccessPublish, true},
+		{anonymous, "sensors/anon/temp", AccessPublish, false},
+		{dashboard, "sensors/#", AccessSubscribe, true},
+		{dashboard, "sensors/+/temp", AccessSubscribe, true},
+		{dashboard, "sensors", AccessSubscribe, true},
+		{dashboard, "sensors/kitchen/temp", AccessPublish, false},
+		{dashboard, "home/lights", AccessPublish, true},
+		{dashboard, "home/lights", AccessSubscribe, true},
+		{dashboard, "home/+", AccessSubscribe, false},
+		{dashboard, "#", AccessSubscribe, false},
+		{dashboard, "$SYS/#", AccessSubscribe, false},
+		{sensor, "sensors/kitchen/temp", AccessPublish, true},
+		{sensor, "sensors/kitchen/temp/raw", AccessPublish, false},
+		{sensor, "sensors/bedroom/temp", AccessPublish, false},
+		{sensor, "sensors/kitchen/temp", AccessSubscribe, false},
+		{sensor, "devices/kitchen/#", AccessSubscribe, true},
+		{sensor, "devices/+/status", AccessSubscribe, false},
+		// Wildcards in substituted values do not widen patterns.
+		{Client{ID: "+", Username: "#"}, "devices/x/status", AccessPublish, false},
+		{Client{ID: "+", Username: "#"}, "sensors/x/temp", AccessPublish, false},
+	}
+	for _, tt := range tests {
+		if allowed := acl.Authorize(tt.client, tt.topic, tt.access, 0); allowed != tt.allowed {
+			t.Errorf("incorrect authorization for %s/%s on %s with access %d (%t) = %t",
+				tt.client.ID, tt.client.Username, tt.topic, tt.access, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestParseACLErrors(t *testing.T) {
+	for _, text := range []string{
+		"unknown rule",
+		"user",
+		"topic read",
+		"topic read sensors/#/temp",
+	} {
+		if _, err := ParseACL(strings.NewReader(text)); err == nil {
+			t.Errorf("ACL %q should be invalid", text)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package broker // import "gosrc.io/mqtt/broker"
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+
+	"gosrc.io/mqtt"
+)
+
+// Client identifies a client connecting to the broker, for authentication
+// and authorization.
+type Client struct {
+	ID       string
+	Username string
+	// Certificate is the TLS peer certificate. It is nil if the connection
+	// does not use TLS or if the client did not send a certificate.
+	Certificate *x509.Certificate
+	RemoteAddr  net.Addr
+}
+
+// Authenticator checks the credentials of connecting clients.
+type Authenticator interface {
+	// Authenticate returns the CONNACK return code for client connecting
+	// with password: mqtt.ConnAccepted to accept the connection, or a
+	// refusal code such as mqtt.ConnRefusedBadUsernameOrPassword or
+	// mqtt.ConnRefusedNotAuthorized.
+	Authenticate(client Client, password string) int
+}
+
+// AuthenticatorFunc is an adapter to use a function as Authenticator.
+type AuthenticatorFunc func(client Client, password string) int
+
+// Authenticate calls f(client, password).
+func (f AuthenticatorFunc) Authenticate(client Client, password string) int {
+	return f(client, password)
+}
+
+// Access is the kind of topic access checked by an Authorizer.
+type Access int
+
+const (
+	// AccessPublish is checked for PUBLISH packets, with the topic name.
+	AccessPublish Access = 1 << iota
+	// AccessSubscribe is checked for each SUBSCRIBE topic filter.
+	AccessSubscribe
+)
+
+// Authorizer checks the topics clients publish and subscribe to.
+type Authorizer interface {
+	// Authorize reports whether client can access topic with QOS qos.
+	// Topic is a topic name for AccessPublish and a topic filter for
+	// AccessSubscribe. Denied messages are acknowledged but not routed,
+	// denied subscriptions are refused in SUBACK.
+	Authorize(client Client, topic string, access Access, qos int) bool
+}
+
+// AuthorizerFunc is an adapter to use a function as Authorizer.
+type AuthorizerFunc func(client Client, topic string, access Access, qos int) bool
+
+// Authorize calls f(client, topic, access, qos).
+func (f AuthorizerFunc) Authorize(client Client, topic string, access Access, qos int) bool {
+	return f(client, topic, access, qos)
+}
+
+// newClient returns the identity of client connecting on nc with CONNECT
+// packet connect.
+func newClient(nc net.Conn, connect mqtt.ConnectPacket) Client {
+	client := Client{
+		ID:         connect.ClientID,
+		Username:   connect.Username,
+		RemoteAddr: nc.RemoteAddr(),
+	}
+	// Handshake is complete, as CONNECT has been read.
+	if tc, ok := nc.(*tls.Conn); ok {
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			client.Certificate = certs[0]
+		}
+	}
+	return client
+}
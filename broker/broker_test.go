@@ -0,0 +1,713 @@
+package broker // import "gosrc.io/mqtt/broker"
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"gosrc.io/mqtt"
+	"gosrc.io/mqtt/mqtttest"
+)
+
+func TestConnect(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+
+	c := dial(s)
+	if connack := connect(t, c, mqtt.ConnectPacket{ClientID: "test", CleanSession: true}); connack.ReturnCode != mqtt.ConnAccepted {
+		t.Errorf("incorrect connect return code (%d) = %d", connack.ReturnCode, mqtt.ConnAccepted)
+	}
+
+	c = dial(s)
+	connack := connect(t, c, mqtt.ConnectPacket{ClientID: "test", ProtocolLevel: 5})
+	if connack.ReturnCode != mqtt.ConnRefusedBadProtocolVersion {
+		t.Errorf("incorrect connect return code (%d) = %d", connack.ReturnCode, mqtt.ConnRefusedBadProtocolVersion)
+	}
+	mqtttest.ExpectClosed(t, c)
+
+	// Client ID is only assigned by the server for clean sessions. ConnectPacket
+	// encoder does not send empty client ID: CONNECT is written as is.
+	for _, clean := range []bool{true, false} {
+		c = dial(s)
+		flags := byte(0)
+		expected := mqtt.ConnRefusedIDRejected
+		if clean {
+			flags = 2
+			expected = mqtt.ConnAccepted
+		}
+		c.Write([]byte{0x10, 12, 0, 4, 'M', 'Q', 'T', 'T', 4, flags, 0, 0, 0, 0})
+		if connack, _ := mqtttest.ReadPacket(t, c).(mqtt.ConnAckPacket); connack.ReturnCode != expected {
+			t.Errorf("incorrect connect return code for empty client ID (%d) = %d", connack.ReturnCode, expected)
+		}
+	}
+}
+
+func TestConnectFirstPacket(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+
+	c := dial(s)
+	mqtttest.WritePacket(t, c, mqtt.PingReqPacket{})
+	mqtttest.ExpectClosed(t, c)
+}
+
+func TestAuthentication(t *testing.T) {
+	var client Client
+	s := &Server{Authenticator: AuthenticatorFunc(func(c Client, password string) int {
+		client = c
+		if c.Username != "user" || password != "secret" {
+			return mqtt.ConnRefusedBadUsernameOrPassword
+		}
+		return mqtt.ConnAccepted
+	})}
+	defer s.Close()
+
+	c := dial(s)
+	connack := connect(t, c, mqtt.ConnectPacket{ClientID: "test", Username: "user", Password: "wrong"})
+	if connack.ReturnCode != mqtt.ConnRefusedBadUsernameOrPassword {
+		t.Errorf("incorrect connect return code (%d) = %d", connack.ReturnCode, mqtt.ConnRefusedBadUsernameOrPassword)
+	}
+	mqtttest.ExpectClosed(t, c)
+
+	c = dial(s)
+	connack = connect(t, c, mqtt.ConnectPacket{ClientID: "test", Username: "user", Password: "secret"})
+	if connack.ReturnCode != mqtt.ConnAccepted {
+		t.Errorf("incorrect connect return code (%d) = %d", connack.ReturnCode, mqtt.ConnAccepted)
+	}
+	if client.ID != "test" || client.Username != "user" || client.RemoteAddr == nil || client.Certificate != nil {
+		t.Errorf("incorrect authenticated client: %+v", client)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader("pattern readwrite devices/%c/#\ntopic read public/#"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Authorizer: acl}
+	defer s.Close()
+
+	c := dial(s)
+	connect(t, c, mqtt.ConnectPacket{ClientID: "dev1", CleanSession: true})
+	mqtttest.WritePacket(t, c, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{
+		{Name: "devices/dev1/#", QOS: 1},
+		{Name: "devices/#", QOS: 1},
+		{Name: "public/news", QOS: 0},
+	}})
+	expectSubAck(t, c, 1, []int{1, subscriptionFailure, 0})
+
+	// Denied messages are acknowledged but not routed.
+	mqtttest.WritePacket(t, c, mqtt.PublishPacket{ID: 2, Qos: 1, Topic: "public/news", Payload: []byte("denied")})
+	expect(t, c, mqtt.PubAckPacket{ID: 2})
+	mqtttest.WritePacket(t, c, mqtt.PublishPacket{Topic: "devices/dev1/status", Payload: []byte("allowed")})
+	if publish := expectPublish(t, c); string(publish.Payload) != "allowed" {
+		t.Errorf("incorrect routed message: %s", publish)
+	}
+}
+
+func TestSecondConnect(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+
+	c := dial(s)
+	connect(t, c, mqtt.ConnectPacket{ClientID: "test", CleanSession: true})
+	mqtttest.WritePacket(t, c, mqtt.ConnectPacket{ClientID: "test", CleanSession: true})
+	mqtttest.ExpectClosed(t, c)
+}
+
+func TestSessionTakeover(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+
+	c1 := dial(s)
+	connect(t, c1, mqtt.ConnectPacket{ClientID: "test", CleanSession: true})
+	c2 := dial(s)
+	connect(t, c2, mqtt.ConnectPacket{ClientID: "test", CleanSession: true})
+	mqtttest.ExpectClosed(t, c1)
+
+	mqtttest.WritePacket(t, c2, mqtt.PingReqPacket{})
+	expect(t, c2, mqtt.PingRespPacket{})
+}
+
+func TestRouting(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+
+	sub := dial(s)
+	connect(t, sub, mqtt.ConnectPacket{ClientID: "sub", CleanSession: true})
+	mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{
+		{Name: "sensors/+/temp", QOS: 1},
+		{Name: "sensors/#/temp", QOS: 1},
+	}})
+	expectSubAck(t, sub, 1, []int{1, subscriptionFailure})
+
+	pub := dial(s)
+	connect(t, pub, mqtt.ConnectPacket{ClientID: "pub", CleanSession: true})
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{Topic: "other/topic", Payload: []byte("ignored")})
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{ID: 7, Qos: 2, Retain: true, Topic: "sensors/kitchen/temp", Payload: []byte("21")})
+	expect(t, pub, mqtt.PubRecPacket{ID: 7})
+	// Duplicate is not routed again.
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{ID: 7, Qos: 2, Dup: true, Topic: "sensors/kitchen/temp", Payload: []byte("21")})
+	expect(t, pub, mqtt.PubRecPacket{ID: 7})
+	mqtttest.WritePacket(t, pub, mqtt.PubRelPacket{ID: 7})
+	expect(t, pub, mqtt.PubCompPacket{ID: 7})
+
+	// QOS is downgraded to subscription QOS, retain flag is cleared.
+	publish := expectPublish(t, sub)
+	if publish.Topic != "sensors/kitchen/temp" || string(publish.Payload) != "21" ||
+		publish.Qos != 1 || publish.Retain || publish.ID == 0 {
+		t.Errorf("incorrect routed message: %s", publish)
+	}
+	mqtttest.WritePacket(t, sub, mqtt.PubAckPacket{ID: publish.ID})
+
+	mqtttest.WritePacket(t, sub, mqtt.PingReqPacket{})
+	expect(t, sub, mqtt.PingRespPacket{})
+	if n := sessionInflight(s, "sub"); n != 0 {
+		t.Errorf("incorrect number of inflight messages (%d) = %d", n, 0)
+	}
+}
+
+func TestRoutingQOS2(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+
+	sub := dial(s)
+	connect(t, sub, mqtt.ConnectPacket{ClientID: "sub", CleanSession: true})
+	mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "#", QOS: 2}}})
+	expectSubAck(t, sub, 1, []int{2})
+
+	pub := dial(s)
+	connect(t, pub, mqtt.ConnectPacket{ClientID: "pub", CleanSession: true})
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{ID: 1, Qos: 2, Topic: "test/1", Payload: []byte("Hi")})
+	expect(t, pub, mqtt.PubRecPacket{ID: 1})
+
+	publish := expectPublish(t, sub)
+	if publish.Qos != 2 {
+		t.Errorf("incorrect routed message QOS (%d) = %d", publish.Qos, 2)
+	}
+	mqtttest.WritePacket(t, sub, mqtt.PubRecPacket{ID: publish.ID})
+	expect(t, sub, mqtt.PubRelPacket{ID: publish.ID})
+	mqtttest.WritePacket(t, sub, mqtt.PubCompPacket{ID: publish.ID})
+
+	mqtttest.WritePacket(t, sub, mqtt.UnsubscribePacket{ID: 2, Topics: []string{"#"}})
+	expect(t, sub, mqtt.UnsubAckPacket{ID: 2})
+	if n := sessionInflight(s, "sub"); n != 0 {
+		t.Errorf("incorrect number of inflight messages (%d) = %d", n, 0)
+	}
+}
+
+func TestRetained(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+
+	pub := dial(s)
+	connect(t, pub, mqtt.ConnectPacket{ClientID: "pub", CleanSession: true})
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{Retain: true, Topic: "home/kitchen/temp", Payload: []byte("21")})
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{ID: 1, Qos: 1, Retain: true, Topic: "home/status", Payload: []byte("online")})
+	expect(t, pub, mqtt.PubAckPacket{ID: 1})
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{Retain: true, Topic: "home/bedroom/temp", Payload: []byte("19")})
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{Retain: true, Topic: "home/bedroom/temp"})
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{Topic: "home/garage/temp", Payload: []byte("not retained")})
+	mqtttest.WritePacket(t, pub, mqtt.PingReqPacket{})
+	expect(t, pub, mqtt.PingRespPacket{})
+
+	// Retained messages follow SUBACK, with retain flag set and QOS
+	// downgraded to subscription QOS.
+	sub := dial(s)
+	connect(t, sub, mqtt.ConnectPacket{ClientID: "sub", CleanSession: true})
+	mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "home/#", QOS: 1}}})
+	expectSubAck(t, sub, 1, []int{1})
+	expected := []mqtt.PublishPacket{
+		{Qos: 0, Retain: true, Topic: "home/kitchen/temp", Payload: []byte("21")},
+		{Qos: 1, Retain: true, Topic: "home/status", Payload: []byte("online")},
+	}
+	for _, e := range expected {
+		publish := expectPublish(t, sub)
+		if publish.Topic != e.Topic || string(publish.Payload) != string(e.Payload) ||
+			publish.Qos != e.Qos || !publish.Retain {
+			t.Errorf("incorrect retained message (%s) = %s", publish, e)
+		}
+		if publish.Qos == 1 {
+			mqtttest.WritePacket(t, sub, mqtt.PubAckPacket{ID: publish.ID})
+		}
+	}
+
+	// Messages published to existing subscriptions do not have retain flag.
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{Retain: true, Topic: "home/status", Payload: []byte("offline")})
+	if publish := expectPublish(t, sub); publish.Retain || string(publish.Payload) != "offline" {
+		t.Errorf("incorrect routed message: %s", publish)
+	}
+	mqtttest.WritePacket(t, sub, mqtt.PingReqPacket{})
+	expect(t, sub, mqtt.PingRespPacket{})
+}
+
+func TestPersistentSession(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+
+	sub := dial(s)
+	if connack := connect(t, sub, mqtt.ConnectPacket{ClientID: "sub"}); connack.SessionPresent {
+		t.Error("session should not be present on first connection")
+	}
+	mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "test/#", QOS: 2}}})
+	expectSubAck(t, sub, 1, []int{2})
+
+	pub := dial(s)
+	connect(t, pub, mqtt.ConnectPacket{ClientID: "pub", CleanSession: true})
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{ID: 1, Qos: 1, Topic: "test/1", Payload: []byte("1")})
+	expect(t, pub, mqtt.PubAckPacket{ID: 1})
+	// Message is received but not acknowledged before disconnection.
+	first := expectPublish(t, sub)
+	mqtttest.WritePacket(t, sub, mqtt.DisconnectPacket{})
+	sub.Close()
+	waitOffline(t, s, "sub")
+
+	// QOS 0 messages are not queued for offline clients.
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{Topic: "test/0", Payload: []byte("0")})
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{ID: 2, Qos: 1, Topic: "test/2", Payload: []byte("2")})
+	expect(t, pub, mqtt.PubAckPacket{ID: 2})
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{ID: 3, Qos: 2, Topic: "test/3", Payload: []byte("3")})
+	expect(t, pub, mqtt.PubRecPacket{ID: 3})
+
+	sub = dial(s)
+	if connack := connect(t, sub, mqtt.ConnectPacket{ClientID: "sub"}); !connack.SessionPresent {
+		t.Error("session should be present on reconnection")
+	}
+	expected := []mqtt.PublishPacket{
+		{ID: first.ID, Qos: 1, Dup: true, Topic: "test/1", Payload: []byte("1")},
+		{Qos: 1, Topic: "test/2", Payload: []byte("2")},
+		{Qos: 2, Topic: "test/3", Payload: []byte("3")},
+	}
+	for _, e := range expected {
+		publish := expectPublish(t, sub)
+		if publish.Topic != e.Topic || publish.Qos != e.Qos || publish.Dup != e.Dup ||
+			(e.ID != 0 && publish.ID != e.ID) {
+			t.Errorf("incorrect queued message (%s) = %s", publish, e)
+		}
+		if publish.Qos == 1 {
+			mqtttest.WritePacket(t, sub, mqtt.PubAckPacket{ID: publish.ID})
+		} else {
+			mqtttest.WritePacket(t, sub, mqtt.PubRecPacket{ID: publish.ID})
+			expect(t, sub, mqtt.PubRelPacket{ID: publish.ID})
+			mqtttest.WritePacket(t, sub, mqtt.PubCompPacket{ID: publish.ID})
+		}
+	}
+	mqtttest.WritePacket(t, sub, mqtt.PingReqPacket{})
+	expect(t, sub, mqtt.PingRespPacket{})
+	if n := sessionInflight(s, "sub"); n != 0 {
+		t.Errorf("incorrect number of inflight messages (%d) = %d", n, 0)
+	}
+	sub.Close()
+	waitOffline(t, s, "sub")
+
+	// Clean session discards the previous session and its subscriptions.
+	sub = dial(s)
+	if connack := connect(t, sub, mqtt.ConnectPacket{ClientID: "sub", CleanSession: true}); connack.SessionPresent {
+		t.Error("session should not be present for clean session")
+	}
+	mqtttest.WritePacket(t, pub, mqtt.PublishPacket{Topic: "test/4", Payload: []byte("4")})
+	mqtttest.WritePacket(t, sub, mqtt.PingReqPacket{})
+	expect(t, sub, mqtt.PingRespPacket{})
+}
+
+func TestOfflineQueueLimit(t *testing.T) {
+	s := &Server{MaxQueuedMessages: 2}
+	defer s.Close()
+
+	sub := dial(s)
+	connect(t, sub, mqtt.ConnectPacket{ClientID: "sub"})
+	mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "test", QOS: 1}}})
+	expectSubAck(t, sub, 1, []int{1})
+	sub.Close()
+	waitOffline(t, s, "sub")
+
+	pub := dial(s)
+	connect(t, pub, mqtt.ConnectPacket{ClientID: "pub", CleanSession: true})
+	for id := 1; id <= 3; id++ {
+		mqtttest.WritePacket(t, pub, mqtt.PublishPacket{ID: id, Qos: 1, Topic: "test", Payload: []byte{byte(id)}})
+		expect(t, pub, mqtt.PubAckPacket{ID: id})
+	}
+
+	sub = dial(s)
+	connect(t, sub, mqtt.ConnectPacket{ClientID: "sub"})
+	for id := 1; id <= 2; id++ {
+		if publish := expectPublish(t, sub); publish.Payload[0] != byte(id) {
+			t.Errorf("incorrect queued message (%d) = %d", publish.Payload[0], id)
+		}
+	}
+	mqtttest.WritePacket(t, sub, mqtt.PingReqPacket{})
+	expect(t, sub, mqtt.PingRespPacket{})
+}
+
+func TestInflightLimit(t *testing.T) {
+	s := &Server{MaxQueuedMessages: 2}
+	defer s.Close()
+
+	// Subscriber is connected, but never acknowledges messages.
+	sub := dial(s)
+	connect(t, sub, mqtt.ConnectPacket{ClientID: "sub"})
+	mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "test", QOS: 1}}})
+	expectSubAck(t, sub, 1, []int{1})
+
+	pub := dial(s)
+	connect(t, pub, mqtt.ConnectPacket{ClientID: "pub", CleanSession: true})
+	for id := 1; id <= 3; id++ {
+		mqtttest.WritePacket(t, pub, mqtt.PublishPacket{ID: id, Qos: 1, Topic: "test", Payload: []byte{byte(id)}})
+		expect(t, pub, mqtt.PubAckPacket{ID: id})
+	}
+	for id := 1; id <= 2; id++ {
+		if publish := expectPublish(t, sub); publish.Payload[0] != byte(id) {
+			t.Errorf("incorrect message (%d) = %d", publish.Payload[0], id)
+		}
+	}
+	mqtttest.WritePacket(t, sub, mqtt.PingReqPacket{})
+	expect(t, sub, mqtt.PingRespPacket{})
+	sub.Close()
+	waitOffline(t, s, "sub")
+
+	// Only unacknowledged messages are sent again.
+	sub = dial(s)
+	connect(t, sub, mqtt.ConnectPacket{ClientID: "sub"})
+	for id := 1; id <= 2; id++ {
+		if publish := expectPublish(t, sub); publish.Payload[0] != byte(id) || !publish.Dup {
+			t.Errorf("incorrect message sent again: %s", publish)
+		}
+	}
+	mqtttest.WritePacket(t, sub, mqtt.PingReqPacket{})
+	expect(t, sub, mqtt.PingRespPacket{})
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := &Server{SessionExpiry: 50 * time.Millisecond}
+	defer s.Close()
+
+	c := dial(s)
+	connect(t, c, mqtt.ConnectPacket{ClientID: "test"})
+	c.Close()
+	waitOffline(t, s, "test")
+
+	deadline := time.Now().Add(time.Second)
+	for hasSession(s, "test") {
+		if time.Now().After(deadline) {
+			t.Fatal("session did not expire")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c = dial(s)
+	if connack := connect(t, c, mqtt.ConnectPacket{ClientID: "test"}); connack.SessionPresent {
+		t.Error("session should not be present after expiry")
+	}
+}
+
+func TestSys(t *testing.T) {
+	s := &Server{SysInterval: 20 * time.Millisecond, SysTopics: []string{SysClientsConnected, SysPublishReceived}}
+	defer s.Close()
+
+	c := dial(s)
+	connect(t, c, mqtt.ConnectPacket{ClientID: "test", CleanSession: true})
+	mqtttest.WritePacket(t, c, mqtt.PublishPacket{Topic: "test", Payload: []byte("Hi")})
+	mqtttest.WritePacket(t, c, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "$SYS/#"}}})
+	expectSubAck(t, c, 1, []int{0})
+
+	expected := map[string]string{
+		SysClientsConnected: "1",
+		SysPublishReceived:  "1",
+	}
+	values := make(map[string]string)
+	for i := 0; i < 10 && !equalValues(values, expected); i++ {
+		publish := expectPublish(t, c)
+		if _, ok := expected[publish.Topic]; !ok {
+			t.Fatalf("incorrect $SYS topic: %s", publish.Topic)
+		}
+		values[publish.Topic] = string(publish.Payload)
+	}
+	if !equalValues(values, expected) {
+		t.Errorf("incorrect $SYS values (%v) = %v", values, expected)
+	}
+	if retained, _ := s.retained().Match("$SYS/#"); len(retained) != 0 {
+		t.Errorf("$SYS messages should not be in retained store: %v", retained)
+	}
+
+	// $SYS values are sent to new subscribers as retained messages.
+	late := dial(s)
+	connect(t, late, mqtt.ConnectPacket{ClientID: "late", CleanSession: true})
+	mqtttest.WritePacket(t, late, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: SysClientsConnected}}})
+	expectSubAck(t, late, 1, []int{0})
+	if publish := expectPublish(t, late); publish.Topic != SysClientsConnected || !publish.Retain {
+		t.Errorf("incorrect retained $SYS message: %s", publish)
+	}
+}
+
+func TestSysReserved(t *testing.T) {
+	s := &Server{SysInterval: -1}
+	defer s.Close()
+
+	sub := dial(s)
+	connect(t, sub, mqtt.ConnectPacket{ClientID: "sub", CleanSession: true})
+	mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "$SYS/#"}, {Name: "#"}}})
+	expectSubAck(t, sub, 1, []int{0, 0})
+
+	// Clients cannot publish to $ topics: Message is acknowledged and dropped.
+	c := dial(s)
+	connect(t, c, mqtt.ConnectPacket{ClientID: "test", CleanSession: true})
+	spoofed := mqtt.PublishPacket{ID: 1, Qos: 1, Retain: true, Topic: SysClientsConnected, Payload: []byte("1000")}
+	mqtttest.WritePacket(t, c, spoofed)
+	expect(t, c, mqtt.PubAckPacket{ID: 1})
+	mqtttest.WritePacket(t, c, mqtt.PublishPacket{ID: 2, Qos: 1, Topic: "test", Payload: []byte("Hi")})
+	expect(t, c, mqtt.PubAckPacket{ID: 2})
+
+	if publish := expectPublish(t, sub); publish.Topic != "test" {
+		t.Errorf("incorrect topic (%s) = %s", publish.Topic, "test")
+	}
+	if retained, _ := s.retained().Match("$SYS/#"); len(retained) != 0 {
+		t.Errorf("$SYS messages should not be retained: %v", retained)
+	}
+}
+
+func TestWill(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+
+	sub := dial(s)
+	connect(t, sub, mqtt.ConnectPacket{ClientID: "sub", CleanSession: true})
+	mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "status/#", QOS: 1}}})
+	expectSubAck(t, sub, 1, []int{1})
+
+	withWill := func(clientID string, qos int, retain bool) mqtt.ConnectPacket {
+		connect := mqtt.ConnectPacket{ClientID: clientID, CleanSession: true}
+		connect.SetWill("status/"+clientID, []byte("offline"), qos)
+		connect.WillRetain = retain
+		return connect
+	}
+
+	// Will is not published on DISCONNECT.
+	c := dial(s)
+	connect(t, c, withWill("clean", 0, false))
+	mqtttest.WritePacket(t, c, mqtt.DisconnectPacket{})
+	mqtttest.ExpectClosed(t, c)
+
+	// Network connection lost
+	c = dial(s)
+	connect(t, c, withWill("lost", 0, false))
+	c.Close()
+	if publish := expectPublish(t, sub); publish.Topic != "status/lost" || string(publish.Payload) != "offline" {
+		t.Errorf("incorrect will message: %s", publish)
+	}
+
+	// Protocol error: Will QOS and retain flag are kept.
+	c = dial(s)
+	connect(t, c, withWill("error", 1, true))
+	mqtttest.WritePacket(t, c, mqtt.ConnAckPacket{})
+	mqtttest.ExpectClosed(t, c)
+	publish := expectPublish(t, sub)
+	if publish.Topic != "status/error" || publish.Qos != 1 {
+		t.Errorf("incorrect will message: %s", publish)
+	}
+	mqtttest.WritePacket(t, sub, mqtt.PubAckPacket{ID: publish.ID})
+	if retained, _ := s.retained().Match("status/error"); len(retained) != 1 {
+		t.Error("will message should be retained")
+	}
+
+	mqtttest.WritePacket(t, sub, mqtt.PingReqPacket{})
+	expect(t, sub, mqtt.PingRespPacket{})
+
+	// Invalid will topic is a protocol violation.
+	c = dial(s)
+	invalid := mqtt.ConnectPacket{ClientID: "invalid", CleanSession: true}
+	invalid.SetWill("status/#", []byte("offline"), 0)
+	mqtttest.WritePacket(t, c, invalid)
+	mqtttest.ExpectClosed(t, c)
+}
+
+func TestWillKeepalive(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+
+	sub := dial(s)
+	connect(t, sub, mqtt.ConnectPacket{ClientID: "sub", CleanSession: true})
+	mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "status"}}})
+	expectSubAck(t, sub, 1, []int{0})
+
+	c := dial(s)
+	will := mqtt.ConnectPacket{ClientID: "test", CleanSession: true, Keepalive: 1}
+	will.SetWill("status", []byte("offline"), 0)
+	connect(t, c, will)
+
+	sub.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p, err := mqtt.PacketRead(sub)
+	if err != nil {
+		t.Fatalf("will was not published on keepalive expiry: %s", err)
+	}
+	if publish, ok := p.(mqtt.PublishPacket); !ok || publish.Topic != "status" {
+		t.Errorf("incorrect will message: %s", p)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	s := &Server{}
+	defer s.Close()
+
+	c := dial(s)
+	connect(t, c, mqtt.ConnectPacket{ClientID: "test", CleanSession: true, Keepalive: 1})
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := mqtt.PacketRead(c); err == nil {
+		t.Fatal("connection should be closed on keepalive expiry")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 2500*time.Millisecond {
+		t.Errorf("incorrect keepalive expiry (%s) = %s", elapsed, 1500*time.Millisecond)
+	}
+}
+
+func TestServeClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(l)
+	}()
+	address := "tcp://" + l.Addr().String()
+
+	received := make(chan mqtt.Message, 1)
+	sub := mqtt.NewClient(address)
+	sub.ClientID = "sub"
+	if err := sub.Connect(make(chan mqtt.Message)); err != nil {
+		t.Fatalf("MQTT connection failed: %s", err)
+	}
+	handler := mqtt.HandlerFunc(func(m mqtt.Message) { received <- m })
+	if err := sub.SubscribeHandler(mqtt.Topic{Name: "test/+", QOS: 1}, handler); err != nil {
+		t.Fatal(err)
+	}
+	mqtttest.WaitSubscription(t, sub, "test/+")
+
+	pub := mqtt.NewClient(address)
+	pub.ClientID = "pub"
+	if err := pub.Connect(make(chan mqtt.Message)); err != nil {
+		t.Fatalf("MQTT connection failed: %s", err)
+	}
+	if err := pub.PublishMessage(mqtt.Message{Topic: "test/1", Payload: []byte("Hi"), QOS: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-received:
+		if m.Topic != "test/1" || string(m.Payload) != "Hi" || m.QOS != 1 {
+			t.Errorf("incorrect message received (%s, %q, %d)", m.Topic, m.Payload, m.QOS)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was not routed")
+	}
+
+	pub.Disconnect()
+	sub.Disconnect()
+	if err := s.Close(); err != nil {
+		t.Errorf("cannot close server: %s", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("incorrect serve error (%v) = %v", err, ErrServerClosed)
+	}
+}
+
+//=============================================================================
+// Helpers
+
+// dial connects to the server through an in-memory connection.
+func dial(s *Server) net.Conn {
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	return client
+}
+
+func connect(t *testing.T, c net.Conn, connect mqtt.ConnectPacket) mqtt.ConnAckPacket {
+	t.Helper()
+	mqtttest.WritePacket(t, c, connect)
+	p := mqtttest.ReadPacket(t, c)
+	connack, ok := p.(mqtt.ConnAckPacket)
+	if !ok {
+		t.Fatalf("incorrect packet received (%s) = CONNACK", p)
+	}
+	return connack
+}
+
+// expect reads next packet and compares it with expected, which must be
+// comparable.
+func expect(t *testing.T, c net.Conn, expected mqtt.Packet) {
+	t.Helper()
+	if p := mqtttest.ReadPacket(t, c); p != expected {
+		t.Errorf("incorrect packet received (%s) = %s", p, expected)
+	}
+}
+
+func expectPublish(t *testing.T, c net.Conn) mqtt.PublishPacket {
+	t.Helper()
+	p := mqtttest.ReadPacket(t, c)
+	publish, ok := p.(mqtt.PublishPacket)
+	if !ok {
+		t.Fatalf("incorrect packet received (%s) = PUBLISH", p)
+	}
+	return publish
+}
+
+func expectSubAck(t *testing.T, c net.Conn, id int, codes []int) {
+	t.Helper()
+	p := mqtttest.ReadPacket(t, c)
+	suback, ok := p.(mqtt.SubAckPacket)
+	if !ok || suback.ID != id || len(suback.ReturnCodes) != len(codes) {
+		t.Fatalf("incorrect packet received (%s) = SUBACK id=%d %v", p, id, codes)
+	}
+	for i, code := range codes {
+		if suback.ReturnCodes[i] != code {
+			t.Errorf("incorrect SUBACK return codes (%v) = %v", suback.ReturnCodes, codes)
+		}
+	}
+}
+
+func sessionInflight(s *Server, clientID string) int {
+	s.mu.RLock()
+	sess := s.sessions[clientID]
+	s.mu.RUnlock()
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return len(sess.inflight)
+}
+
+func equalValues(values, expected map[string]string) bool {
+	if len(values) != len(expected) {
+		return false
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func hasSession(s *Server, clientID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, found := s.sessions[clientID]
+	return found
+}
+
+// waitOffline waits until the session of client ID has no connection.
+func waitOffline(t *testing.T, s *Server, clientID string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.RLock()
+		sess := s.sessions[clientID]
+		s.mu.RUnlock()
+		if sess != nil && sess.offline() {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session of %s is not offline", clientID)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,334 @@
+package broker // import "gosrc.io/mqtt/broker"
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gosrc.io/mqtt"
+	"gosrc.io/mqtt/topic"
+)
+
+var (
+	// errDisconnect is returned by the reader when the client sends
+	// DISCONNECT.
+	errDisconnect = errors.New("client disconnected")
+	// errProtocol is returned by the reader when the client violates the
+	// protocol. The connection is closed without response.
+	errProtocol = errors.New("protocol violation")
+)
+
+// conn is a client network connection to the broker.
+type conn struct {
+	server *Server
+	nc     net.Conn
+	client Client
+	sess   *session
+	// Will message, published if the connection is not closed with
+	// DISCONNECT
+	will *mqtt.PublishPacket
+	// Time allowed between two packets from the client (zero if disabled)
+	keepalive time.Duration
+
+	quit      chan struct{}
+	closeOnce sync.Once
+	// Closed when serve returns
+	done chan struct{}
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	return &conn{
+		server: s,
+		nc:     nc,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// serve runs the connection until the client disconnects, the connection
+// fails or the broker closes it.
+func (c *conn) serve() {
+	defer close(c.done)
+	defer c.close()
+
+	decoder := mqtt.NewDecoder(bufio.NewReader(c.nc))
+	decoder.MaxPacketSize = c.server.MaxPacketSize
+
+	// 1. Connect: First packet must be CONNECT [MQTT-3.1.0-1]
+	if err := c.nc.SetReadDeadline(time.Now().Add(c.server.connectTimeout())); err != nil {
+		return
+	}
+	p, err := decoder.Decode()
+	if err != nil {
+		return
+	}
+	c.server.packetReceived(p)
+	connect, ok := p.(mqtt.ConnectPacket)
+	if !ok || !validWill(connect) {
+		return
+	}
+	if code := c.accept(&connect); code != mqtt.ConnAccepted {
+		connack := mqtt.ConnAckPacket{ReturnCode: code}
+		if _, err := connack.WriteTo(c.nc); err == nil {
+			c.server.packetSent(connack)
+		}
+		return
+	}
+
+	sess, present := c.server.attach(connect.ClientID, c, connect.CleanSession)
+	defer c.server.detach(sess, c)
+	c.sess = sess
+	log := c.server.logger()
+	log.Info("client connected", "client_id", sess.id, "remote_addr", c.nc.RemoteAddr().String(),
+		"session_present", present)
+
+	// CONNACK is written before any queued packet [MQTT-3.2.2-2]
+	// [MQTT-3.2.2-3].
+	connack := mqtt.ConnAckPacket{SessionPresent: present, ReturnCode: mqtt.ConnAccepted}
+	if _, err := connack.WriteTo(c.nc); err != nil {
+		return
+	}
+	c.server.packetSent(connack)
+
+	// 2. Start writer and read packets
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		c.writeLoop()
+	}()
+	defer writer.Wait()
+
+	for err == nil {
+		if err = c.setKeepaliveDeadline(); err != nil {
+			break
+		}
+		if p, err = decoder.Decode(); err == nil {
+			c.server.packetReceived(p)
+			err = c.handle(p)
+		}
+	}
+	c.close()
+	if err == errDisconnect {
+		return
+	}
+	log.Info("client connection closed", "client_id", sess.id, "error", err)
+
+	// Connection closed by network error, keepalive expiry, protocol error
+	// or session takeover: Will is published [MQTT-3.1.2-8].
+	if c.will != nil && !c.server.isClosed() {
+		log.Info("publishing will", "client_id", sess.id, "topic", c.will.Topic)
+		c.publish(*c.will)
+	}
+}
+
+// accept checks CONNECT packet and authenticates the client. It returns
+// the CONNACK return code. It assigns a client ID to clients that do not
+// provide one.
+func (c *conn) accept(connect *mqtt.ConnectPacket) int {
+	switch {
+	case connect.ProtocolName == mqtt.ProtocolName && connect.ProtocolLevel == mqtt.ProtocolLevel:
+	case connect.ProtocolName == "MQIsdp" && connect.ProtocolLevel == 3:
+	default:
+		return mqtt.ConnRefusedBadProtocolVersion
+	}
+
+	if connect.ClientID == "" {
+		// Only clients with clean session can have their ID assigned
+		// by the server [MQTT-3.1.3-7] [MQTT-3.1.3-8].
+		if !connect.CleanSession {
+			return mqtt.ConnRefusedIDRejected
+		}
+		connect.ClientID = generateClientID()
+	}
+
+	c.client = newClient(c.nc, *connect)
+	if code := c.server.authenticate(c.client, connect.Password); code != mqtt.ConnAccepted {
+		c.server.logger().Warn("client refused", "client_id", connect.ClientID,
+			"remote_addr", c.nc.RemoteAddr().String(), "return_code", code)
+		return code
+	}
+
+	if connect.WillFlag {
+		c.will = &mqtt.PublishPacket{
+			Topic:   connect.WillTopic,
+			Payload: connect.WillMessage,
+			Qos:     connect.WillQOS,
+			Retain:  connect.WillRetain,
+		}
+	}
+	c.keepalive = time.Duration(connect.Keepalive) * time.Second
+	return mqtt.ConnAccepted
+}
+
+// validWill reports whether the will of CONNECT packet, if any, has a valid
+// topic name and QOS. Invalid will is a protocol violation.
+func validWill(connect mqtt.ConnectPacket) bool {
+	if !connect.WillFlag {
+		return true
+	}
+	return topic.ValidateName(connect.WillTopic) == nil && connect.WillQOS >= 0 && connect.WillQOS <= 2
+}
+
+// setKeepaliveDeadline closes the connection if the client does not send
+// anything within one and a half keepalive period [MQTT-3.1.2-24].
+func (c *conn) setKeepaliveDeadline() error {
+	if c.keepalive == 0 {
+		return c.nc.SetReadDeadline(time.Time{})
+	}
+	return c.nc.SetReadDeadline(time.Now().Add(c.keepalive * 3 / 2))
+}
+
+// close closes the network connection and stops the writer.
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.quit)
+		_ = c.nc.Close()
+	})
+}
+
+// writeLoop writes the session queued packets to the client, starting
+// with packets queued before the connection was established.
+func (c *conn) writeLoop() {
+	w := bufio.NewWriter(c.nc)
+	encoder := mqtt.NewEncoder(w)
+	for {
+		if packets := c.sess.take(c); len(packets) > 0 {
+			for _, p := range packets {
+				if err := encoder.Encode(p); err != nil {
+					c.close()
+					return
+				}
+				c.server.packetSent(p)
+			}
+			if err := w.Flush(); err != nil {
+				c.close()
+				return
+			}
+		}
+		select {
+		case <-c.sess.notify:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// ============================================================================
+// Packet handling
+
+// handle processes packet p received from the client.
+func (c *conn) handle(p mqtt.Packet) error {
+	switch packet := p.(type) {
+	case mqtt.PublishPacket:
+		return c.handlePublish(packet)
+	case mqtt.PubAckPacket:
+		c.sess.acked(packet.ID)
+	case mqtt.PubRecPacket:
+		c.sess.pubReceived(packet.ID)
+	case mqtt.PubRelPacket:
+		c.sess.release(packet.ID)
+		c.sess.send(mqtt.PubCompPacket{ID: packet.ID})
+	case mqtt.PubCompPacket:
+		c.sess.acked(packet.ID)
+	case mqtt.SubscribePacket:
+		c.handleSubscribe(packet)
+	case mqtt.UnsubscribePacket:
+		for _, filter := range packet.Topics {
+			c.sess.unsubscribe(filter)
+		}
+		c.sess.send(mqtt.UnsubAckPacket{ID: packet.ID})
+	case mqtt.PingReqPacket:
+		c.sess.send(mqtt.PingRespPacket{})
+	case mqtt.DisconnectPacket:
+		return errDisconnect
+	default:
+		// Second CONNECT [MQTT-3.1.0-2] or packet only sent by servers.
+		return errProtocol
+	}
+	return nil
+}
+
+func (c *conn) handlePublish(publish mqtt.PublishPacket) error {
+	if topic.ValidateName(publish.Topic) != nil || publish.Qos > 2 {
+		return errProtocol
+	}
+
+	switch publish.Qos {
+	case 0:
+		c.publish(publish)
+	case 1:
+		c.publish(publish)
+		c.sess.send(mqtt.PubAckPacket{ID: publish.ID})
+	case 2:
+		// Message is routed only once, even if the client sends it again
+		// before receiving PUBREC.
+		if c.sess.receive(publish.ID) {
+			c.publish(publish)
+		}
+		c.sess.send(mqtt.PubRecPacket{ID: publish.ID})
+	}
+	return nil
+}
+
+// publish stores publish if it is retained, and routes it to subscribers.
+// Retained messages with an empty payload are routed as usual. Messages the
+// client is not allowed to publish are discarded: They are still
+// acknowledged, as MQTT 3.1.1 has no way to report the refusal
+// [MQTT-3.3.5-2]. Topics starting with $ are reserved for the server, so
+// that clients cannot publish fake $SYS statistics [MQTT-4.7.2-1].
+func (c *conn) publish(publish mqtt.PublishPacket) {
+	if strings.HasPrefix(publish.Topic, "$") {
+		c.server.logger().Warn("publish to reserved topic dropped", "client_id", c.client.ID, "topic", publish.Topic)
+		return
+	}
+	if !c.server.authorize(c.client, publish.Topic, AccessPublish, publish.Qos) {
+		c.server.logger().Warn("publish denied", "client_id", c.client.ID, "topic", publish.Topic)
+		return
+	}
+	if publish.Retain {
+		c.server.retain(publish)
+	}
+	c.server.route(publish)
+}
+
+func (c *conn) handleSubscribe(subscribe mqtt.SubscribePacket) {
+	suback := mqtt.SubAckPacket{ID: subscribe.ID}
+	var granted []mqtt.Topic
+	for _, t := range subscribe.Topics {
+		if !validFilter(t.Name) || t.QOS < 0 || t.QOS > 2 {
+			suback.ReturnCodes = append(suback.ReturnCodes, subscriptionFailure)
+			continue
+		}
+		if !c.server.authorize(c.client, t.Name, AccessSubscribe, t.QOS) {
+			c.server.logger().Warn("subscription denied", "client_id", c.client.ID, "topic", t.Name)
+			suback.ReturnCodes = append(suback.ReturnCodes, subscriptionFailure)
+			continue
+		}
+		c.sess.subscribe(t.Name, t.QOS)
+		suback.ReturnCodes = append(suback.ReturnCodes, t.QOS)
+		granted = append(granted, t)
+	}
+	c.sess.send(suback)
+
+	// Retained messages are sent after SUBACK.
+	for _, t := range granted {
+		c.server.sendRetained(c.sess, t.Name, t.QOS)
+	}
+}
+
+// subscriptionFailure is the SUBACK return code of refused subscriptions.
+const subscriptionFailure = 0x80
+
+// generateClientID returns a unique client ID for clients connecting
+// without one.
+func generateClientID() string {
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	return "auto-" + hex.EncodeToString(b[:])
+}
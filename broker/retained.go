@@ -0,0 +1,182 @@
+package broker // import "gosrc.io/mqtt/broker"
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"gosrc.io/mqtt"
+	"gosrc.io/mqtt/topic"
+)
+
+// RetainedMessage is the last message published with the retain flag on a
+// topic.
+type RetainedMessage struct {
+	Topic   string
+	Payload []byte
+	QOS     int
+}
+
+// RetainedStore keeps the retained message of each topic. Implementations
+// must be safe for concurrent use.
+type RetainedStore interface {
+	// Store replaces the retained message of m topic with m. A message with
+	// an empty payload deletes the retained message of the topic
+	// [MQTT-3.3.1-10].
+	Store(m RetainedMessage) error
+	// Match returns the retained messages whose topic matches topic filter,
+	// sorted by topic.
+	Match(filter string) ([]RetainedMessage, error)
+}
+
+// ============================================================================
+// In-memory store
+
+// MemoryStore is a RetainedStore keeping messages in memory. The zero value
+// is an empty store ready to use.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	messages map[string]RetainedMessage
+}
+
+// NewMemoryStore returns an empty in-memory retained message store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Store implements RetainedStore.
+func (s *MemoryStore) Store(m RetainedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(m.Payload) == 0 {
+		delete(s.messages, m.Topic)
+		return nil
+	}
+	if s.messages == nil {
+		s.messages = make(map[string]RetainedMessage)
+	}
+	m.Payload = append([]byte(nil), m.Payload...)
+	s.messages[m.Topic] = m
+	return nil
+}
+
+// Match implements RetainedStore.
+func (s *MemoryStore) Match(filter string) ([]RetainedMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var messages []RetainedMessage
+	for name, m := range s.messages {
+		if topic.Match(filter, name) {
+			messages = append(messages, m)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Topic < messages[j].Topic })
+	return messages, nil
+}
+
+// all returns all messages of the store. s.mu must be held.
+func (s *MemoryStore) all() []RetainedMessage {
+	messages := make([]RetainedMessage, 0, len(s.messages))
+	for _, m := range s.messages {
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// ============================================================================
+// File-backed store
+
+// FileStore is a RetainedStore keeping messages in memory and saving them
+// to a file, so that they survive broker restarts. Messages are saved as a
+// sequence of MQTT PUBLISH packets.
+//
+// The whole file is rewritten on each change: FileStore is meant for a
+// moderate number of retained topics.
+type FileStore struct {
+	path string
+
+	// Serializes file updates
+	mu     sync.Mutex
+	memory MemoryStore
+}
+
+// OpenFileStore returns a retained message store saved to file path. Messages
+// already saved in the file are loaded. The file is created on first
+// change if it does not exist.
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoder := mqtt.NewDecoder(bufio.NewReader(f))
+	for {
+		p, err := decoder.Decode()
+		if err == io.EOF {
+			return s, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if publish, ok := p.(mqtt.PublishPacket); ok {
+			_ = s.memory.Store(RetainedMessage{Topic: publish.Topic, Payload: publish.Payload, QOS: publish.Qos})
+		}
+	}
+}
+
+// Store implements RetainedStore. The file is written before Store returns.
+func (s *FileStore) Store(m RetainedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.memory.Store(m); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// Match implements RetainedStore.
+func (s *FileStore) Match(filter string) ([]RetainedMessage, error) {
+	return s.memory.Match(filter)
+}
+
+// save writes all messages to a temporary file, which then replaces the
+// store file. s.mu must be held.
+func (s *FileStore) save() error {
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	encoder := mqtt.NewEncoder(w)
+	s.memory.mu.RLock()
+	for _, m := range s.memory.all() {
+		if err = encoder.Encode(mqtt.PublishPacket{Topic: m.Topic, Payload: m.Payload, Qos: m.QOS, Retain: true}); err != nil {
+			break
+		}
+	}
+	s.memory.mu.RUnlock()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
@@ -0,0 +1,99 @@
+package broker // import "gosrc.io/mqtt/broker"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testRetainedStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retained")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "retained.db")
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRetainedStore(t, s)
+
+	// Messages are loaded when the file is opened again.
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := s.Match("#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Topic != "home/kitchen/temp" || string(messages[0].Payload) != "22" ||
+		messages[0].QOS != 1 || messages[1].Topic != "home/status" {
+		t.Errorf("incorrect loaded messages: %v", messages)
+	}
+}
+
+func testRetainedStore(t *testing.T, s RetainedStore) {
+	t.Helper()
+	for _, m := range []RetainedMessage{
+		{Topic: "home/kitchen/temp", Payload: []byte("21")},
+		{Topic: "home/kitchen/temp", Payload: []byte("22"), QOS: 1},
+		{Topic: "home/bedroom/temp", Payload: []byte("19")},
+		{Topic: "home/status", Payload: []byte("online")},
+		{Topic: "$SYS/uptime", Payload: []byte("10")},
+		// Empty payload removes the retained message.
+		{Topic: "home/bedroom/temp"},
+	} {
+		if err := s.Store(m); err != nil {
+			t.Fatalf("cannot store %s: %s", m.Topic, err)
+		}
+	}
+
+	tests := []struct {
+		filter string
+		topics []string
+	}{
+		{"home/kitchen/temp", []string{"home/kitchen/temp"}},
+		{"home/+/temp", []string{"home/kitchen/temp"}},
+		{"home/#", []string{"home/kitchen/temp", "home/status"}},
+		{"#", []string{"home/kitchen/temp", "home/status"}},
+		{"$SYS/#", []string{"$SYS/uptime"}},
+		{"office/#", nil},
+	}
+	for _, tt := range tests {
+		messages, err := s.Match(tt.filter)
+		if err != nil {
+			t.Fatalf("cannot match %s: %s", tt.filter, err)
+		}
+		var topics []string
+		for _, m := range messages {
+			topics = append(topics, m.Topic)
+		}
+		if len(topics) != len(tt.topics) {
+			t.Errorf("incorrect retained messages for %s (%v) = %v", tt.filter, topics, tt.topics)
+			continue
+		}
+		for i := range topics {
+			if topics[i] != tt.topics[i] {
+				t.Errorf("incorrect retained messages for %s (%v) = %v", tt.filter, topics, tt.topics)
+				break
+			}
+		}
+	}
+
+	// Removing the message of a topic without retained message is not an
+	// error.
+	if err := s.Store(RetainedMessage{Topic: "$SYS/uptime"}); err != nil {
+		t.Errorf("cannot remove retained message: %s", err)
+	}
+	if err := s.Store(RetainedMessage{Topic: "unknown"}); err != nil {
+		t.Errorf("cannot remove unknown retained message: %s", err)
+	}
+}
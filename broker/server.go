@@ -0,0 +1,469 @@
+/*
+Package broker implements an embeddable MQTT 3.1.1 server, built on the
+mqtt package codecs.
+
+The broker accepts client connections, keeps track of their sessions and
+subscriptions, and routes published messages to the subscribers whose topic
+filter matches, with QOS 0, 1 or 2. Retained messages are kept in a
+RetainedStore, in memory by default, and sent to new subscribers. Sessions
+of clients connecting with CleanSession false are kept when they disconnect,
+with their QOS 1 and 2 messages queued until they connect again. Access is
+controlled with an Authenticator and an Authorizer, such as ACL. Broker
+statistics are published as retained messages in $SYS topics, kept in
+memory apart from the RetainedStore:
+
+	server := &broker.Server{Addr: ":1883"}
+	log.Fatal(server.ListenAndServe())
+
+Server.Serve accepts connections on any net.Listener and Server.ServeConn
+serves a single connection, for example one end of a net.Pipe.
+*/
+package broker // import "gosrc.io/mqtt/broker"
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"gosrc.io/mqtt"
+	"gosrc.io/mqtt/metrics"
+	"gosrc.io/mqtt/topic"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close.
+var ErrServerClosed = errors.New("mqtt: broker closed")
+
+const (
+	// DefaultAddr is the address used by ListenAndServe when Server Addr is
+	// empty.
+	DefaultAddr = ":1883"
+	// DefaultConnectTimeout is the default time a client has to send CONNECT
+	// after opening the connection.
+	DefaultConnectTimeout = 10 * time.Second
+	// DefaultMaxQueuedMessages is the default number of messages a session
+	// can have waiting to be written to the client.
+	DefaultMaxQueuedMessages = 1000
+)
+
+// Server is an MQTT broker. Its exported fields must be set before the
+// server starts serving connections.
+type Server struct {
+	// Addr is the TCP address to listen on with ListenAndServe.
+	// Default is DefaultAddr.
+	Addr string
+	// ConnectTimeout is the time a client has to send CONNECT after opening
+	// the connection. Default is DefaultConnectTimeout.
+	ConnectTimeout time.Duration
+	// MaxPacketSize is the maximum size in bytes of packets received from
+	// clients. Zero means that only the protocol limit applies.
+	MaxPacketSize int
+	// MaxQueuedMessages is the number of messages a session can have waiting
+	// to be written to the client or, for QOS 1 and 2 messages, to be
+	// acknowledged by the client, including messages queued while the
+	// client is offline. Messages published to a session whose queue is
+	// full are dropped. Default is DefaultMaxQueuedMessages.
+	MaxQueuedMessages int
+	// SessionExpiry is the time the session of a client connected with
+	// CleanSession false is kept after the client disconnects. Zero means
+	// that sessions do not expire.
+	SessionExpiry time.Duration
+	// Authenticator checks the credentials of connecting clients. Default
+	// is to accept all clients.
+	Authenticator Authenticator
+	// Authorizer checks the topics clients publish and subscribe to.
+	// Default is to allow all topics.
+	Authorizer Authorizer
+	// Retained stores retained messages, except $SYS topics. Default is an
+	// in-memory store.
+	Retained RetainedStore
+	// SysInterval is the interval between two updates of $SYS topics.
+	// Default is DefaultSysInterval. A negative interval disables $SYS
+	// topics.
+	SysInterval time.Duration
+	// SysTopics is the list of $SYS topics published, among Sys
+	// constants. Default is all of them.
+	SysTopics []string
+	// Observer receives metrics events for all client connections, for
+	// example a metrics.Collector. Only PacketSent, PacketReceived and
+	// MessageDropped are called.
+	Observer mqtt.Observer
+	// Logger receives broker log records. Default is to not log anything.
+	Logger mqtt.Logger
+
+	defaultRetained MemoryStore
+	// Retained $SYS topics, updated every SysInterval: They are not worth
+	// persisting in Retained store.
+	sysRetained MemoryStore
+
+	startOnce sync.Once
+	started   time.Time
+	// Counters feeding $SYS topics
+	stats *metrics.Collector
+	// Stops $SYS topics updates
+	quit chan struct{}
+
+	mu        sync.RWMutex
+	sessions  map[string]*session
+	conns     map[*conn]struct{}
+	listeners map[net.Listener]struct{}
+	closed    bool
+	// Connections being served
+	wg sync.WaitGroup
+}
+
+// ListenAndServe listens on the TCP network address s.Addr and serves
+// clients connecting to it. It always returns a non-nil error.
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts client connections on listener l, serving each of them in
+// a new go routine. Serve closes l when it returns. It always returns a
+// non-nil error, ErrServerClosed after Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.start()
+	if !s.trackListener(l, true) {
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	defer l.Close()
+
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			// Retry on temporary errors, like running out of file descriptors.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.logger().Warn("accept error", "error", err)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn serves a single client connection and returns when the
+// connection is closed.
+func (s *Server) ServeConn(nc net.Conn) {
+	s.start()
+	c := newConn(s, nc)
+	if !s.trackConn(c, true) {
+		_ = nc.Close()
+		return
+	}
+	defer s.trackConn(c, false)
+	c.serve()
+}
+
+// Close immediately closes all listeners and client connections, and waits
+// for connections to terminate.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.quit != nil && !s.closed {
+		close(s.quit)
+	}
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for c := range s.conns {
+		c.close()
+	}
+	for _, sess := range s.sessions {
+		sess.mu.Lock()
+		sess.stopExpiry()
+		sess.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// start initializes the server on first use and starts publishing $SYS
+// topics.
+func (s *Server) start() {
+	s.startOnce.Do(func() {
+		s.started = time.Now()
+		s.stats = metrics.NewCollector()
+		interval := s.SysInterval
+		if interval == 0 {
+			interval = DefaultSysInterval
+		}
+		if interval < 0 {
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.closed {
+			return
+		}
+		s.quit = make(chan struct{})
+		s.wg.Add(1)
+		go s.sysLoop(interval, s.quit)
+	})
+}
+
+// ============================================================================
+// Sessions and routing
+
+// attach returns the session of client ID for connection c, and whether
+// it is a session resumed from a previous connection. A new session is
+// started if clean is true or if there is no session for the client
+// [MQTT-3.1.2-4] [MQTT-3.1.2-6]. If the client is already connected, its
+// previous connection is closed [MQTT-3.1.4-2].
+func (s *Server) attach(clientID string, c *conn, clean bool) (*session, bool) {
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*session)
+	}
+	old := s.sessions[clientID]
+	sess := old
+	if sess == nil || clean {
+		sess = newSession(clientID, s.maxQueuedMessages())
+		s.sessions[clientID] = sess
+	}
+	sess.clean = clean
+	previous := sess.attach(c)
+	if old != nil && old != sess {
+		previous = old.attach(nil)
+	}
+	s.mu.Unlock()
+
+	if previous != nil {
+		previous.close()
+		<-previous.done
+	}
+	return sess, old == sess
+}
+
+// detach removes connection c from its session. Clean sessions are
+// discarded when their connection is detached [MQTT-3.1.2-6], other
+// sessions are kept until they expire.
+func (s *Server) detach(sess *session, c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !sess.detach(c) || s.sessions[sess.id] != sess {
+		return
+	}
+	if sess.clean {
+		delete(s.sessions, sess.id)
+		return
+	}
+	if s.SessionExpiry > 0 && !s.closed {
+		sess.expireAfter(s.SessionExpiry, func() { s.expire(sess) })
+	}
+}
+
+// expire discards session sess if its client is still offline.
+func (s *Server) expire(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[sess.id] == sess && sess.offline() {
+		delete(s.sessions, sess.id)
+		s.logger().Info("session expired", "client_id", sess.id)
+	}
+}
+
+// route delivers publish to all sessions with a matching subscription, with
+// the minimum of the message QOS and the subscription QOS.
+func (s *Server) route(publish mqtt.PublishPacket) {
+	s.mu.RLock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.RUnlock()
+
+	// Retain flag is only set for messages sent from the retained message
+	// store [MQTT-3.3.1-9].
+	publish.Retain = false
+	for _, sess := range sessions {
+		if qos, ok := sess.match(publish.Topic); ok {
+			if qos > publish.Qos {
+				qos = publish.Qos
+			}
+			if !sess.publish(publish, qos) {
+				s.messageDropped()
+				s.logger().Warn("message dropped, session queue is full", "client_id", sess.id, "topic", publish.Topic)
+			}
+		}
+	}
+}
+
+// retain updates the retained message of publish topic.
+func (s *Server) retain(publish mqtt.PublishPacket) {
+	m := RetainedMessage{Topic: publish.Topic, Payload: publish.Payload, QOS: publish.Qos}
+	if err := s.retained().Store(m); err != nil {
+		s.logger().Error("cannot store retained message", "topic", publish.Topic, "error", err)
+	}
+}
+
+// sendRetained delivers to sess the retained messages matching filter, with
+// the retain flag set [MQTT-3.3.1-6].
+func (s *Server) sendRetained(sess *session, filter string, qos int) {
+	messages, err := s.retained().Match(filter)
+	if err != nil {
+		s.logger().Error("cannot read retained messages", "topic", filter, "error", err)
+		return
+	}
+	if sys, _ := s.sysRetained.Match(filter); len(sys) > 0 {
+		messages = append(sys, messages...)
+		sort.Slice(messages, func(i, j int) bool { return messages[i].Topic < messages[j].Topic })
+	}
+	for _, m := range messages {
+		publishQOS := qos
+		if m.QOS < publishQOS {
+			publishQOS = m.QOS
+		}
+		publish := mqtt.PublishPacket{Topic: m.Topic, Payload: m.Payload, Retain: true}
+		if !sess.publish(publish, publishQOS) {
+			s.messageDropped()
+			s.logger().Warn("retained message dropped, session queue is full", "client_id", sess.id, "topic", m.Topic)
+		}
+	}
+}
+
+// ============================================================================
+// Metrics
+
+func (s *Server) packetSent(p mqtt.Packet) {
+	size := mqtt.PacketSize(p)
+	s.stats.PacketSent(p.Type(), size)
+	if s.Observer != nil {
+		s.Observer.PacketSent(p.Type(), size)
+	}
+}
+
+func (s *Server) packetReceived(p mqtt.Packet) {
+	size := mqtt.PacketSize(p)
+	s.stats.PacketReceived(p.Type(), size)
+	if s.Observer != nil {
+		s.Observer.PacketReceived(p.Type(), size)
+	}
+}
+
+func (s *Server) messageDropped() {
+	s.stats.MessageDropped()
+	if s.Observer != nil {
+		s.Observer.MessageDropped()
+	}
+}
+
+// ============================================================================
+// Internal
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(c *conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.conns == nil {
+			s.conns = make(map[*conn]struct{})
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+	} else {
+		delete(s.conns, c)
+		s.wg.Done()
+	}
+	return true
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+func (s *Server) connectTimeout() time.Duration {
+	if s.ConnectTimeout > 0 {
+		return s.ConnectTimeout
+	}
+	return DefaultConnectTimeout
+}
+
+func (s *Server) maxQueuedMessages() int {
+	if s.MaxQueuedMessages > 0 {
+		return s.MaxQueuedMessages
+	}
+	return DefaultMaxQueuedMessages
+}
+
+func (s *Server) authenticate(client Client, password string) int {
+	if s.Authenticator == nil {
+		return mqtt.ConnAccepted
+	}
+	return s.Authenticator.Authenticate(client, password)
+}
+
+func (s *Server) authorize(client Client, topic string, access Access, qos int) bool {
+	if s.Authorizer == nil {
+		return true
+	}
+	return s.Authorizer.Authorize(client, topic, access, qos)
+}
+
+func (s *Server) retained() RetainedStore {
+	if s.Retained == nil {
+		return &s.defaultRetained
+	}
+	return s.Retained
+}
+
+func (s *Server) logger() mqtt.Logger {
+	if s.Logger == nil {
+		return mqtt.NopLogger{}
+	}
+	return s.Logger
+}
+
+// validFilter reports whether filter is a valid subscription topic filter.
+func validFilter(filter string) bool {
+	return topic.ValidateFilter(filter) == nil
+}
@@ -0,0 +1,316 @@
+package broker // import "gosrc.io/mqtt/broker"
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gosrc.io/mqtt"
+	"gosrc.io/mqtt/topic"
+)
+
+// maxPacketID is the largest MQTT packet identifier.
+const maxPacketID = 65535
+
+// session is the state of a client on the broker: Its subscriptions, the
+// packets waiting to be written to the client and the QOS 1 and 2 flows in
+// progress. A session is attached to at most one connection at a time.
+//
+// Sessions of clients connecting with CleanSession false outlive their
+// connection: QOS 1 and 2 messages are queued while the client is offline,
+// and sent when it connects again.
+type session struct {
+	id        string
+	maxQueued int
+	// Session is discarded on disconnection. Guarded by Server mu.
+	clean bool
+
+	mu   sync.Mutex
+	conn *conn
+	// Topic filters, with their granted QOS
+	subscriptions map[string]int
+	// Outgoing QOS 1 and 2 packets waiting for acknowledgement
+	inflight map[int]outgoing
+	lastID   int
+	lastSeq  uint64
+	// Incoming QOS 2 packet IDs waiting for PUBREL
+	received map[int]struct{}
+	// Packets waiting to be written to the client, with the number of QOS
+	// 0 publish packets among them. QOS 1 and 2 publish packets are
+	// counted in inflight until acknowledged.
+	queue  []mqtt.Packet
+	queued int
+	// Signals the connection writer that the queue is not empty
+	notify chan struct{}
+	// Discards the session when the client stays offline too long
+	expiry *time.Timer
+}
+
+// outgoing is an inflight packet, with its position in the flow of packets
+// sent to the client.
+type outgoing struct {
+	packet mqtt.Packet
+	seq    uint64
+}
+
+func newSession(id string, maxQueued int) *session {
+	return &session{
+		id:            id,
+		maxQueued:     maxQueued,
+		subscriptions: make(map[string]int),
+		inflight:      make(map[int]outgoing),
+		received:      make(map[int]struct{}),
+		notify:        make(chan struct{}, 1),
+	}
+}
+
+// attach makes c the connection of the session and returns the previous
+// one, if any.
+func (s *session) attach(c *conn) *conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.conn
+	s.conn = c
+	if c != nil {
+		s.stopExpiry()
+		s.resume()
+	}
+	return previous
+}
+
+// detach removes connection c from the session. It reports whether c was
+// the session connection.
+func (s *session) detach(c *conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != c {
+		return false
+	}
+	s.conn = nil
+	return true
+}
+
+// resume rebuilds the queue for a new connection. Packets queued for the
+// previous connection are discarded, except QOS 1 and 2 flows in progress,
+// which are sent again in their original order. PUBLISH packets already
+// sent have their DUP flag set [MQTT-4.4.0-1]. s.mu must be held.
+func (s *session) resume() {
+	unsent := make(map[int]bool)
+	for _, p := range s.queue {
+		if publish, ok := p.(mqtt.PublishPacket); ok && publish.ID != 0 {
+			unsent[publish.ID] = true
+		}
+	}
+
+	flows := make([]outgoing, 0, len(s.inflight))
+	for _, o := range s.inflight {
+		flows = append(flows, o)
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].seq < flows[j].seq })
+
+	s.queue = nil
+	s.queued = 0
+	for _, o := range flows {
+		if publish, ok := o.packet.(mqtt.PublishPacket); ok {
+			if !unsent[publish.ID] {
+				publish.Dup = true
+				s.inflight[publish.ID] = outgoing{packet: publish, seq: o.seq}
+			}
+			o.packet = publish
+		}
+		s.queue = append(s.queue, o.packet)
+	}
+	s.signal()
+}
+
+// expireAfter calls expire if the session is still offline after duration d.
+func (s *session) expireAfter(d time.Duration, expire func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		s.stopExpiry()
+		s.expiry = time.AfterFunc(d, expire)
+	}
+}
+
+// offline reports whether the session has no connection.
+func (s *session) offline() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn == nil
+}
+
+// stopExpiry cancels session expiry. s.mu must be held.
+func (s *session) stopExpiry() {
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+}
+
+// ============================================================================
+// Subscriptions
+
+func (s *session) subscribe(filter string, qos int) {
+	s.mu.Lock()
+	s.subscriptions[filter] = qos
+	s.mu.Unlock()
+}
+
+func (s *session) unsubscribe(filter string) {
+	s.mu.Lock()
+	delete(s.subscriptions, filter)
+	s.mu.Unlock()
+}
+
+// match returns the maximum QOS of the session subscriptions matching
+// topic name. Overlapping subscriptions deliver the message only once.
+func (s *session) match(name string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qos, found := 0, false
+	for filter, granted := range s.subscriptions {
+		if topic.Match(filter, name) {
+			if !found || granted > qos {
+				qos = granted
+			}
+			found = true
+		}
+	}
+	return qos, found
+}
+
+// ============================================================================
+// Outgoing packets
+
+// publish queues publish to be sent to the client with QOS qos. QOS 0
+// messages are not queued while the client is offline. It reports false if
+// the message is dropped because the queue is full or all packet IDs are in
+// use. The queue limit includes QOS 1 and 2 messages sent but not
+// acknowledged, so that a client that never acknowledges messages cannot
+// make the session grow.
+func (s *session) publish(publish mqtt.PublishPacket, qos int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil && qos == 0 {
+		return true
+	}
+	if len(s.inflight)+s.queued >= s.maxQueued {
+		return false
+	}
+
+	publish.Qos = qos
+	publish.Dup = false
+	publish.ID = 0
+	if qos > 0 {
+		id, ok := s.nextID()
+		if !ok {
+			return false
+		}
+		publish.ID = id
+		s.track(id, publish)
+	} else {
+		s.queued++
+	}
+	s.push(publish)
+	return true
+}
+
+// send queues control packet p to be sent to the client.
+func (s *session) send(p mqtt.Packet) {
+	s.mu.Lock()
+	s.push(p)
+	s.mu.Unlock()
+}
+
+// take returns all packets waiting to be written to connection c. It
+// returns nil if c is not the session connection anymore.
+func (s *session) take(c *conn) []mqtt.Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != c {
+		return nil
+	}
+	packets := s.queue
+	s.queue = nil
+	s.queued = 0
+	return packets
+}
+
+// acked completes the delivery of QOS 1 message (PUBACK) or QOS 2
+// message (PUBCOMP) with packet ID id.
+func (s *session) acked(id int) {
+	s.mu.Lock()
+	delete(s.inflight, id)
+	s.mu.Unlock()
+}
+
+// pubReceived handles PUBREC for QOS 2 message with packet ID id: The
+// message is released with PUBREL, which replaces it in inflight packets.
+func (s *session) pubReceived(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.inflight[id]; !found {
+		return
+	}
+	pubrel := mqtt.PubRelPacket{ID: id}
+	s.track(id, pubrel)
+	s.push(pubrel)
+}
+
+// track records p as the inflight packet of packet ID id. s.mu must be held.
+func (s *session) track(id int, p mqtt.Packet) {
+	s.lastSeq++
+	s.inflight[id] = outgoing{packet: p, seq: s.lastSeq}
+}
+
+// push adds p to the queue. s.mu must be held.
+func (s *session) push(p mqtt.Packet) {
+	s.queue = append(s.queue, p)
+	s.signal()
+}
+
+// signal wakes up the connection writer. s.mu must be held.
+func (s *session) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// nextID returns a packet ID that is not used by an inflight packet.
+// s.mu must be held.
+func (s *session) nextID() (int, bool) {
+	for i := 0; i < maxPacketID; i++ {
+		s.lastID++
+		if s.lastID > maxPacketID {
+			s.lastID = 1
+		}
+		if _, used := s.inflight[s.lastID]; !used {
+			return s.lastID, true
+		}
+	}
+	return 0, false
+}
+
+// ============================================================================
+// Incoming QOS 2 messages
+
+// receive records incoming QOS 2 message with packet ID id. It reports
+// whether the message is new, that is, it must be routed to subscribers.
+func (s *session) receive(id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.received[id]; found {
+		return false
+	}
+	s.received[id] = struct{}{}
+	return true
+}
+
+// release handles PUBREL for incoming QOS 2 message with packet ID id.
+func (s *session) release(id int) {
+	s.mu.Lock()
+	delete(s.received, id)
+	s.mu.Unlock()
+}
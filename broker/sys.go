@@ -0,0 +1,122 @@
+package broker // import "gosrc.io/mqtt/broker"
+
+import (
+	"strconv"
+	"time"
+
+	"gosrc.io/mqtt"
+)
+
+// DefaultSysInterval is the default interval between two updates of $SYS
+// topics.
+const DefaultSysInterval = 10 * time.Second
+
+// $SYS topics published by the broker, as retained messages. They are
+// kept in memory, and never written to the Server RetainedStore. Message
+// counts include all control packets, publish counts only PUBLISH packets.
+const (
+	SysUptime           = "$SYS/broker/uptime"
+	SysClientsConnected = "$SYS/broker/clients/connected"
+	SysClientsTotal     = "$SYS/broker/clients/total"
+	SysSubscriptions    = "$SYS/broker/subscriptions/count"
+	SysMessagesReceived = "$SYS/broker/messages/received"
+	SysMessagesSent     = "$SYS/broker/messages/sent"
+	SysPublishReceived  = "$SYS/broker/publish/messages/received"
+	SysPublishSent      = "$SYS/broker/publish/messages/sent"
+	SysPublishDropped   = "$SYS/broker/publish/messages/dropped"
+	SysBytesReceived    = "$SYS/broker/bytes/received"
+	SysBytesSent        = "$SYS/broker/bytes/sent"
+)
+
+// sysTopics are the $SYS topics published by default.
+var sysTopics = []string{
+	SysUptime,
+	SysClientsConnected,
+	SysClientsTotal,
+	SysSubscriptions,
+	SysMessagesReceived,
+	SysMessagesSent,
+	SysPublishReceived,
+	SysPublishSent,
+	SysPublishDropped,
+	SysBytesReceived,
+	SysBytesSent,
+}
+
+// sysLoop publishes $SYS topics every interval, until quit is closed.
+func (s *Server) sysLoop(interval time.Duration, quit <-chan struct{}) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.publishSys()
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// publishSys publishes the current value of $SYS topics.
+func (s *Server) publishSys() {
+	values := s.sysValues()
+	topics := s.SysTopics
+	if topics == nil {
+		topics = sysTopics
+	}
+	for _, name := range topics {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		publish := mqtt.PublishPacket{Topic: name, Payload: []byte(value), Retain: true}
+		_ = s.sysRetained.Store(RetainedMessage{Topic: name, Payload: publish.Payload})
+		s.route(publish)
+	}
+}
+
+// sysValues returns the value of all $SYS topics. Counters are read from
+// the collector also feeding Server Observer.
+func (s *Server) sysValues() map[string]string {
+	var connected, subscriptions int
+	s.mu.RLock()
+	total := len(s.sessions)
+	for _, sess := range s.sessions {
+		sess.mu.Lock()
+		if sess.conn != nil {
+			connected++
+		}
+		subscriptions += len(sess.subscriptions)
+		sess.mu.Unlock()
+	}
+	s.mu.RUnlock()
+
+	snapshot := s.stats.Snapshot()
+	publish := mqtt.PacketPublish.String()
+	return map[string]string{
+		SysUptime:           strconv.Itoa(int(time.Since(s.started).Seconds())) + " seconds",
+		SysClientsConnected: strconv.Itoa(connected),
+		SysClientsTotal:     strconv.Itoa(total),
+		SysSubscriptions:    strconv.Itoa(subscriptions),
+		SysMessagesReceived: formatUint(sum(snapshot.PacketsReceived)),
+		SysMessagesSent:     formatUint(sum(snapshot.PacketsSent)),
+		SysPublishReceived:  formatUint(snapshot.PacketsReceived[publish]),
+		SysPublishSent:      formatUint(snapshot.PacketsSent[publish]),
+		SysPublishDropped:   formatUint(snapshot.DroppedMessages),
+		SysBytesReceived:    formatUint(sum(snapshot.BytesReceived)),
+		SysBytesSent:        formatUint(sum(snapshot.BytesSent)),
+	}
+}
+
+func sum(counts map[string]uint64) uint64 {
+	var total uint64
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
+
+func formatUint(n uint64) string {
+	return strconv.FormatUint(n, 10)
+}
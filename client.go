@@ -2,12 +2,15 @@ package mqtt // import "gosrc.io/mqtt"
 
 import "C"
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +18,18 @@ var (
 	// ErrIncorrectConnectResponse is triggered on CONNECT when server
 	// does not reply with CONNACK packet.
 	ErrIncorrectConnectResponse = errors.New("incorrect mqtt connect response")
+
+	// ErrNoMux is returned when trying to register a message handler on a
+	// client without Mux.
+	ErrNoMux = errors.New("mqtt client has no mux to register handler")
+
+	// ErrInvalidQOS is returned when trying to publish a message with a QOS
+	// level other than 0, 1 or 2.
+	ErrInvalidQOS = errors.New("invalid mqtt qos level")
+
+	// ErrClientClosed is returned when using a client after Shutdown or
+	// Disconnect.
+	ErrClientClosed = errors.New("mqtt client is closed")
 )
 
 const (
@@ -42,6 +57,54 @@ type OptConnect struct {
 // for standard cases.
 type OptTCP struct {
 	ConnectTimeout time.Duration
+	// Dialer opens the network connection to the server address. With tls
+	// scheme, the TLS handshake is performed on the returned connection.
+	// Default is a net.Dialer with a 5 seconds timeout. It can be replaced,
+	// for example to connect through a proxy or to an in-memory test server.
+	Dialer Dialer
+}
+
+// Dialer opens network connections. It is implemented by net.Dialer.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// OptWill defines the message the server publishes on behalf of the client
+// when the client disconnects abnormally. It is sent on every connect, so
+// it also applies after reconnects. Will is disabled when Topic is empty.
+type OptWill struct {
+	Topic   string
+	Payload []byte
+	QOS     int
+	Retain  bool
+}
+
+// OptInbound defines how messages received from the server are
+// delivered to the client application.
+type OptInbound struct {
+	// BorrowPayloads makes the client read message payloads into pooled
+	// buffers instead of allocating a new one for each message. The payload
+	// of a received Message is then only valid until Message.Release is
+	// called. This reduces garbage collection pressure for high-throughput
+	// subscribers.
+	BorrowPayloads bool
+
+	// ManualAck defers acknowledgement of QOS 1 and QOS 2 messages until the
+	// application calls Message.Ack, instead of sending PUBACK or PUBREC as
+	// soon as the message is received. This makes sure the server keeps the
+	// message if the application stops before it has processed it.
+	// Every QOS 1 and 2 message must then be acknowledged, as acknowledgements
+	// are sent to the server in the order messages were received.
+	ManualAck bool
+
+	// Overflow defines the client behavior when the application does not
+	// read messages from the default message channel fast enough. Dropped
+	// messages are acknowledged, even in manual ack mode, and reported as
+	// StateMessageDropped events.
+	Overflow OverflowPolicy
+	// BufferSize is the number of messages the client buffers with
+	// OverflowDropOldest and OverflowSpill policies. Default is 256.
+	BufferSize int
 }
 
 // Config provides a data structure of required configuration
@@ -54,15 +117,62 @@ type Config struct {
 	// *************************************************************************
 	OptConnect
 	OptTCP
+	OptInbound
+
+	// Will is the client Last Will and Testament.
+	Will OptWill
+
+	// Logger receives client log records. Default is to not log anything.
+	Logger Logger
+	// Observer receives client metrics events. Default is to ignore them.
+	Observer Observer
 }
 
 //=============================================================================
 
 // Message encapsulates Publish MQTT payload from the MQTT client perspective.
 // Message is used to abstract the detail of the MQTT protocol to the developer.
+// It is used both for received messages and for messages published with
+// PublishMessage.
 type Message struct {
 	Topic   string
 	Payload []byte
+	QOS     int
+	// Retain is set on received messages when they are sent by the server
+	// from its retained messages store, on subscription.
+	Retain bool
+	// Dup is set on received messages when the server may have sent the
+	// message before. It is managed by the client on publish.
+	Dup bool
+	// ID is the packet ID of QOS 1 and 2 messages. It is managed by the
+	// client on publish.
+	ID int
+
+	// Pooled buffer holding the payload, when payload is borrowed
+	buf *payloadBuffer
+	// Pending acknowledgement, in manual ack mode
+	ack *ackTicket
+}
+
+// Ack acknowledges a QOS 1 or QOS 2 message to the server, when the client is
+// configured for manual acknowledgement (see OptInbound). As PUBACK and PUBREC
+// packets must be sent in the order messages were received, the
+// acknowledgement is delayed until all previous messages are acknowledged.
+// Ack does nothing for QOS 0 messages or in automatic acknowledgement mode.
+func (m Message) Ack() {
+	if m.ack != nil {
+		m.ack.ack()
+	}
+}
+
+// Release gives the message payload buffer back to the client, when the
+// client is configured to borrow payloads (see OptInbound). The payload
+// must not be used after Release, which must be called only once per
+// message. It does nothing for messages that do not borrow their payload.
+func (m Message) Release() {
+	if m.buf != nil {
+		m.buf.release()
+	}
 }
 
 //=============================================================================
@@ -74,6 +184,9 @@ type ConnState int
 // client can be notified about.
 const (
 	StateDisconnected ConnState = iota
+	// StateMessageDropped is notified when a received message is dropped
+	// because of inbound overflow policy. Description contains message topic.
+	StateMessageDropped
 )
 
 // Event is a structure use to convey event changes related to client state. This
@@ -97,27 +210,52 @@ type Subscriptions map[string]int
 // State
 type inflight map[int]QOSOutPacket
 
+// qosState is protected by Client mutex.
 type qosState struct {
 	qosResponse   chan<- QOSResponse
 	Subscriptions Subscriptions
 	inflight      inflight
+	// Send time of inflight packets, to send them again in order
+	sent map[int]time.Time
 }
 
 //=============================================================================
 
 // Client is the main structure use to connect as a client on an MQTT
 // server.
+//
+// Client methods are safe for concurrent use by multiple goroutines.
+// Exported fields are configuration: They must be set before Connect and
+// must not be modified while the client is running. Use SetHandler to change
+// the event handler and ActiveSubscriptions to read subscriptions of a
+// running client. The event handler and message handlers are called from
+// client goroutines.
 type Client struct {
 	Config
 
 	Handler  EventHandler
 	Messages chan<- Message
+	// Mux dispatches received messages to handlers based on their topic.
+	// Messages that do not match any handler are sent to Messages channel.
+	Mux *ServeMux
 
 	qosState
 
-	mu       sync.RWMutex
-	sender   sender
-	packetID int
+	mu          sync.RWMutex
+	sender      sender
+	ids         packetIDs
+	middlewares []Middleware
+	inbox       *inbox
+	dropped     uint64
+	// Event handler set with SetHandler, replacing Handler
+	eventHandler atomic.Value
+
+	// Client is shutting down or shut down
+	closed bool
+	// Closed when inflight state becomes empty, while shutting down
+	idle chan struct{}
+	// Go routines of the current connection
+	routines sync.WaitGroup
 }
 
 // New generates a new MQTT client with default parameters. Address
@@ -144,6 +282,7 @@ func NewClient(address string) *Client {
 			Subscriptions: make(Subscriptions),
 			inflight:      make(inflight),
 		},
+		Mux: NewServeMux(),
 	}
 }
 
@@ -167,56 +306,214 @@ func NewClient(address string) *Client {
 // allows the caller to pass a channel with a buffer size suiting its
 // own use case and expected throughput.
 func (c *Client) Connect(defaultMsgChannel chan<- Message) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	c.mu.Lock()
 	c.Messages = defaultMsgChannel
+	c.mu.Unlock()
 	return c.connect()
 }
 
 // Disconnect sends DISCONNECT MQTT packet to other party and clean up
-// the client state.
+// the client state. Unlike Shutdown, it does not wait for pending
+// acknowledgements.
 func (c *Client) Disconnect() {
-	packet := DisconnectPacket{}
-	c.send(packet)
-	c.sender.quit <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = c.Shutdown(ctx)
+}
+
+// Shutdown gracefully disconnects the client. New publishes and
+// subscriptions are rejected with ErrClientClosed, then Shutdown waits until
+// the server acknowledges all inflight packets, or until ctx is done. It then
+// sends DISCONNECT, closes the connection, waits for all client go routines
+// to terminate and finally closes the message channel.
+//
+// Shutdown returns ctx error if it stopped waiting for acknowledgements.
+// It must not be called from an event handler or a message handler, as it
+// waits for the go routines running them. The client cannot be connected
+// again after Shutdown.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+	c.closed = true
+	s := c.sender
+	var idle chan struct{}
+	if len(c.inflight) > 0 {
+		idle = make(chan struct{})
+		c.idle = idle
+	}
+	c.mu.Unlock()
+
+	var err error
+	if s.done != nil { // Client has been connected
+		if idle != nil {
+			select {
+			case <-idle:
+			case <-s.done: // Connection lost: Acknowledgements will not come.
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		s.send(DisconnectPacket{})
+		s.stop()
+	}
+
+	// Sender closed the connection, so receiver and state loop terminate too.
+	c.routines.Wait()
 
-	// Terminate client receive channel
-	// TODO Should we really close the channel or let it live in case client reconnects ?
-	close(c.Messages)
+	// Make sure nothing is sent anymore on the channel before closing it.
+	// The inbox is closed without holding c.mu, as dropping buffered
+	// messages calls the event handler.
+	c.mu.Lock()
+	ib := c.inbox
+	c.inbox = nil
+	messages := c.Messages
 	c.Messages = nil
-	// TODO Properly terminates receiver and sender
+	c.mu.Unlock()
+	if ib != nil {
+		ib.close()
+	}
+	if messages != nil {
+		close(messages)
+	}
+	return err
 }
 
 // ============================================================================
 
-// Subscribe sends SUBSCRIBE MQTT control packet.  At the moment
-// subscription state is not kept in client state and are lost on reconnection.
-func (c *Client) Subscribe(topic Topic) {
-	c.packetID++
-	subscribe := SubscribePacket{ID: c.packetID}
+// Subscribe sends SUBSCRIBE MQTT control packet. The subscription appears
+// in ActiveSubscriptions once the server acknowledges it. Subscriptions that
+// are not acknowledged are sent again on reconnection. Subscribe returns
+// ErrClientClosed after Shutdown, or ErrPacketIDExhausted if all packet IDs
+// are in use.
+func (c *Client) Subscribe(topic Topic) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	id, err := c.ids.acquire()
+	if err != nil {
+		return err
+	}
+	subscribe := SubscribePacket{ID: id}
 	subscribe.Topics = append(subscribe.Topics, topic)
 	c.send(subscribe)
+	return nil
 }
 
-// Unsubscribe sends UNSUBSCRIBE MQTT control packet.
-func (c *Client) Unsubscribe(topic string) {
-	c.packetID++
-	unsubscribe := UnsubscribePacket{ID: c.packetID}
+// SubscribeHandler registers handler on client Mux for topic name filter and
+// sends SUBSCRIBE MQTT control packet. Messages matching the topic are then
+// dispatched to handler, instead of the default message channel. If
+// Subscribe fails, the handler previously registered for the topic filter,
+// if any, is restored.
+func (c *Client) SubscribeHandler(topic Topic, handler Handler) error {
+	if c.Mux == nil {
+		return ErrNoMux
+	}
+	previous, err := c.Mux.handle(topic.Name, handler)
+	if err != nil {
+		return err
+	}
+	if err = c.Subscribe(topic); err != nil {
+		if previous != nil {
+			_, _ = c.Mux.handle(topic.Name, previous)
+		} else {
+			c.Mux.Remove(topic.Name)
+		}
+	}
+	return err
+}
+
+// Unsubscribe sends UNSUBSCRIBE MQTT control packet. Handler registered
+// on client Mux for that topic is removed.
+func (c *Client) Unsubscribe(topic string) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	id, err := c.ids.acquire()
+	if err != nil {
+		return err
+	}
+	if c.Mux != nil {
+		c.Mux.Remove(topic)
+	}
+	unsubscribe := UnsubscribePacket{ID: id}
 	unsubscribe.Topics = append(unsubscribe.Topics, topic)
 	c.send(unsubscribe)
+	return nil
 }
 
 // ============================================================================
 
-// Publish sends PUBLISH MQTT control packet.
-func (c *Client) Publish(topic string, payload []byte) {
-	c.packetID++
-	publish := PublishPacket{ID: c.packetID}
-	publish.Topic = topic
-	publish.Payload = payload
+// Publish sends PUBLISH MQTT control packet with QOS 0.
+func (c *Client) Publish(topic string, payload []byte) error {
+	return c.PublishMessage(Message{Topic: topic, Payload: payload})
+}
+
+// PublishMessage sends PUBLISH MQTT control packet for message m, with its
+// QOS and retain flag. QOS 1 and 2 messages get a new packet ID and are kept
+// in inflight state until the server acknowledges them: If the connection
+// is lost, they are sent again when the client reconnects, for example with
+// a ClientManager. Messages published before the first Connect are sent on
+// connection. QOS 0 messages published while disconnected are lost.
+func (c *Client) PublishMessage(m Message) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	publish := PublishPacket{
+		Qos:     m.QOS,
+		Retain:  m.Retain,
+		Topic:   m.Topic,
+		Payload: m.Payload,
+	}
+	switch m.QOS {
+	case 0:
+	case 1, 2:
+		id, err := c.ids.acquire()
+		if err != nil {
+			return err
+		}
+		publish.ID = id
+	default:
+		return ErrInvalidQOS
+	}
 	c.send(publish)
+	return nil
+}
+
+// DroppedMessages returns the number of received messages dropped because
+// of inbound overflow policy since the client was created.
+func (c *Client) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// SetHandler replaces the client event handler. Unlike setting Handler
+// field, it can be used while the client is running. Handler field is left
+// unchanged.
+func (c *Client) SetHandler(handler EventHandler) {
+	c.eventHandler.Store(eventHandlerBox{handler})
+}
+
+// ActiveSubscriptions returns a copy of the subscriptions acknowledged by
+// the server, with their granted QOS.
+func (c *Client) ActiveSubscriptions() Subscriptions {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	subscriptions := make(Subscriptions, len(c.Subscriptions))
+	for topic, qos := range c.Subscriptions {
+		subscriptions[topic] = qos
+	}
+	return subscriptions
 }
 
 // Format printable version of client state
 func (c *Client) String() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	str := fmt.Sprintf(`
 Subscription: %v
 Inflight: %v`, c.Subscriptions, c.inflight)
@@ -233,16 +530,21 @@ func (c *Client) connect() (err error) {
 		return err
 	}
 
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: 5 * time.Second}
+	}
+
 	var conn net.Conn
 	switch uri.Scheme {
 	case "tcp":
-		conn, err = net.DialTimeout("tcp", uri.Host, 5*time.Second)
+		conn, err = dialer.Dial("tcp", uri.Host)
 		if err != nil {
 			return err
 		}
 		return c.login(conn)
 	case "tls":
-		conn, err = net.DialTimeout("tcp", uri.Host, 5*time.Second)
+		conn, err = dialer.Dial("tcp", uri.Host)
 		if err != nil {
 			return err
 		}
@@ -267,8 +569,14 @@ func (c *Client) login(conn net.Conn) (err error) {
 	connectPacket.CleanSession = c.CleanSession
 	connectPacket.Username = c.Username
 	connectPacket.Password = c.Password
-	buf := connectPacket.Marshall()
-	if _, err = conn.Write(buf); err != nil {
+	if c.Will.Topic != "" {
+		if c.Will.QOS < 0 || c.Will.QOS > 2 {
+			return ErrInvalidQOS
+		}
+		connectPacket.SetWill(c.Will.Topic, c.Will.Payload, c.Will.QOS)
+		connectPacket.WillRetain = c.Will.Retain
+	}
+	if _, err = connectPacket.WriteTo(conn); err != nil {
 		return err
 	}
 
@@ -297,28 +605,86 @@ func (c *Client) login(conn net.Conn) (err error) {
 	}
 
 	// 3. Configure sender and receiver
-	c.setSender(initSender(conn, c.Keepalive))
+	// Go routines are started under lock, so that Shutdown cannot miss them.
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		_ = conn.Close()
+		return ErrClientClosed
+	}
+	logger := c.logger()
+	mon := newConnMonitor(logger, c.Observer)
+	c.sender = initSender(conn, c.Keepalive, &c.routines, mon)
 	// Start routine to receive incoming data
-	receiverChannel := spawnReceiver(conn, c.Messages, c.sender)
+	ib, stale := c.currentInbox()
+	receiverChannel := spawnReceiver(conn, ib, c.sender, c.getSender, c.OptInbound, c.Mux, c.middlewares, &c.routines, mon)
 	// Routine to maintain client state based on event from receiver and sender (disconnect signal, QOS / Ack messages, etc)
-	go c.stateLoop(receiverChannel, c.sender.done, c.Messages)
+	c.routines.Add(1)
+	go func(s sender) {
+		defer c.routines.Done()
+		c.stateLoop(receiverChannel, s)
+	}(c.sender)
+	s, pending := c.sender, c.pendingPackets()
+	c.mu.Unlock()
+	if stale != nil {
+		stale.close()
+	}
+	logger.Info("connected")
+
+	// 4. Resume QOS 1 and 2 flows interrupted by the previous connection or
+	// started while the client was disconnected [MQTT-4.4.0-1]. Subscription
+	// requests that were not acknowledged are sent again too.
+	for _, p := range pending {
+		s.send(p)
+	}
 	return nil
 }
 
+// pendingPackets returns the inflight PUBLISH, PUBREL, SUBSCRIBE and
+// UNSUBSCRIBE packets, in send order, to send them again after
+// reconnection. PUBLISH packets have their DUP flag set, as the server may
+// have received them. c.mu must be held.
+func (c *Client) pendingPackets() []Packet {
+	var ids []int
+	for id := range c.sent {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		ti, tj := c.sent[ids[i]], c.sent[ids[j]]
+		if ti.Equal(tj) {
+			return ids[i] < ids[j]
+		}
+		return ti.Before(tj)
+	})
+
+	packets := make([]Packet, 0, len(ids))
+	for _, id := range ids {
+		switch p := c.inflight[id].(type) {
+		case PublishPacket:
+			p.Dup = true
+			c.inflight[id] = p
+			packets = append(packets, p)
+		case PubRelPacket, SubscribePacket, UnsubscribePacket:
+			packets = append(packets, p.(Packet))
+		}
+	}
+	return packets
+}
+
 // Go routine used to coordinates client state management loop.
 // Routine to maintain client state based on event from receiver and sender (disconnect signal, QOS / Ack messages, etc)
 // It updates the state of inflight messages, but also track disconnect event to shutdown properly.
-func (c *Client) stateLoop(receiverChannel <-chan QOSResponse, senderDone <-chan struct{}, messageChannel chan<- Message) {
+func (c *Client) stateLoop(receiverChannel <-chan QOSResponse, s sender) {
 Loop:
 	for {
 		select {
 		case qosResponse, ok := <-receiverChannel:
 			if !ok { // Receiver terminated
-				c.sender.quit <- struct{}{}
+				s.stop()
 				break Loop
 			}
 			c.handleQOSResponse(qosResponse)
-		case <-senderDone:
+		case <-s.done:
 			// We do nothing for now: As the sender closes socket, this should
 			// be enough to have read Loop fail and properly shutdown process.
 
@@ -327,8 +693,9 @@ Loop:
 		}
 	}
 
-	if c.Handler != nil {
-		c.Handler(Event{State: StateDisconnected})
+	c.logger().Info("disconnected")
+	if handler := c.handler(); handler != nil {
+		handler(Event{State: StateDisconnected})
 	}
 }
 
@@ -345,62 +712,101 @@ type QOSResponse interface {
 // TODO: Refactor in smaller functions
 func (c *Client) handleQOSResponse(qosResponse QOSResponse) {
 	id := qosResponse.ResponseID()
-	if originalPacket, found := c.inflight[id]; found {
+	if p, ok := qosResponse.(Packet); ok {
+		c.logger().Debug("acknowledgement received", logKeyPacketType, p.Type(), logKeyPacketID, id)
+	}
+	c.mu.RLock()
+	originalPacket, found := c.inflight[id]
+	c.mu.RUnlock()
+	if found {
 		switch resp := qosResponse.(type) {
 		case SubAckPacket:
 			// Ack only contains the response code for each topic: We need to merge the result with the
 			// original subscription request.
 			if sub, ok := originalPacket.(SubscribePacket); ok {
+				c.mu.Lock()
 				for i, topic := range sub.Topics {
+					if i >= len(resp.ReturnCodes) {
+						break
+					}
 					if resp.ReturnCodes[i] == 0x80 {
-						fmt.Printf("Subscription failed for topic %s\n", topic.Name)
+						c.logger().Warn("subscription refused", logKeyTopic, topic.Name, logKeyPacketID, id)
 						continue
 					}
 					topic.QOS = resp.ReturnCodes[i]
 					c.Subscriptions[topic.Name] = topic.QOS
 				}
+				c.mu.Unlock()
 			} else {
-				fmt.Printf("SubAck received, but packet %d is not a subscribe packet\n", id)
+				c.logger().Warn("SUBACK does not match a subscribe packet",
+					logKeyPacketType, PacketSubAck, logKeyPacketID, id)
 			}
 		case UnsubAckPacket:
 			// When the ack is received, delete all our subscriptions from the local list.
 			if unsub, ok := originalPacket.(UnsubscribePacket); ok {
+				c.mu.Lock()
 				for _, topic := range unsub.Topics {
 					delete(c.Subscriptions, topic)
 				}
+				c.mu.Unlock()
 			}
+		case PubRecPacket:
+			// QOS 2 publish received by server: Release it. PUBREL replaces the
+			// publish packet in inflight state until PUBCOMP is received.
+			c.send(PubRelPacket{ID: id})
+			return
 		}
 		c.deleteInflight(id)
 	}
 }
 
-func (c *Client) addToInflight(packet Marshaller) {
-	if qosPacket, ok := packet.(QOSOutPacket); ok {
+// addToInflight keeps track of packets expecting a response. Packets with
+// zero ID, like QOS 0 publish, are not acknowledged.
+func (c *Client) addToInflight(packet Packet) {
+	if qosPacket, ok := packet.(QOSOutPacket); ok && qosPacket.PacketID() != 0 {
 		c.addInflight(qosPacket)
 	}
 }
 
 // ============================================================================
 
-func (c *Client) send(packet Marshaller) {
+func (c *Client) send(packet Packet) {
 	c.addToInflight(packet)
-	buf := packet.Marshall()
 	out := c.getSender()
-	out.send(buf)
+	out.send(packet)
 }
 
 // ============================================================================
-// sender setter / getter
+// sender getter
 // TODO: Probably it is not needed as we probably do not need to really reset
 //   sender on reconnect
 
-// setSender is used to protect against race on reconnect.
-func (c *Client) setSender(sender sender) {
-	c.mu.Lock()
-	{
-		c.sender = sender
+// logger returns the client logger, adding client fields to log records.
+func (c *Client) logger() Logger {
+	return withFields(c.Logger, logKeyClientID, c.ClientID, logKeyBroker, c.Address)
+}
+
+// observer returns the client observer.
+func (c *Client) observer() Observer {
+	if c.Observer == nil {
+		return nopObserver{}
 	}
-	c.mu.Unlock()
+	return c.Observer
+}
+
+// handler returns the current event handler. It does not take c.mu, so
+// that events can be notified by code holding it.
+func (c *Client) handler() EventHandler {
+	if box, ok := c.eventHandler.Load().(eventHandlerBox); ok {
+		return box.handler
+	}
+	return c.Handler
+}
+
+// eventHandlerBox wraps the event handler set with SetHandler, as
+// atomic.Value cannot store nil.
+type eventHandlerBox struct {
+	handler EventHandler
 }
 
 // getSender is used to protect against race on reconnect.
@@ -414,19 +820,85 @@ func (c *Client) getSender() sender {
 	return s
 }
 
+// currentInbox returns the inbox delivering messages to the current message
+// channel. The inbox is kept between connections, unless the channel changes:
+// The replaced inbox is returned as stale, to be closed by the caller once
+// c.mu is released. c.mu must be held.
+func (c *Client) currentInbox() (ib, stale *inbox) {
+	if c.inbox != nil && c.inbox.out != c.Messages {
+		stale = c.inbox
+		c.inbox = nil
+	}
+	if c.inbox == nil {
+		c.inbox = newInbox(c.Messages, c.OptInbound, c.messageDropped)
+	}
+	return c.inbox, stale
+}
+
+// isClosed reports whether the client is shutting down or shut down.
+func (c *Client) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
+
+func (c *Client) messageDropped(m Message) {
+	atomic.AddUint64(&c.dropped, 1)
+	c.logger().Warn("message dropped", logKeyTopic, m.Topic, logKeyPacketID, m.ID)
+	c.observer().MessageDropped()
+	if handler := c.handler(); handler != nil {
+		handler(Event{State: StateMessageDropped, Description: m.Topic})
+	}
+}
+
 // Delete or remove packets from inflight packet queue
 func (c *Client) addInflight(p QOSOutPacket) {
+	var count int
 	c.mu.Lock()
 	{
+		// PUBREL replacing a PUBLISH keeps the publish time.
+		if _, found := c.sent[p.PacketID()]; !found {
+			if c.sent == nil {
+				c.sent = make(map[int]time.Time)
+			}
+			c.sent[p.PacketID()] = time.Now()
+		}
 		c.inflight[p.PacketID()] = p
+		count = len(c.inflight)
 	}
 	c.mu.Unlock()
+	c.observer().InflightChanged(count)
 }
 
 func (c *Client) deleteInflight(id int) {
+	var count, qos int
+	var latency time.Duration
 	c.mu.Lock()
 	{
+		// Publish is acknowledged with PUBACK for QOS 1, or completed with PUBCOMP
+		// for QOS 2, when PUBREL has replaced it in inflight state.
+		switch p := c.inflight[id].(type) {
+		case PublishPacket:
+			qos = p.Qos
+		case PubRelPacket:
+			qos = 2
+		}
+		latency = time.Since(c.sent[id])
+		delete(c.sent, id)
 		delete(c.inflight, id)
+		count = len(c.inflight)
+		// Shutdown is waiting for inflight packets to be acknowledged
+		if len(c.inflight) == 0 && c.idle != nil {
+			close(c.idle)
+			c.idle = nil
+		}
 	}
 	c.mu.Unlock()
+	c.ids.release(id)
+
+	observer := c.observer()
+	if qos > 0 {
+		observer.PublishAcked(qos, latency)
+	}
+	observer.InflightChanged(count)
 }
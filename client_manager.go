@@ -1,7 +1,5 @@
 package mqtt // import "gosrc.io/mqtt"
 
-import "log"
-
 // postConnect function, if defined, is executed right after connection
 // success (CONNACK).
 type postConnect func(c *Client) // TODO Should we not take an MQTT client, but an io.Writer ?
@@ -13,7 +11,10 @@ type ClientManager struct {
 	PostConnect postConnect
 	// TODO Handler func to rebroadcast MQTT event
 	// Handler     mqtt.EventHandler
-	// TODO: Configurable logger
+
+	// Logger receives client manager log records. Default is to use
+	// client Logger.
+	Logger Logger
 }
 
 // NewClientManager creates a new client manager structure, intended to support
@@ -29,28 +30,36 @@ func NewClientManager(client *Client, pc postConnect) *ClientManager {
 // Start launch the connection loop
 func (cm *ClientManager) Start() {
 	// TODO Fix me: Ensure we do not override existing handler by supporting a list of handlers.
-	cm.Client.Handler = func(e Event) {
+	// Message channel is read once: Client resets it on shutdown.
+	msgs := cm.Client.Messages
+	cm.Client.SetHandler(func(e Event) {
 		if e.State == StateDisconnected {
-			cm.connect(cm.Client.Messages)
+			if cm.connect(msgs) == nil {
+				cm.Client.observer().Reconnected()
+			}
 		}
-	}
-	cm.connect(cm.Client.Messages)
+	})
+	_ = cm.connect(msgs)
 }
 
 // Stop cancels pending operations and terminates existing MQTT client.
 func (cm *ClientManager) Stop() {
 	// Remove on disconnect handler to avoid triggering reconnect
-	cm.Client.Handler = nil
+	cm.Client.SetHandler(nil)
 	cm.Client.Disconnect()
 }
 
 // connect manages the reconnection loop and apply the define backoff to avoid overloading the server.
-func (cm *ClientManager) connect(msgs chan<- Message) {
+// It only fails when the client is closed.
+func (cm *ClientManager) connect(msgs chan<- Message) error {
 	var backoff Backoff // TODO Probably group backoff calculation features with connection manager.
 
 	for {
 		if err := cm.Client.Connect(msgs); err != nil {
-			log.Printf("Connection error: %v\n", err)
+			if err == ErrClientClosed {
+				return err
+			}
+			cm.logger().Warn("connection failed", logKeyError, err)
 			backoff.Wait()
 		} else {
 			break
@@ -60,4 +69,15 @@ func (cm *ClientManager) connect(msgs chan<- Message) {
 	if cm.PostConnect != nil {
 		cm.PostConnect(cm.Client)
 	}
+	return nil
+}
+
+// logger returns the client manager logger, adding client fields to log
+// records.
+func (cm *ClientManager) logger() Logger {
+	logger := cm.Logger
+	if logger == nil {
+		logger = cm.Client.Logger
+	}
+	return withFields(logger, logKeyClientID, cm.Client.ClientID, logKeyBroker, cm.Client.Address)
 }
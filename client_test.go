@@ -1,10 +1,15 @@
 package mqtt_test // import "gosrc.io/mqtt"
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -96,6 +101,569 @@ func TestClient_KeepAliveDisable(t *testing.T) {
 	mock.Stop()
 }
 
+// TestClient_SubscribeHandler checks that messages are dispatched to the
+// handler matching their topic, and to the default channel otherwise.
+func TestClient_SubscribeHandler(t *testing.T) {
+	// Setup Mock server
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, handlerPublishOnSubscribe); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	// Test / Check result
+	client := mqtt.NewClient(testMQTTAddress)
+	messages := make(chan mqtt.Message, 1)
+	if err := client.Connect(messages); err != nil {
+		t.Fatalf("MQTT connection failed: %s", err)
+	}
+
+	handled := make(chan mqtt.Message, 1)
+	handler := mqtt.HandlerFunc(func(m mqtt.Message) { handled <- m })
+	if err := client.SubscribeHandler(mqtt.Topic{Name: "sensors/+/temp"}, handler); err != nil {
+		t.Fatalf("cannot subscribe: %s", err)
+	}
+
+	select {
+	case m := <-handled:
+		if m.Topic != "sensors/kitchen/temp" {
+			t.Errorf("incorrect handled message topic (%q) = %q", m.Topic, "sensors/kitchen/temp")
+		}
+	case <-time.After(time.Second):
+		t.Error("handler was not called")
+	}
+
+	select {
+	case m := <-messages:
+		if m.Topic != "other/topic" {
+			t.Errorf("incorrect default channel message topic (%q) = %q", m.Topic, "other/topic")
+		}
+	case <-time.After(time.Second):
+		t.Error("message matching no handler was not sent to default channel")
+	}
+}
+
+// TestClient_ManualAck checks that PUBACK is sent only when the application
+// acknowledges the message.
+func TestClient_ManualAck(t *testing.T) {
+	// Setup Mock server
+	acked := make(chan mqtt.Packet, 1)
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, func(t *testing.T, c net.Conn) {
+		expectPacket(t, c, mqtt.PacketConnect)
+		c.Write(mqtt.ConnAckPacket{}.Marshall())
+		c.Write(mqtt.PublishPacket{ID: 5, Qos: 1, Topic: "test/topic"}.Marshall())
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		p, _ := mqtt.PacketRead(c)
+		acked <- p
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	// Test / Check result
+	client := mqtt.NewClient(testMQTTAddress)
+	client.ManualAck = true
+	messages := make(chan mqtt.Message, 1)
+	if err := client.Connect(messages); err != nil {
+		t.Fatalf("MQTT connection failed: %s", err)
+	}
+
+	m := <-messages
+	select {
+	case p := <-acked:
+		t.Fatalf("message should not be acknowledged before application ack: %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	m.Ack()
+	select {
+	case p := <-acked:
+		if p != (mqtt.PubAckPacket{ID: 5}) {
+			t.Errorf("incorrect ack packet (%s) = %s", p, mqtt.PubAckPacket{ID: 5})
+		}
+	case <-time.After(time.Second):
+		t.Error("message was not acknowledged")
+	}
+}
+
+func TestClient_Will(t *testing.T) {
+	// Setup Mock server
+	connects := make(chan mqtt.ConnectPacket, 1)
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, func(t *testing.T, c net.Conn) {
+		connect, _ := expectPacket(t, c, mqtt.PacketConnect).(mqtt.ConnectPacket)
+		connects <- connect
+		c.Write(mqtt.ConnAckPacket{}.Marshall())
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	// Test / Check result
+	client := mqtt.NewClient(testMQTTAddress)
+	client.Will = mqtt.OptWill{Topic: "devices/1/status", Payload: []byte{0, 'o', 'f', 'f'}, QOS: 1, Retain: true}
+	if err := client.Connect(make(chan mqtt.Message)); err != nil {
+		t.Fatalf("MQTT connection failed: %s", err)
+	}
+
+	connect := <-connects
+	if !connect.WillFlag || connect.WillTopic != client.Will.Topic || connect.WillQOS != 1 || !connect.WillRetain {
+		t.Errorf("incorrect will in connect packet: %s", connect)
+	}
+	if !bytes.Equal(connect.WillMessage, client.Will.Payload) {
+		t.Errorf("incorrect will message (%q) = %q", connect.WillMessage, client.Will.Payload)
+	}
+}
+
+func TestClient_PublishQOS2(t *testing.T) {
+	// Setup Mock server
+	received := make(chan mqtt.PublishPacket, 1)
+	completed := make(chan struct{})
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, func(t *testing.T, c net.Conn) {
+		expectPacket(t, c, mqtt.PacketConnect)
+		c.Write(mqtt.ConnAckPacket{}.Marshall())
+		publish, _ := expectPacket(t, c, mqtt.PacketPublish).(mqtt.PublishPacket)
+		received <- publish
+		c.Write(mqtt.PubRecPacket{ID: publish.ID}.Marshall())
+		if p := expectPacket(t, c, mqtt.PacketPubRel); p != (mqtt.PubRelPacket{ID: publish.ID}) {
+			t.Errorf("incorrect release packet (%s) = %s", p, mqtt.PubRelPacket{ID: publish.ID})
+		}
+		c.Write(mqtt.PubCompPacket{ID: publish.ID}.Marshall())
+		close(completed)
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	// Test / Check result
+	client := mqtt.NewClient(testMQTTAddress)
+	if err := client.Connect(make(chan mqtt.Message)); err != nil {
+		t.Fatalf("MQTT connection failed: %s", err)
+	}
+
+	m := mqtt.Message{Topic: "test/topic", Payload: []byte("Hi"), QOS: 2, Retain: true}
+	if err := client.PublishMessage(m); err != nil {
+		t.Fatalf("cannot publish message: %s", err)
+	}
+
+	select {
+	case p := <-received:
+		if p.ID == 0 || p.Qos != 2 || !p.Retain || p.Topic != m.Topic || string(p.Payload) != "Hi" {
+			t.Errorf("incorrect publish packet: %s", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was not published")
+	}
+	select {
+	case <-completed:
+	case <-time.After(time.Second):
+		t.Error("QOS 2 flow was not completed")
+	}
+
+	if err := client.PublishMessage(mqtt.Message{Topic: "test/topic", QOS: 3}); err != mqtt.ErrInvalidQOS {
+		t.Errorf("incorrect error for invalid qos (%v) = %v", err, mqtt.ErrInvalidQOS)
+	}
+}
+
+func TestClient_ResendInflight(t *testing.T) {
+	// Setup Mock server: First connection is closed before acknowledging
+	// the message.
+	var connections int64
+	resent := make(chan mqtt.PublishPacket, 1)
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, func(t *testing.T, c net.Conn) {
+		expectPacket(t, c, mqtt.PacketConnect)
+		c.Write(mqtt.ConnAckPacket{}.Marshall())
+		publish, _ := expectPacket(t, c, mqtt.PacketPublish).(mqtt.PublishPacket)
+		if atomic.AddInt64(&connections, 1) == 1 {
+			c.Close()
+			return
+		}
+		resent <- publish
+		c.Write(mqtt.PubAckPacket{ID: publish.ID}.Marshall())
+		expectPacket(t, c, mqtt.PacketDisconnect)
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	// Test / Check result
+	client := mqtt.NewClient(testMQTTAddress)
+	client.Messages = make(chan mqtt.Message)
+	cm := mqtt.NewClientManager(client, nil)
+	cm.Start()
+
+	if err := client.PublishMessage(mqtt.Message{Topic: "test/topic", Payload: []byte("Hi"), QOS: 1}); err != nil {
+		t.Fatalf("cannot publish message: %s", err)
+	}
+
+	select {
+	case p := <-resent:
+		if !p.Dup || p.ID == 0 || p.Topic != "test/topic" || string(p.Payload) != "Hi" {
+			t.Errorf("incorrect resent publish packet: %s", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not sent again after reconnection")
+	}
+
+	// Resent message has been acknowledged: Nothing is left inflight.
+	client.SetHandler(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Errorf("inflight message was not acknowledged: %s", err)
+	}
+}
+
+func TestClient_PublishBeforeConnect(t *testing.T) {
+	// Setup Mock server
+	server := newAckServer()
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, server.handle); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	// Test / Check result
+	client := mqtt.NewClient(testMQTTAddress)
+	published := make(chan error, 1)
+	go func() {
+		published <- client.PublishMessage(mqtt.Message{Topic: "test/topic", Payload: []byte("Hi"), QOS: 1})
+	}()
+	select {
+	case err := <-published:
+		if err != nil {
+			t.Fatalf("cannot publish message: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish before connect should not block")
+	}
+
+	// Message is kept inflight and sent on connection.
+	if err := client.Connect(make(chan mqtt.Message, 10)); err != nil {
+		t.Fatalf("MQTT connection failed: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Errorf("message was not sent on connection: %s", err)
+	}
+	if n := server.publishes(); n != 1 {
+		t.Errorf("incorrect number of publish packets received (%d) = %d", n, 1)
+	}
+}
+
+func TestClient_ResendSubscribe(t *testing.T) {
+	// Setup Mock server: First connection is closed before acknowledging
+	// the subscriptions.
+	var connections int64
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, func(t *testing.T, c net.Conn) {
+		expectPacket(t, c, mqtt.PacketConnect)
+		c.Write(mqtt.ConnAckPacket{}.Marshall())
+		subscribe, _ := expectPacket(t, c, mqtt.PacketSubscribe).(mqtt.SubscribePacket)
+		unsubscribe, _ := expectPacket(t, c, mqtt.PacketUnsubscribe).(mqtt.UnsubscribePacket)
+		if atomic.AddInt64(&connections, 1) == 1 {
+			c.Close()
+			return
+		}
+		c.Write(mqtt.SubAckPacket{ID: subscribe.ID, ReturnCodes: []int{1}}.Marshall())
+		c.Write(mqtt.UnsubAckPacket{ID: unsubscribe.ID}.Marshall())
+		expectPacket(t, c, mqtt.PacketDisconnect)
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	// Test / Check result
+	client := mqtt.NewClient(testMQTTAddress)
+	client.Messages = make(chan mqtt.Message)
+	cm := mqtt.NewClientManager(client, nil)
+	cm.Start()
+
+	if err := client.Subscribe(mqtt.Topic{Name: "test/a", QOS: 1}); err != nil {
+		t.Fatalf("cannot subscribe: %s", err)
+	}
+	if err := client.Unsubscribe("test/b"); err != nil {
+		t.Fatalf("cannot unsubscribe: %s", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt64(&connections) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriptions were not sent again after reconnection")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Subscriptions sent again are acknowledged: Nothing is left inflight.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client.SetHandler(nil)
+	if err := client.Shutdown(ctx); err != nil {
+		t.Errorf("subscriptions were not acknowledged: %s", err)
+	}
+	if qos, ok := client.ActiveSubscriptions()["test/a"]; !ok || qos != 1 {
+		t.Errorf("incorrect active subscriptions: %v", client.ActiveSubscriptions())
+	}
+}
+
+func TestClient_Shutdown(t *testing.T) {
+	// Setup Mock server
+	disconnected := make(chan struct{})
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, func(t *testing.T, c net.Conn) {
+		expectPacket(t, c, mqtt.PacketConnect)
+		c.Write(mqtt.ConnAckPacket{}.Marshall())
+		publish, _ := expectPacket(t, c, mqtt.PacketPublish).(mqtt.PublishPacket)
+		// Acknowledgement is delayed: Shutdown must wait for it.
+		time.Sleep(100 * time.Millisecond)
+		c.Write(mqtt.PubAckPacket{ID: publish.ID}.Marshall())
+		expectPacket(t, c, mqtt.PacketDisconnect)
+		close(disconnected)
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	// Test / Check result
+	client := mqtt.NewClient(testMQTTAddress)
+	messages := make(chan mqtt.Message)
+	if err := client.Connect(messages); err != nil {
+		t.Fatalf("MQTT connection failed: %s", err)
+	}
+	if err := client.PublishMessage(mqtt.Message{Topic: "test/topic", QOS: 1}); err != nil {
+		t.Fatalf("cannot publish message: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown failed: %s", err)
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Error("DISCONNECT was not sent after acknowledgement")
+	}
+	if _, ok := <-messages; ok {
+		t.Error("message channel should be closed")
+	}
+
+	if err := client.Publish("test/topic", nil); err != mqtt.ErrClientClosed {
+		t.Errorf("incorrect publish error after shutdown (%v) = %v", err, mqtt.ErrClientClosed)
+	}
+	if err := client.Connect(make(chan mqtt.Message)); err != mqtt.ErrClientClosed {
+		t.Errorf("incorrect connect error after shutdown (%v) = %v", err, mqtt.ErrClientClosed)
+	}
+}
+
+func TestClient_ShutdownTimeout(t *testing.T) {
+	// Setup Mock server
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, func(t *testing.T, c net.Conn) {
+		expectPacket(t, c, mqtt.PacketConnect)
+		c.Write(mqtt.ConnAckPacket{}.Marshall())
+		// Messages are received, but the application does not read them.
+		c.Write(mqtt.PublishPacket{Topic: "test/topic"}.Marshall())
+		c.Write(mqtt.PublishPacket{Topic: "test/topic"}.Marshall())
+		// Publish is never acknowledged
+		expectPacket(t, c, mqtt.PacketPublish)
+		expectPacket(t, c, mqtt.PacketDisconnect)
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	// Test / Check result
+	client := mqtt.NewClient(testMQTTAddress)
+	messages := make(chan mqtt.Message)
+	if err := client.Connect(messages); err != nil {
+		t.Fatalf("MQTT connection failed: %s", err)
+	}
+	if err := client.PublishMessage(mqtt.Message{Topic: "test/topic", QOS: 1}); err != nil {
+		t.Fatalf("cannot publish message: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("incorrect shutdown error (%v) = %v", err, context.DeadlineExceeded)
+	}
+	if _, ok := <-messages; ok {
+		t.Error("message channel should be closed")
+	}
+}
+
+// TestClient_ShutdownSpilled checks that shutdown does not deadlock when
+// messages buffered by the overflow policy are dropped.
+func TestClient_ShutdownSpilled(t *testing.T) {
+	// Setup Mock server
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, func(t *testing.T, c net.Conn) {
+		expectPacket(t, c, mqtt.PacketConnect)
+		c.Write(mqtt.ConnAckPacket{}.Marshall())
+		// Messages are received, but the application does not read them.
+		for i := 0; i < 3; i++ {
+			c.Write(mqtt.PublishPacket{Topic: "test/topic"}.Marshall())
+		}
+		expectPacket(t, c, mqtt.PacketDisconnect)
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	// Test / Check result
+	client := mqtt.NewClient(testMQTTAddress)
+	client.OptInbound = mqtt.OptInbound{Overflow: mqtt.OverflowSpill, BufferSize: 4}
+	var dropped int64
+	client.Handler = func(e mqtt.Event) {
+		if e.State == mqtt.StateMessageDropped {
+			atomic.AddInt64(&dropped, 1)
+		}
+	}
+	if err := client.Connect(make(chan mqtt.Message)); err != nil {
+		t.Fatalf("MQTT connection failed: %s", err)
+	}
+	// Let messages be spilled in the inbox buffer.
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		client.Disconnect()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown deadlocked with buffered messages")
+	}
+	if n := atomic.LoadInt64(&dropped); n != 3 {
+		t.Errorf("incorrect dropped messages count (%d) = 3", n)
+	}
+}
+
+// TestClient_ConcurrentUse stresses the client from many goroutines. It is
+// meant to be run with -race.
+func TestClient_ConcurrentUse(t *testing.T) {
+	// Setup Mock server
+	server := newAckServer()
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, server.handle); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	client := mqtt.NewClient(testMQTTAddress)
+	messages := make(chan mqtt.Message, 10)
+	if err := client.Connect(messages); err != nil {
+		t.Fatalf("MQTT connection failed: %s", err)
+	}
+	received := make(chan int)
+	go func() {
+		count := 0
+		for range messages {
+			count++
+		}
+		received <- count
+	}()
+
+	const publishers, publishes = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			topic := fmt.Sprintf("test/%d", i)
+			if err := client.Subscribe(mqtt.Topic{Name: topic, QOS: 1}); err != nil {
+				t.Errorf("cannot subscribe: %s", err)
+			}
+			for j := 0; j < publishes; j++ {
+				m := mqtt.Message{Topic: topic, Payload: []byte("Hi"), QOS: j % 3}
+				if err := client.PublishMessage(m); err != nil {
+					t.Errorf("cannot publish message: %s", err)
+				}
+			}
+			_ = client.ActiveSubscriptions()
+			_ = client.String()
+			client.SetHandler(func(mqtt.Event) {})
+		}(i)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown failed: %s", err)
+	}
+	select {
+	case <-server.disconnected:
+	case <-time.After(time.Second):
+		t.Error("server did not receive DISCONNECT")
+	}
+	if count := server.publishes(); count != publishers*publishes {
+		t.Errorf("incorrect number of publish received by server (%d) = %d", count, publishers*publishes)
+	}
+	if count := <-received; count > publishers*publishes {
+		t.Errorf("too many messages received (%d)", count)
+	}
+	if subscriptions := client.ActiveSubscriptions(); len(subscriptions) != publishers {
+		t.Errorf("incorrect number of subscriptions (%d) = %d", len(subscriptions), publishers)
+	}
+}
+
+// TestClientManager_ConcurrentUse publishes from many goroutines while the
+// client manager starts and stops. It is meant to be run with -race.
+func TestClientManager_ConcurrentUse(t *testing.T) {
+	// Setup Mock server
+	server := newAckServer()
+	mock := MQTTServerMock{}
+	if err := mock.Start(t, server.handle); err != nil {
+		t.Error(err)
+		return
+	}
+	defer mock.Stop()
+
+	client := mqtt.NewClient(testMQTTAddress)
+	messages := make(chan mqtt.Message)
+	client.Messages = messages
+	cm := mqtt.NewClientManager(client, nil)
+	cm.Start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				err := client.PublishMessage(mqtt.Message{Topic: "test/topic", QOS: 1})
+				if err != nil && err != mqtt.ErrClientClosed {
+					t.Errorf("cannot publish message: %s", err)
+				}
+			}
+		}()
+	}
+	cm.Stop()
+	wg.Wait()
+
+	if _, ok := <-messages; ok {
+		t.Error("message channel should be closed")
+	}
+}
+
 //=============================================================================
 // Mock MQTT server for testing client
 
@@ -219,6 +787,96 @@ func handlerConnackSuccess(_ *testing.T, c net.Conn) {
 	c.Write(buf)
 }
 
+// handlerPublishOnSubscribe acknowledges connection and first subscription,
+// then publishes a message on a topic matching the subscription and one on
+// another topic.
+func handlerPublishOnSubscribe(t *testing.T, c net.Conn) {
+	expectPacket(t, c, mqtt.PacketConnect)
+	c.Write(mqtt.ConnAckPacket{}.Marshall())
+
+	p := expectPacket(t, c, mqtt.PacketSubscribe)
+	if subscribe, ok := p.(mqtt.SubscribePacket); ok {
+		c.Write(mqtt.SubAckPacket{ID: subscribe.ID, ReturnCodes: []int{0}}.Marshall())
+	}
+
+	c.Write(mqtt.PublishPacket{Topic: "sensors/kitchen/temp", Payload: []byte("21")}.Marshall())
+	c.Write(mqtt.PublishPacket{Topic: "other/topic", Payload: []byte("other")}.Marshall())
+}
+
+// ackServer acknowledges all packets sent by the client, and sends publish
+// packets back to the client.
+type ackServer struct {
+	count int64
+	// Closed when DISCONNECT is received
+	disconnected chan struct{}
+	once         sync.Once
+}
+
+func newAckServer() *ackServer {
+	return &ackServer{disconnected: make(chan struct{})}
+}
+
+func (s *ackServer) handle(t *testing.T, c net.Conn) {
+	for {
+		p, err := mqtt.PacketRead(c)
+		if err != nil {
+			return
+		}
+		var response mqtt.Packet
+		switch packet := p.(type) {
+		case mqtt.ConnectPacket:
+			response = mqtt.ConnAckPacket{}
+		case mqtt.PublishPacket:
+			atomic.AddInt64(&s.count, 1)
+			c.Write(mqtt.PublishPacket{Topic: packet.Topic, Payload: packet.Payload}.Marshall())
+			switch packet.Qos {
+			case 1:
+				response = mqtt.PubAckPacket{ID: packet.ID}
+			case 2:
+				response = mqtt.PubRecPacket{ID: packet.ID}
+			}
+		case mqtt.PubRelPacket:
+			response = mqtt.PubCompPacket{ID: packet.ID}
+		case mqtt.SubscribePacket:
+			suback := mqtt.SubAckPacket{ID: packet.ID}
+			for _, topic := range packet.Topics {
+				suback.ReturnCodes = append(suback.ReturnCodes, topic.QOS)
+			}
+			response = suback
+		case mqtt.UnsubscribePacket:
+			response = mqtt.UnsubAckPacket{ID: packet.ID}
+		case mqtt.PingReqPacket:
+			response = mqtt.PingRespPacket{}
+		case mqtt.DisconnectPacket:
+			s.once.Do(func() { close(s.disconnected) })
+			return
+		}
+		if response != nil {
+			c.Write(response.Marshall())
+		}
+	}
+}
+
+func (s *ackServer) publishes() int {
+	return int(atomic.LoadInt64(&s.count))
+}
+
+// expectPacket reads next packet from client and checks its type.
+func expectPacket(t *testing.T, c net.Conn, packetType mqtt.PacketType) mqtt.Packet {
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	defer c.SetReadDeadline(time.Time{})
+
+	p, err := mqtt.PacketRead(c)
+	if err != nil {
+		t.Errorf("did not receive %s from client: %s", packetType, err)
+		return nil
+	}
+	if p.Type() != packetType {
+		t.Errorf("incorrect packet type received from client (%s) = %s", p.Type(), packetType)
+	}
+	return p
+}
+
 func handlerUnauthorized(t *testing.T, c net.Conn) {
 	var p mqtt.Marshaller
 	var err error
@@ -0,0 +1,154 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"io"
+)
+
+// maxRemainingLength is the largest value that can be encoded in the
+// remaining length field of an MQTT control packet (256 MB).
+const maxRemainingLength = 268435455
+
+// inlinePayloadSize is the publish payload size above which the Encoder
+// writes the payload directly to the stream instead of copying it into
+// its own buffer.
+const inlinePayloadSize = 4096
+
+//==============================================================================
+
+// Encoder writes MQTT control packets to an output stream. The Encoder
+// reuses the same buffer for all packets it serializes, so it is not safe
+// for concurrent use. Large publish payloads are written with a separate
+// Write call: Other writers of the stream must be serialized with Encode.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+
+	// MaxPacketSize is the maximum size in bytes of a packet, including its
+	// fixed header. Zero means that only the protocol limit applies.
+	MaxPacketSize int
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the MQTT control packet p to the stream. It returns
+// ErrPacketTooLarge without writing anything if the packet exceeds the
+// maximum packet size.
+func (e *Encoder) Encode(p Packet) error {
+	ep, ok := p.(encodable)
+	if !ok {
+		if e.MaxPacketSize > 0 && PacketSize(p) > e.MaxPacketSize {
+			return ErrPacketTooLarge
+		}
+		_, err := p.WriteTo(e.w)
+		return err
+	}
+
+	length := ep.PayloadSize()
+	size := fixedHeaderSize(length) + length
+	if length > maxRemainingLength || (e.MaxPacketSize > 0 && size > e.MaxPacketSize) {
+		return ErrPacketTooLarge
+	}
+
+	// Large publish payloads are written as is to avoid copying them.
+	if publish, ok := p.(PublishPacket); ok && len(publish.Payload) > inlinePayloadSize {
+		buf := e.grow(publish.headerSize())
+		publish.encodeHeader(buf)
+		if _, err := e.w.Write(buf); err != nil {
+			return err
+		}
+		_, err := e.w.Write(publish.Payload)
+		return err
+	}
+
+	buf := e.grow(size)
+	ep.encode(buf)
+	_, err := e.w.Write(buf)
+	return err
+}
+
+// grow returns the encoder buffer resized to n bytes.
+func (e *Encoder) grow(n int) []byte {
+	if cap(e.buf) < n {
+		e.buf = make([]byte, n)
+	}
+	return e.buf[:n]
+}
+
+//==============================================================================
+
+// Decoder reads and decodes MQTT control packets from an input stream.
+// The Decoder reuses the same buffer to read all packets, so it is not safe
+// for concurrent use. Decoded packets do not reference the Decoder buffer
+// and remain valid after the next call to Decode.
+//
+// The Decoder never reads past the end of the packet it decodes. If you
+// are reading from a network connection, you may want to wrap it in a
+// bufio.Reader to limit the number of system calls.
+type Decoder struct {
+	r       io.Reader
+	buf     []byte
+	scratch [1]byte
+
+	// MaxPacketSize is the maximum size in bytes of a packet, including its
+	// fixed header. Zero means that only the protocol limit applies.
+	// When a packet is too large, Decode returns ErrPacketTooLarge and the
+	// stream should not be read further, as the packet content is not consumed.
+	MaxPacketSize int
+}
+
+// NewDecoder returns a new decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next MQTT control packet from the stream.
+func (d *Decoder) Decode() (Packet, error) {
+	packetType, fixedHeaderFlags, payload, err := d.readPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := decodePacket(packetType, fixedHeaderFlags, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// Publish payload is a slice of our read buffer: It must be copied before
+	// the buffer is reused.
+	if publish, ok := p.(PublishPacket); ok && publish.Payload != nil {
+		publish.Payload = append([]byte(nil), publish.Payload...)
+		return publish, nil
+	}
+	return p, nil
+}
+
+// readPacket reads the fixed header and the rest of the packet in the
+// Decoder buffer. The returned payload is only valid until next read.
+func (d *Decoder) readPacket() (packetType int, fixedHeaderFlags int, payload []byte, err error) {
+	if _, err = io.ReadFull(d.r, d.scratch[:]); err != nil {
+		return
+	}
+	packetType = int(d.scratch[0] >> 4)
+	fixedHeaderFlags = int(d.scratch[0] & 15) // keep only last 4 bits
+
+	var length int
+	if length, err = decodeRemainingLength(d.r, d.scratch[:]); err != nil {
+		return
+	}
+	if d.MaxPacketSize > 0 && fixedHeaderSize(length)+length > d.MaxPacketSize {
+		err = ErrPacketTooLarge
+		return
+	}
+
+	if cap(d.buf) < length {
+		d.buf = make([]byte, length)
+	}
+	payload = d.buf[:length]
+	if _, err = io.ReadFull(d.r, payload); err != nil {
+		return
+	}
+	return
+}
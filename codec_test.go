@@ -0,0 +1,159 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncoderDecoder(t *testing.T) {
+	packets := []Packet{
+		getConnect(),
+		ConnAckPacket{ReturnCode: ConnRefusedNotAuthorized},
+		PublishPacket{ID: 12, Qos: 1, Topic: "test/1", Payload: []byte("Hi")},
+		PubAckPacket{ID: 12},
+		PubRecPacket{ID: 13},
+		PubRelPacket{ID: 13},
+		PubCompPacket{ID: 13},
+		SubscribePacket{ID: 3, Topics: []Topic{{Name: "test/+", QOS: 1}}},
+		SubAckPacket{ID: 3, ReturnCodes: []int{1}},
+		UnsubscribePacket{ID: 4, Topics: []string{"test/+"}},
+		UnsubAckPacket{ID: 4},
+		PingReqPacket{},
+		PingRespPacket{},
+		DisconnectPacket{},
+	}
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	for _, p := range packets {
+		if err := encoder.Encode(p); err != nil {
+			t.Fatalf("cannot encode packet %T: %s", p, err)
+		}
+	}
+
+	decoder := NewDecoder(&buf)
+	for _, expected := range packets {
+		p, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("cannot decode packet %T: %s", expected, err)
+		}
+		if !bytes.Equal(p.Marshall(), expected.Marshall()) {
+			t.Errorf("decoded packet does not match original (%+v) = %+v", p, expected)
+		}
+	}
+}
+
+func TestEncoderLargePublish(t *testing.T) {
+	// 3 MB payload requires a 4 bytes remaining length field.
+	publish := PublishPacket{ID: 1, Qos: 1, Topic: "test/large", Payload: bytes.Repeat([]byte{'x'}, 3<<20)}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(publish); err != nil {
+		t.Fatalf("cannot encode publish packet: %s", err)
+	}
+	if !bytes.Equal(buf.Bytes(), publish.Marshall()) {
+		t.Error("encoded publish packet does not match marshalled packet")
+	}
+
+	p, err := NewDecoder(&buf).Decode()
+	if err != nil {
+		t.Fatalf("cannot decode publish packet: %s", err)
+	}
+	if !bytes.Equal(p.(PublishPacket).Payload, publish.Payload) {
+		t.Error("incorrect large publish payload")
+	}
+}
+
+func TestPublishWriteTo(t *testing.T) {
+	publish := PublishPacket{ID: 42, Qos: 2, Retain: true, Topic: "test/1", Payload: bytes.Repeat([]byte{'x'}, 300)}
+
+	var buf bytes.Buffer
+	n, err := publish.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("cannot write publish packet: %s", err)
+	}
+	if int(n) != buf.Len() {
+		t.Errorf("incorrect written length (%d) = %d", n, buf.Len())
+	}
+	if !bytes.Equal(buf.Bytes(), publish.Marshall()) {
+		t.Error("written publish packet does not match marshalled packet")
+	}
+}
+
+func TestDecoderReusesBuffer(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	_ = encoder.Encode(PublishPacket{Topic: "test/1", Payload: []byte("first")})
+	_ = encoder.Encode(PublishPacket{Topic: "test/1", Payload: []byte("other")})
+
+	decoder := NewDecoder(&buf)
+	p1, _ := decoder.Decode()
+	p2, _ := decoder.Decode()
+	if payload := string(p1.(PublishPacket).Payload); payload != "first" {
+		t.Errorf("first payload was overwritten (%q) = %q", payload, "first")
+	}
+	if payload := string(p2.(PublishPacket).Payload); payload != "other" {
+		t.Errorf("incorrect payload (%q) = %q", payload, "other")
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	publish := PublishPacket{Topic: "test/1", Payload: make([]byte, 100)}
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	encoder.MaxPacketSize = 100
+	if err := encoder.Encode(publish); err != ErrPacketTooLarge {
+		t.Errorf("incorrect encode error (%v) = %v", err, ErrPacketTooLarge)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("packet too large should not be written (%d bytes)", buf.Len())
+	}
+
+	// Packets that cannot be encoded in the Encoder buffer are checked too.
+	if err := encoder.Encode(opaquePacket{publish}); err != ErrPacketTooLarge {
+		t.Errorf("incorrect encode error (%v) = %v", err, ErrPacketTooLarge)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("packet too large should not be written (%d bytes)", buf.Len())
+	}
+
+	decoder := NewDecoder(bytes.NewReader(publish.Marshall()))
+	decoder.MaxPacketSize = 100
+	if _, err := decoder.Decode(); err != ErrPacketTooLarge {
+		t.Errorf("incorrect decode error (%v) = %v", err, ErrPacketTooLarge)
+	}
+}
+
+// opaquePacket hides the encodable implementation of a packet, like packet
+// types defined outside of this package.
+type opaquePacket struct {
+	Packet
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	// SUBSCRIBE with a topic length larger than the packet.
+	input := []byte{subscribeType<<4 | 2, 6, 0, 1, 0, 10, 'a', 'b'}
+	if _, err := NewDecoder(bytes.NewReader(input)).Decode(); err != ErrMalformedPacket {
+		t.Errorf("incorrect decode error (%v) = %v", err, ErrMalformedPacket)
+	}
+
+	// Reserved packet type.
+	input = []byte{reserved2Type << 4, 0}
+	if _, err := NewDecoder(bytes.NewReader(input)).Decode(); err != ErrUnsupportedPacketType {
+		t.Errorf("incorrect decode error (%v) = %v", err, ErrUnsupportedPacketType)
+	}
+}
+
+func BenchmarkPublishEncode(b *testing.B) {
+	publish := PublishPacket{ID: 1, Qos: 1, Topic: "test/bench", Payload: make([]byte, 256)}
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		_ = encoder.Encode(publish)
+	}
+}
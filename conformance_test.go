@@ -0,0 +1,986 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gosrc.io/mqtt"
+	"gosrc.io/mqtt/broker"
+	"gosrc.io/mqtt/mqtttest"
+	"gosrc.io/mqtt/topic"
+)
+
+// Conformance tests check the normative statements of the MQTT 3.1.1
+// specification, identified as [MQTT-x.x.x-y], against the packet codec, the
+// topic package, the client and the broker. Requirements without statement
+// identifier refer to their specification section, like 2.2.3. Run with -v
+// to print the statements covered:
+//
+//	go test -v -run TestConformance
+//
+// Broker statements are checked against an in-process broker.Server, or
+// against the broker at the address of MQTT_CONFORMANCE_BROKER environment
+// variable, for example tcp://localhost:1883.
+
+// conformanceCase checks specification statements.
+type conformanceCase struct {
+	statements []string
+	name       string
+	test       func(t *testing.T)
+}
+
+func TestConformance(t *testing.T) {
+	b := newBrokerUnderTest()
+	defer b.close()
+
+	groups := []struct {
+		name  string
+		cases []conformanceCase
+	}{
+		{"codec", codecConformance()},
+		{"topic", topicConformance()},
+		{"client", clientConformance()},
+		{"broker", brokerConformance(b)},
+	}
+
+	// Results of the cases checking each statement
+	results := make(map[string][]string)
+	for _, g := range groups {
+		t.Run(g.name, func(t *testing.T) {
+			for _, c := range g.cases {
+				result := "FAIL"
+				if t.Run(c.name, c.test) {
+					result = "ok"
+				}
+				for _, s := range c.statements {
+					results[s] = append(results[s], fmt.Sprintf("%s %s: %s", result, g.name, c.name))
+				}
+			}
+		})
+	}
+
+	statements := make([]string, 0, len(results))
+	for s := range results {
+		statements = append(statements, s)
+	}
+	sort.Slice(statements, func(i, j int) bool {
+		return statementLess(statements[i], statements[j])
+	})
+	t.Logf("%d MQTT 3.1.1 statements covered:", len(statements))
+	for _, s := range statements {
+		t.Logf("[%s]", s)
+		for _, r := range results[s] {
+			t.Logf("    %s", r)
+		}
+	}
+}
+
+// statementLess orders statement identifiers by section numbers.
+func statementLess(a, b string) bool {
+	na, nb := statementNumbers(a), statementNumbers(b)
+	for i := 0; i < len(na) && i < len(nb); i++ {
+		if na[i] != nb[i] {
+			return na[i] < nb[i]
+		}
+	}
+	return len(na) < len(nb)
+}
+
+func statementNumbers(s string) []int {
+	var numbers []int
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r < '0' || r > '9' }) {
+		n, _ := strconv.Atoi(f)
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+// ============================================================================
+// Test vectors
+
+// malformedPackets are invalid packets, with the statement they break. The
+// receiver must close the connection [MQTT-4.8.0-1].
+var malformedPackets = []struct {
+	statement string
+	name      string
+	packet    []byte
+}{
+	{"MQTT-2.2.2-2", "PUBACK with flags", []byte{0x41, 2, 0, 1}},
+	{"MQTT-2.2.2-2", "SUBSCRIBE without flags", []byte{0x80, 6, 0, 1, 0, 1, 'a', 0}},
+	{"MQTT-2.2.2-2", "PINGRESP with flags", []byte{0xD8, 0}},
+	{"MQTT-3.3.1-4", "PUBLISH with QOS 3", []byte{0x36, 5, 0, 1, 'a', 0, 1}},
+	{"MQTT-1.5.3-1", "PUBLISH with ill-formed UTF-8 topic", []byte{0x30, 3, 0, 1, 0xFF}},
+	{"MQTT-1.5.3-1", "PUBLISH with UTF-16 surrogate in topic", []byte{0x30, 5, 0, 3, 0xED, 0xA0, 0x80}},
+	{"MQTT-1.5.3-1", "PUBLISH with overlong UTF-8 topic", []byte{0x30, 4, 0, 2, 0xC0, 0xAF}},
+	{"MQTT-1.5.3-2", "PUBLISH with null character in topic", []byte{0x30, 5, 0, 3, 'a', 0, 'b'}},
+	{"MQTT-3.8.3-4", "SUBSCRIBE with QOS 3", []byte{0x82, 6, 0, 1, 0, 1, 'a', 3}},
+	{"MQTT-3.8.3-4", "SUBSCRIBE with reserved bits", []byte{0x82, 6, 0, 1, 0, 1, 'a', 0x41}},
+	{"MQTT-3.8.3-3", "SUBSCRIBE without topic filter", []byte{0x82, 2, 0, 1}},
+	{"MQTT-3.10.3-2", "UNSUBSCRIBE without topic filter", []byte{0xA2, 2, 0, 1}},
+	{"2.2.3", "remaining length on 5 bytes", []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}},
+	{"1.5.3", "string longer than packet", []byte{0x30, 4, 0, 10, 'a', 'b'}},
+	{"2.3.1", "PUBACK without packet identifier", []byte{0x40, 1, 0}},
+	{"2.3.1", "QOS 1 PUBLISH without packet identifier", []byte{0x32, 3, 0, 1, 'a'}},
+}
+
+// malformedConnects are invalid CONNECT packets, with the statement they
+// break. The server must close the connection without CONNACK
+// [MQTT-3.1.4-1].
+var malformedConnects = []struct {
+	statement string
+	name      string
+	packet    []byte
+}{
+	{"MQTT-3.1.2-3", "reserved flag", rawConnect(0x03)},
+	{"MQTT-3.1.2-11", "will QOS without will", rawConnect(0x0A)},
+	{"MQTT-3.1.2-13", "will QOS without will", rawConnect(0x12)},
+	{"MQTT-3.1.2-14", "will QOS 3", rawConnect(0x1E)},
+	{"MQTT-3.1.2-15", "will retain without will", rawConnect(0x22)},
+	{"MQTT-3.1.2-22", "password without user name", rawConnect(0x82)},
+	{"MQTT-3.1.3-4", "ill-formed UTF-8 client ID", []byte{0x10, 13, 0, 4, 'M', 'Q', 'T', 'T', 4, 2, 0, 0, 0, 1, 0xFF}},
+}
+
+// rawConnect returns a CONNECT packet with connect flags and a client ID,
+// without payload for other flags.
+func rawConnect(flags byte) []byte {
+	return []byte{0x10, 13, 0, 4, 'M', 'Q', 'T', 'T', 4, flags, 0, 0, 0, 1, 'c'}
+}
+
+// packetFlags are valid packets, with the value of their fixed header flags
+// [MQTT-2.2.2-1].
+var packetFlags = []struct {
+	statement string
+	packet    mqtt.Packet
+	flags     byte
+}{
+	{"MQTT-2.2.2-1", mqtt.ConnectPacket{ClientID: "c"}, 0},
+	{"MQTT-2.2.2-1", mqtt.ConnAckPacket{}, 0},
+	{"MQTT-2.2.2-1", mqtt.PubAckPacket{ID: 1}, 0},
+	{"MQTT-2.2.2-1", mqtt.PubRecPacket{ID: 1}, 0},
+	{"MQTT-3.6.1-1", mqtt.PubRelPacket{ID: 1}, 2},
+	{"MQTT-2.2.2-1", mqtt.PubCompPacket{ID: 1}, 0},
+	{"MQTT-3.8.1-1", mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: "a"}}}, 2},
+	{"MQTT-2.2.2-1", mqtt.SubAckPacket{ID: 1, ReturnCodes: []int{0}}, 0},
+	{"MQTT-3.10.1-1", mqtt.UnsubscribePacket{ID: 1, Topics: []string{"a"}}, 2},
+	{"MQTT-2.2.2-1", mqtt.UnsubAckPacket{ID: 1}, 0},
+	{"MQTT-2.2.2-1", mqtt.PingReqPacket{}, 0},
+	{"MQTT-2.2.2-1", mqtt.PingRespPacket{}, 0},
+	{"MQTT-2.2.2-1", mqtt.DisconnectPacket{}, 0},
+}
+
+// rawPacket is a packet written as is, to send malformed packets.
+type rawPacket []byte
+
+func (p rawPacket) Marshall() []byte { return p }
+
+func (p rawPacket) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(p)
+	return int64(n), err
+}
+
+func (p rawPacket) Type() mqtt.PacketType { return mqtt.PacketType(p[0] >> 4) }
+func (p rawPacket) String() string        { return fmt.Sprintf("raw packet % x", []byte(p)) }
+
+// ============================================================================
+// Codec
+
+func codecConformance() []conformanceCase {
+	cases := []conformanceCase{
+		{[]string{"MQTT-2.3.1-1"}, "packet identifier is not zero", func(t *testing.T) {
+			for _, p := range []mqtt.Packet{
+				mqtt.PublishPacket{Topic: "a", Qos: 1},
+				mqtt.PublishPacket{Topic: "a", Qos: 2},
+				mqtt.SubscribePacket{Topics: []mqtt.Topic{{Name: "a"}}},
+				mqtt.UnsubscribePacket{Topics: []string{"a"}},
+			} {
+				decoded := roundTrip(t, p)
+				if id := decoded.(interface{ PacketID() int }).PacketID(); id == 0 {
+					t.Errorf("%s encoded with packet identifier 0", p.Type())
+				}
+			}
+		}},
+		{[]string{"MQTT-2.3.1-5"}, "QOS 0 PUBLISH has no packet identifier", func(t *testing.T) {
+			expected := []byte{0x30, 4, 0, 1, 'a', 'b'}
+			if b := (mqtt.PublishPacket{ID: 7, Topic: "a", Payload: []byte("b")}).Marshall(); !bytes.Equal(b, expected) {
+				t.Errorf("incorrect encoded packet (% x) = % x", b, expected)
+			}
+		}},
+		{[]string{"MQTT-1.5.3-3"}, "byte order mark is not stripped", func(t *testing.T) {
+			decoded := roundTrip(t, mqtt.PublishPacket{Topic: "\uFEFFa"}).(mqtt.PublishPacket)
+			if decoded.Topic != "\uFEFFa" {
+				t.Errorf("incorrect topic (%q) = %q", decoded.Topic, "\uFEFFa")
+			}
+		}},
+		{[]string{"1.5.3"}, "string of maximum length", func(t *testing.T) {
+			name := strings.Repeat("a", 65535)
+			decoded := roundTrip(t, mqtt.PublishPacket{Topic: name}).(mqtt.PublishPacket)
+			if decoded.Topic != name {
+				t.Errorf("incorrect topic length (%d) = %d", len(decoded.Topic), len(name))
+			}
+		}},
+		{[]string{"2.2.3"}, "remaining length boundaries", func(t *testing.T) {
+			for _, v := range []struct {
+				length int
+				header []byte
+			}{
+				{3, []byte{0x03}},
+				{127, []byte{0x7F}},
+				{128, []byte{0x80, 0x01}},
+				{16383, []byte{0xFF, 0x7F}},
+				{16384, []byte{0x80, 0x80, 0x01}},
+				{2097151, []byte{0xFF, 0xFF, 0x7F}},
+				{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+			} {
+				// Topic "a" is 3 bytes long.
+				publish := mqtt.PublishPacket{Topic: "a", Payload: bytes.Repeat([]byte{'x'}, v.length-3)}
+				b := publish.Marshall()
+				if !bytes.Equal(b[1:1+len(v.header)], v.header) {
+					t.Errorf("incorrect remaining length %d (% x) = % x", v.length, b[1:1+len(v.header)], v.header)
+				}
+				decoded := roundTrip(t, publish).(mqtt.PublishPacket)
+				if !bytes.Equal(decoded.Payload, publish.Payload) {
+					t.Errorf("incorrect payload for remaining length %d", v.length)
+				}
+			}
+
+			if p := roundTrip(t, mqtt.PingReqPacket{}); p.Type() != mqtt.PacketPingReq {
+				t.Errorf("incorrect packet with remaining length 0: %s", p)
+			}
+
+			// Maximum remaining length, 268435455, is decoded: The packet is
+			// only refused because of the decoder limit.
+			decoder := mqtt.NewDecoder(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F}))
+			decoder.MaxPacketSize = 1
+			if _, err := decoder.Decode(); err != mqtt.ErrPacketTooLarge {
+				t.Errorf("incorrect error for maximum remaining length (%v) = %v", err, mqtt.ErrPacketTooLarge)
+			}
+		}},
+		{[]string{"MQTT-3.1.3-1", "MQTT-3.1.2-9", "MQTT-3.1.2-19", "MQTT-3.1.2-21"}, "CONNECT payload order", func(t *testing.T) {
+			connect := mqtt.ConnectPacket{
+				ProtocolName:  mqtt.ProtocolName,
+				ProtocolLevel: mqtt.ProtocolLevel,
+				ClientID:      "c",
+				CleanSession:  true,
+				Keepalive:     10,
+				WillFlag:      true,
+				WillTopic:     "w",
+				WillMessage:   []byte("m"),
+				WillQOS:       1,
+				WillRetain:    true,
+				Username:      "u",
+				Password:      "p",
+			}
+			expected := []byte{
+				0x10, 25, 0, 4, 'M', 'Q', 'T', 'T', 4, 0xEE, 0, 10,
+				0, 1, 'c', 0, 1, 'w', 0, 1, 'm', 0, 1, 'u', 0, 1, 'p',
+			}
+			if b := connect.Marshall(); !bytes.Equal(b, expected) {
+				t.Errorf("incorrect encoded packet (% x) = % x", b, expected)
+			}
+			if decoded := roundTrip(t, connect).(mqtt.ConnectPacket); decoded.String() != connect.String() || decoded.Password != "p" {
+				t.Errorf("incorrect decoded packet (%s) = %s", decoded, connect)
+			}
+		}},
+		{[]string{"MQTT-3.1.2-3", "MQTT-3.1.2-11", "MQTT-3.1.2-13", "MQTT-3.1.2-15"}, "CONNECT flags without will", func(t *testing.T) {
+			b := (mqtt.ConnectPacket{ClientID: "c", WillQOS: 2, WillRetain: true}).Marshall()
+			if flags := b[9]; flags != 0 {
+				t.Errorf("incorrect connect flags (%08b) = 0", flags)
+			}
+		}},
+		{[]string{"MQTT-3.1.2-18", "MQTT-3.1.2-20", "MQTT-3.1.2-22"}, "CONNECT without user name or password", func(t *testing.T) {
+			// Password is not sent without user name.
+			expected := []byte{0x10, 13, 0, 4, 'M', 'Q', 'T', 'T', 4, 0, 0, 0, 0, 1, 'c'}
+			if b := (mqtt.ConnectPacket{ClientID: "c", Password: "p"}).Marshall(); !bytes.Equal(b, expected) {
+				t.Errorf("incorrect encoded packet (% x) = % x", b, expected)
+			}
+			expected = []byte{0x10, 16, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x40, 0, 0, 0, 1, 'c', 0, 1, 'u'}
+			if b := (mqtt.ConnectPacket{ClientID: "c", Username: "u"}).Marshall(); !bytes.Equal(b, expected) {
+				t.Errorf("incorrect encoded packet (% x) = % x", b, expected)
+			}
+		}},
+	}
+
+	for _, v := range packetFlags {
+		v := v
+		cases = append(cases, conformanceCase{[]string{v.statement}, v.packet.Type().String() + " flags", func(t *testing.T) {
+			b := v.packet.Marshall()
+			if flags := b[0] & 0x0F; flags != v.flags {
+				t.Errorf("incorrect fixed header flags (%04b) = %04b", flags, v.flags)
+			}
+			roundTrip(t, v.packet)
+			// Any other value is malformed.
+			b[0] ^= 1
+			if _, err := decode(b); err == nil {
+				t.Errorf("%s with flags %04b should be malformed", v.packet.Type(), b[0]&0x0F)
+			}
+		}})
+	}
+	for _, v := range malformedPackets {
+		v := v
+		cases = append(cases, conformanceCase{[]string{v.statement}, "decode " + v.name, func(t *testing.T) {
+			if p, err := decode(v.packet); err == nil {
+				t.Errorf("malformed packet should not be decoded: %s", p)
+			}
+		}})
+	}
+	for _, v := range malformedConnects {
+		v := v
+		cases = append(cases, conformanceCase{[]string{v.statement}, "decode CONNECT with " + v.name, func(t *testing.T) {
+			if p, err := decode(v.packet); err == nil {
+				t.Errorf("malformed packet should not be decoded: %s", p)
+			}
+		}})
+	}
+	return cases
+}
+
+func decode(b []byte) (mqtt.Packet, error) {
+	return mqtt.NewDecoder(bytes.NewReader(b)).Decode()
+}
+
+// roundTrip encodes and decodes p.
+func roundTrip(t *testing.T, p mqtt.Packet) mqtt.Packet {
+	t.Helper()
+	decoded, err := decode(p.Marshall())
+	if err != nil {
+		t.Fatalf("cannot decode %s: %s", p.Type(), err)
+	}
+	if decoded.Type() != p.Type() {
+		t.Fatalf("incorrect decoded packet type (%s) = %s", decoded.Type(), p.Type())
+	}
+	return decoded
+}
+
+// ============================================================================
+// Topic
+
+func topicConformance() []conformanceCase {
+	return []conformanceCase{
+		{[]string{"MQTT-4.7.1-1", "MQTT-3.3.2-2"}, "no wildcard in topic name", func(t *testing.T) {
+			for _, name := range []string{"a/+", "#", "a/b#"} {
+				if topic.ValidateName(name) == nil {
+					t.Errorf("topic name %q should be invalid", name)
+				}
+			}
+		}},
+		{[]string{"MQTT-4.7.1-2"}, "multi-level wildcard is last", func(t *testing.T) {
+			checkFilters(t, []string{"#", "a/#", "+/#"}, []string{"a/#/b", "a#", "a/b#", "#/a"})
+		}},
+		{[]string{"MQTT-4.7.1-3"}, "single-level wildcard occupies a level", func(t *testing.T) {
+			checkFilters(t, []string{"+", "a/+/b", "+/+", "/+"}, []string{"a+", "a/b+", "+a/b"})
+		}},
+		{[]string{"MQTT-4.7.2-1"}, "$ topics are not matched by wildcards", func(t *testing.T) {
+			for _, filter := range []string{"#", "+/a", "+/#"} {
+				if topic.Match(filter, "$SYS/a") {
+					t.Errorf("%s should not match $SYS/a", filter)
+				}
+			}
+			if !topic.Match("$SYS/#", "$SYS/a") {
+				t.Error("$SYS/# should match $SYS/a")
+			}
+		}},
+		{[]string{"MQTT-4.7.3-1", "MQTT-4.7.3-2", "MQTT-4.7.3-3", "MQTT-1.5.3-1"}, "topic length and characters", func(t *testing.T) {
+			for _, name := range []string{"", "a\x00b", strings.Repeat("a", 65536), "a\xFF"} {
+				if topic.ValidateName(name) == nil || topic.ValidateFilter(name) == nil {
+					t.Errorf("topic %.10q should be invalid", name)
+				}
+			}
+			if err := topic.ValidateName(strings.Repeat("a", 65535)); err != nil {
+				t.Errorf("topic of maximum length should be valid: %s", err)
+			}
+		}},
+	}
+}
+
+func checkFilters(t *testing.T, valid, invalid []string) {
+	t.Helper()
+	for _, filter := range valid {
+		if err := topic.ValidateFilter(filter); err != nil {
+			t.Errorf("topic filter %q should be valid: %s", filter, err)
+		}
+	}
+	for _, filter := range invalid {
+		if topic.ValidateFilter(filter) == nil {
+			t.Errorf("topic filter %q should be invalid", filter)
+		}
+	}
+}
+
+// ============================================================================
+// Client
+
+func clientConformance() []conformanceCase {
+	connected := mqtttest.Script{
+		mqtttest.Expect(mqtt.PacketConnect),
+		mqtttest.ConnAck(mqtt.ConnAccepted),
+	}
+
+	cases := []conformanceCase{
+		{[]string{"MQTT-3.1.0-1"}, "first packet is CONNECT", func(t *testing.T) {
+			s := mqtttest.NewServer(t, script(connected, mqtttest.Expect(mqtt.PacketDisconnect)))
+			defer s.Close()
+			connectClient(t, s, nil).Disconnect()
+		}},
+		{[]string{"MQTT-3.1.2-23"}, "PINGREQ is sent within keepalive", func(t *testing.T) {
+			s := mqtttest.NewServer(t, script(connected,
+				expectWithin(mqtt.PacketPingReq, 2*time.Second),
+				mqtttest.Send(mqtt.PingRespPacket{}),
+				mqtttest.Expect(mqtt.PacketDisconnect),
+			))
+			defer s.Close()
+			c := mqtt.NewClient(s.Addr)
+			c.Dialer = s.Dialer()
+			c.Keepalive = 1
+			if err := c.Connect(nil); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Disconnect()
+			if s.WaitFor(mqtt.PacketPingReq, 2*time.Second) == nil {
+				t.Error("PINGREQ was not sent")
+			}
+		}},
+		{[]string{"MQTT-2.3.1-1", "MQTT-2.3.1-2", "MQTT-4.3.2-1"}, "QOS 1 PUBLISH", func(t *testing.T) {
+			s := mqtttest.NewServer(t, script(connected,
+				mqtttest.Expect(mqtt.PacketPublish),
+				mqtttest.Expect(mqtt.PacketPublish),
+				mqtttest.Expect(mqtt.PacketDisconnect),
+			))
+			defer s.Close()
+			c := connectClient(t, s, nil)
+			for i := 0; i < 2; i++ {
+				if err := c.PublishMessage(mqtt.Message{Topic: "a", QOS: 1}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			waitPackets(t, s, mqtt.PacketPublish, 2)
+			c.Disconnect()
+
+			received := s.Received(mqtt.PacketPublish)
+			p1, p2 := received[0].(mqtt.PublishPacket), received[1].(mqtt.PublishPacket)
+			if p1.ID == 0 || p2.ID == 0 || p1.ID == p2.ID {
+				t.Errorf("incorrect packet identifiers of unacknowledged publishes: %d, %d", p1.ID, p2.ID)
+			}
+			if p1.Dup || p1.Qos != 1 {
+				t.Errorf("incorrect first publish: %s", p1)
+			}
+		}},
+		{[]string{"MQTT-4.3.3-1", "MQTT-2.3.1-6"}, "QOS 2 PUBLISH", func(t *testing.T) {
+			s := mqtttest.NewServer(t, script(connected,
+				mqtttest.Expect(mqtt.PacketPublish),
+				mqtttest.PubRec(),
+				mqtttest.Expect(mqtt.PacketPubRel),
+				mqtttest.PubComp(),
+				mqtttest.Expect(mqtt.PacketDisconnect),
+			))
+			defer s.Close()
+			c := connectClient(t, s, nil)
+			if err := c.PublishMessage(mqtt.Message{Topic: "a", QOS: 2}); err != nil {
+				t.Fatal(err)
+			}
+			shutdown(t, c)
+
+			publish, _ := s.WaitFor(mqtt.PacketPublish, 0).(mqtt.PublishPacket)
+			pubrel, _ := s.WaitFor(mqtt.PacketPubRel, 0).(mqtt.PubRelPacket)
+			if publish.ID == 0 || pubrel.ID != publish.ID {
+				t.Errorf("incorrect PUBREL packet identifier (%d) = %d", pubrel.ID, publish.ID)
+			}
+		}},
+		{[]string{"MQTT-4.3.2-2", "MQTT-2.3.1-6"}, "QOS 1 PUBLISH is acknowledged", func(t *testing.T) {
+			s := mqtttest.NewServer(t, script(connected,
+				mqtttest.Send(mqtt.PublishPacket{ID: 42, Qos: 1, Topic: "a", Payload: []byte("b")}),
+				mqtttest.ExpectPacket(mqtt.PubAckPacket{ID: 42}),
+				mqtttest.Expect(mqtt.PacketDisconnect),
+			))
+			defer s.Close()
+			messages := make(chan mqtt.Message, 1)
+			c := connectClient(t, s, messages)
+			defer c.Disconnect()
+			expectMessage(t, messages, "a", []byte("b"))
+			waitPackets(t, s, mqtt.PacketPubAck, 1)
+		}},
+		{[]string{"MQTT-4.3.3-2", "MQTT-2.3.1-6"}, "QOS 2 PUBLISH is acknowledged", func(t *testing.T) {
+			s := mqtttest.NewServer(t, script(connected,
+				mqtttest.Send(mqtt.PublishPacket{ID: 43, Qos: 2, Topic: "a", Payload: []byte("b")}),
+				mqtttest.ExpectPacket(mqtt.PubRecPacket{ID: 43}),
+				mqtttest.Send(mqtt.PubRelPacket{ID: 43}),
+				mqtttest.ExpectPacket(mqtt.PubCompPacket{ID: 43}),
+				mqtttest.Expect(mqtt.PacketDisconnect),
+			))
+			defer s.Close()
+			messages := make(chan mqtt.Message, 1)
+			c := connectClient(t, s, messages)
+			defer c.Disconnect()
+			expectMessage(t, messages, "a", []byte("b"))
+			waitPackets(t, s, mqtt.PacketPubComp, 1)
+		}},
+		{[]string{"MQTT-3.3.1-1", "MQTT-4.4.0-1"}, "unacknowledged PUBLISH is sent again", func(t *testing.T) {
+			s := mqtttest.NewServer(t,
+				script(connected, mqtttest.Expect(mqtt.PacketPublish), mqtttest.Disconnect()),
+				script(connected,
+					mqtttest.Drop(mqtt.PacketPingReq),
+					mqtttest.Expect(mqtt.PacketPublish),
+					mqtttest.PubAck(),
+					mqtttest.Expect(mqtt.PacketDisconnect),
+				),
+			)
+			defer s.Close()
+			c := mqtt.NewClient(s.Addr)
+			c.Dialer = s.Dialer()
+			mqtt.NewClientManager(c, nil).Start()
+			if err := c.PublishMessage(mqtt.Message{Topic: "a", QOS: 1}); err != nil {
+				t.Fatal(err)
+			}
+			waitPackets(t, s, mqtt.PacketPublish, 2)
+			shutdown(t, c)
+
+			received := s.Received(mqtt.PacketPublish)
+			first, again := received[0].(mqtt.PublishPacket), received[1].(mqtt.PublishPacket)
+			if first.Dup || !again.Dup || again.ID != first.ID {
+				t.Errorf("incorrect publish sent again (%s) after %s", again, first)
+			}
+		}},
+		{[]string{"MQTT-3.14.4-1", "MQTT-3.14.4-2"}, "connection is closed after DISCONNECT", func(t *testing.T) {
+			s := mqtttest.NewServer(t, script(connected,
+				mqtttest.Expect(mqtt.PacketDisconnect),
+				expectClientClose(),
+			))
+			defer s.Close()
+			connectClient(t, s, nil).Disconnect()
+		}},
+		{[]string{"2.2.3"}, "large PUBLISH is received", func(t *testing.T) {
+			payload := bytes.Repeat([]byte{'x'}, 1<<20)
+			s := mqtttest.NewServer(t, script(connected,
+				mqtttest.Send(mqtt.PublishPacket{Topic: "a", Payload: payload}),
+				mqtttest.Expect(mqtt.PacketDisconnect),
+			))
+			defer s.Close()
+			messages := make(chan mqtt.Message, 1)
+			c := connectClient(t, s, messages)
+			defer c.Disconnect()
+			expectMessage(t, messages, "a", payload)
+		}},
+	}
+
+	for _, v := range malformedPackets {
+		v := v
+		cases = append(cases, conformanceCase{[]string{v.statement, "MQTT-4.8.0-1"}, "close on " + v.name, func(t *testing.T) {
+			s := mqtttest.NewServer(t, script(connected,
+				mqtttest.Send(rawPacket(v.packet)),
+				expectClientClose(),
+			))
+			defer s.Close()
+			c := connectClient(t, s, nil)
+			defer c.Disconnect()
+			waitClosed(t, s)
+		}})
+	}
+	return cases
+}
+
+// script returns a new script made of steps.
+func script(steps mqtttest.Script, more ...mqtttest.Step) mqtttest.Script {
+	return append(append(mqtttest.Script(nil), steps...), more...)
+}
+
+// expectWithin expects a packet of type t within timeout, which can be
+// longer than mqtttest.ExpectTimeout.
+func expectWithin(t mqtt.PacketType, timeout time.Duration) mqtttest.Step {
+	return func(c *mqtttest.Conn) error {
+		p, err := c.Read(timeout)
+		if err != nil {
+			return fmt.Errorf("did not receive %s: %s", t, err)
+		}
+		if p.Type() != t {
+			return fmt.Errorf("incorrect packet received (%s) = %s", p, t)
+		}
+		return nil
+	}
+}
+
+// expectClientClose expects the client to close the connection without
+// sending anything.
+func expectClientClose() mqtttest.Step {
+	return func(c *mqtttest.Conn) error {
+		p, err := c.Read(time.Second)
+		switch {
+		case err == nil:
+			return fmt.Errorf("unexpected %s, connection should be closed", p)
+		case err != io.EOF && err != io.ErrClosedPipe:
+			// net.Pipe deadlines fail with io.ErrClosedPipe once the
+			// client end is closed.
+			return fmt.Errorf("connection was not closed: %s", err)
+		}
+		return mqtttest.Disconnect()(c)
+	}
+}
+
+func connectClient(t *testing.T, s *mqtttest.Server, messages chan<- mqtt.Message) *mqtt.Client {
+	t.Helper()
+	c := mqtt.NewClient(s.Addr)
+	c.Dialer = s.Dialer()
+	if err := c.Connect(messages); err != nil {
+		t.Fatalf("connection failed: %s", err)
+	}
+	return c
+}
+
+// shutdown disconnects c once its inflight messages are acknowledged.
+func shutdown(t *testing.T, c *mqtt.Client) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Errorf("inflight messages were not acknowledged: %s", err)
+	}
+}
+
+func waitPackets(t *testing.T, s *mqtttest.Server, packetType mqtt.PacketType, n int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for len(s.Received(packetType)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("incorrect %s count (%d) = %d", packetType, len(s.Received(packetType)), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitClosed waits until the client connection script is over.
+func waitClosed(t *testing.T, s *mqtttest.Server) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		packets := s.Packets()
+		if last := packets[len(packets)-1]; last.Direction == mqtttest.ToClient && last.Type() != mqtt.PacketConnAck {
+			// Malformed packet was sent: Give the client time to close.
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("malformed packet was not sent")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+}
+
+func expectMessage(t *testing.T, messages <-chan mqtt.Message, topic string, payload []byte) {
+	t.Helper()
+	select {
+	case m := <-messages:
+		if m.Topic != topic || !bytes.Equal(m.Payload, payload) {
+			t.Errorf("incorrect message (%s, %d bytes) = (%s, %d bytes)", m.Topic, len(m.Payload), topic, len(payload))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("message %s was not received", topic)
+	}
+}
+
+// ============================================================================
+// Broker
+
+func brokerConformance(b *brokerUnderTest) []conformanceCase {
+	// Client IDs and topics are unique, for brokers keeping state between
+	// runs.
+	unique := strconv.FormatInt(time.Now().UnixNano(), 36)
+	id := func(name string) string { return "conformance-" + unique + "-" + name }
+
+	cases := []conformanceCase{
+		{[]string{"MQTT-3.1.0-1"}, "first packet must be CONNECT", func(t *testing.T) {
+			c := b.dial(t)
+			defer c.Close()
+			mqtttest.WritePacket(t, c, mqtt.PingReqPacket{})
+			mqtttest.ExpectClosed(t, c)
+		}},
+		{[]string{"MQTT-3.1.0-2"}, "second CONNECT closes connection", func(t *testing.T) {
+			c := b.connect(t, connectPacket(id("second-connect"), true), mqtt.ConnAccepted)
+			defer c.Close()
+			mqtttest.WritePacket(t, c, connectPacket(id("second-connect"), true))
+			mqtttest.ExpectClosed(t, c)
+		}},
+		{[]string{"MQTT-3.1.2-2", "MQTT-3.2.2-4", "MQTT-3.2.2-5"}, "unsupported protocol level", func(t *testing.T) {
+			connect := connectPacket(id("level"), true)
+			connect.ProtocolLevel = 5
+			c := b.connect(t, connect, mqtt.ConnRefusedBadProtocolVersion)
+			defer c.Close()
+			mqtttest.ExpectClosed(t, c)
+		}},
+		{[]string{"MQTT-3.1.3-8"}, "empty client ID with persistent session", func(t *testing.T) {
+			c := b.connect(t, rawPacket(emptyIDConnect(false)), mqtt.ConnRefusedIDRejected)
+			defer c.Close()
+			mqtttest.ExpectClosed(t, c)
+		}},
+		{[]string{"MQTT-3.1.3-5", "MQTT-3.1.3-6"}, "client ID format", func(t *testing.T) {
+			for _, connect := range []mqtt.Packet{
+				rawPacket(emptyIDConnect(true)),
+				connectPacket(unique+strings.Repeat("a", 23-len(unique)), true),
+			} {
+				disconnect(t, b.connect(t, connect, mqtt.ConnAccepted))
+			}
+		}},
+		{[]string{"MQTT-3.1.4-2"}, "session takeover", func(t *testing.T) {
+			c1 := b.connect(t, connectPacket(id("takeover"), true), mqtt.ConnAccepted)
+			defer c1.Close()
+			c2 := b.connect(t, connectPacket(id("takeover"), true), mqtt.ConnAccepted)
+			defer disconnect(t, c2)
+			mqtttest.ExpectClosed(t, c1)
+		}},
+		{[]string{"MQTT-3.2.2-1", "MQTT-3.2.2-2", "MQTT-3.2.2-3"}, "session present", func(t *testing.T) {
+			for _, v := range []struct {
+				clean   bool
+				present bool
+			}{
+				{false, false},
+				{false, true},
+				{true, false},
+			} {
+				c := b.dial(t)
+				mqtttest.WritePacket(t, c, connectPacket(id("session"), v.clean))
+				connack, _ := mqtttest.ReadPacket(t, c).(mqtt.ConnAckPacket)
+				if connack.ReturnCode != mqtt.ConnAccepted || connack.SessionPresent != v.present {
+					t.Errorf("incorrect CONNACK with clean session %t (%s) = %t", v.clean, connack, v.present)
+				}
+				disconnect(t, c)
+			}
+		}},
+		{[]string{"MQTT-3.8.4-1", "MQTT-2.3.1-7", "MQTT-3.9.3-1"}, "SUBACK", func(t *testing.T) {
+			c := b.connect(t, connectPacket(id("suback"), true), mqtt.ConnAccepted)
+			defer disconnect(t, c)
+			mqtttest.WritePacket(t, c, mqtt.SubscribePacket{ID: 10, Topics: []mqtt.Topic{
+				{Name: id("suback/a"), QOS: 2},
+				{Name: id("suback/b"), QOS: 0},
+				{Name: id("suback/c"), QOS: 1},
+			}})
+			suback, _ := mqtttest.ReadPacket(t, c).(mqtt.SubAckPacket)
+			if suback.ID != 10 || fmt.Sprint(suback.ReturnCodes) != "[2 0 1]" {
+				t.Errorf("incorrect SUBACK (%s) = id=10 return_codes=[2 0 1]", suback)
+			}
+		}},
+		{[]string{"MQTT-3.10.4-4", "MQTT-2.3.1-7"}, "UNSUBACK", func(t *testing.T) {
+			c := b.connect(t, connectPacket(id("unsuback"), true), mqtt.ConnAccepted)
+			defer disconnect(t, c)
+			mqtttest.WritePacket(t, c, mqtt.UnsubscribePacket{ID: 11, Topics: []string{id("unsuback")}})
+			if p := mqtttest.ReadPacket(t, c); p != (mqtt.UnsubAckPacket{ID: 11}) {
+				t.Errorf("incorrect UNSUBACK: %s", p)
+			}
+		}},
+		{[]string{"MQTT-3.12.4-1"}, "PINGRESP", func(t *testing.T) {
+			c := b.connect(t, connectPacket(id("ping"), true), mqtt.ConnAccepted)
+			defer disconnect(t, c)
+			mqtttest.WritePacket(t, c, mqtt.PingReqPacket{})
+			if p := mqtttest.ReadPacket(t, c); p.Type() != mqtt.PacketPingResp {
+				t.Errorf("incorrect response to PINGREQ: %s", p)
+			}
+		}},
+		{[]string{"MQTT-4.3.2-2", "MQTT-2.3.1-6"}, "QOS 1 PUBLISH is acknowledged", func(t *testing.T) {
+			c := b.connect(t, connectPacket(id("qos1"), true), mqtt.ConnAccepted)
+			defer disconnect(t, c)
+			mqtttest.WritePacket(t, c, mqtt.PublishPacket{ID: 12, Qos: 1, Topic: id("qos1")})
+			if p := mqtttest.ReadPacket(t, c); p != (mqtt.PubAckPacket{ID: 12}) {
+				t.Errorf("incorrect response to QOS 1 PUBLISH: %s", p)
+			}
+		}},
+		{[]string{"MQTT-4.3.3-2", "MQTT-2.3.1-6"}, "QOS 2 PUBLISH is acknowledged", func(t *testing.T) {
+			c := b.connect(t, connectPacket(id("qos2"), true), mqtt.ConnAccepted)
+			defer disconnect(t, c)
+			mqtttest.WritePacket(t, c, mqtt.PublishPacket{ID: 13, Qos: 2, Topic: id("qos2")})
+			if p := mqtttest.ReadPacket(t, c); p != (mqtt.PubRecPacket{ID: 13}) {
+				t.Errorf("incorrect response to QOS 2 PUBLISH: %s", p)
+			}
+			mqtttest.WritePacket(t, c, mqtt.PubRelPacket{ID: 13})
+			if p := mqtttest.ReadPacket(t, c); p != (mqtt.PubCompPacket{ID: 13}) {
+				t.Errorf("incorrect response to PUBREL: %s", p)
+			}
+		}},
+		{[]string{"MQTT-3.3.2-2"}, "PUBLISH with wildcard closes connection", func(t *testing.T) {
+			c := b.connect(t, connectPacket(id("wildcard"), true), mqtt.ConnAccepted)
+			defer c.Close()
+			// Packet is written at once: The broker may close the connection
+			// before a separate payload write.
+			mqtttest.WritePacket(t, c, rawPacket(mqtt.PublishPacket{Topic: id("wildcard") + "/+"}.Marshall()))
+			mqtttest.ExpectClosed(t, c)
+		}},
+		{[]string{"MQTT-3.3.1-5", "MQTT-3.3.1-6", "MQTT-3.3.1-8", "MQTT-3.3.1-9", "MQTT-3.3.1-10"}, "retained messages", func(t *testing.T) {
+			name := id("retained")
+			pub := b.connect(t, connectPacket(id("retained-pub"), true), mqtt.ConnAccepted)
+			defer disconnect(t, pub)
+			mqtttest.WritePacket(t, pub, mqtt.PublishPacket{ID: 1, Qos: 1, Retain: true, Topic: name, Payload: []byte("1")})
+			mqtttest.ReadPacket(t, pub)
+
+			// Retained message is sent to new subscriptions, with the retain
+			// flag.
+			sub := b.connect(t, connectPacket(id("retained-sub"), true), mqtt.ConnAccepted)
+			defer disconnect(t, sub)
+			mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: name}}})
+			if suback := mqtttest.ReadPacket(t, sub); suback.Type() != mqtt.PacketSubAck {
+				t.Fatalf("incorrect response to SUBSCRIBE: %s", suback)
+			}
+			expectPublish(t, sub, name, "1", true)
+
+			// Established subscriptions receive messages without retain flag.
+			mqtttest.WritePacket(t, pub, mqtt.PublishPacket{ID: 2, Qos: 1, Retain: true, Topic: name})
+			mqtttest.ReadPacket(t, pub)
+			expectPublish(t, sub, name, "", false)
+
+			// Empty message removed the retained message.
+			late := b.connect(t, connectPacket(id("retained-late"), true), mqtt.ConnAccepted)
+			defer disconnect(t, late)
+			mqtttest.WritePacket(t, late, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: name}}})
+			if suback := mqtttest.ReadPacket(t, late); suback.Type() != mqtt.PacketSubAck {
+				t.Fatalf("incorrect response to SUBSCRIBE: %s", suback)
+			}
+			expectNothing(t, late)
+		}},
+		{[]string{"MQTT-3.1.2-8", "MQTT-3.1.2-10", "MQTT-3.14.4-3"}, "will message", func(t *testing.T) {
+			name := id("will")
+			sub := b.connect(t, connectPacket(id("will-sub"), true), mqtt.ConnAccepted)
+			defer disconnect(t, sub)
+			mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: name}}})
+			mqtttest.ReadPacket(t, sub)
+
+			connect := connectPacket(id("will"), true)
+			connect.SetWill(name, []byte("gone"), 0)
+			// Will is discarded on DISCONNECT.
+			disconnect(t, b.connect(t, connect, mqtt.ConnAccepted))
+			expectNothing(t, sub)
+			// Will is published when the network connection is closed.
+			c := b.connect(t, connect, mqtt.ConnAccepted)
+			c.Close()
+			expectPublish(t, sub, name, "gone", false)
+		}},
+		{[]string{"2.2.3"}, "large PUBLISH is routed", func(t *testing.T) {
+			name := id("large")
+			sub := b.connect(t, connectPacket(id("large-sub"), true), mqtt.ConnAccepted)
+			defer disconnect(t, sub)
+			mqtttest.WritePacket(t, sub, mqtt.SubscribePacket{ID: 1, Topics: []mqtt.Topic{{Name: name}}})
+			mqtttest.ReadPacket(t, sub)
+
+			pub := b.connect(t, connectPacket(id("large-pub"), true), mqtt.ConnAccepted)
+			defer disconnect(t, pub)
+			payload := strings.Repeat("x", 1<<20)
+			go mqtttest.WritePacket(t, pub, mqtt.PublishPacket{Topic: name, Payload: []byte(payload)})
+			expectPublish(t, sub, name, payload, false)
+		}},
+	}
+
+	for _, v := range malformedPackets {
+		v := v
+		cases = append(cases, conformanceCase{[]string{v.statement, "MQTT-4.8.0-1"}, "close on " + v.name, func(t *testing.T) {
+			c := b.connect(t, connectPacket(id("malformed"), true), mqtt.ConnAccepted)
+			defer c.Close()
+			mqtttest.WritePacket(t, c, rawPacket(v.packet))
+			mqtttest.ExpectClosed(t, c)
+		}})
+	}
+	for _, v := range malformedConnects {
+		v := v
+		cases = append(cases, conformanceCase{[]string{v.statement, "MQTT-3.1.4-1"}, "close on CONNECT with " + v.name, func(t *testing.T) {
+			c := b.dial(t)
+			defer c.Close()
+			mqtttest.WritePacket(t, c, rawPacket(v.packet))
+			mqtttest.ExpectClosed(t, c)
+		}})
+	}
+	return cases
+}
+
+// brokerUnderTest connects to the broker checked by conformance tests.
+type brokerUnderTest struct {
+	address string
+	server  *broker.Server
+}
+
+// newBrokerUnderTest returns the broker at MQTT_CONFORMANCE_BROKER address,
+// or an in-process broker.
+func newBrokerUnderTest() *brokerUnderTest {
+	if address := os.Getenv("MQTT_CONFORMANCE_BROKER"); address != "" {
+		return &brokerUnderTest{address: strings.TrimPrefix(address, "tcp://")}
+	}
+	return &brokerUnderTest{server: &broker.Server{SysInterval: -1}}
+}
+
+func (b *brokerUnderTest) close() {
+	if b.server != nil {
+		b.server.Close()
+	}
+}
+
+func (b *brokerUnderTest) dial(t *testing.T) net.Conn {
+	t.Helper()
+	if b.server == nil {
+		c, err := net.DialTimeout("tcp", b.address, time.Second)
+		if err != nil {
+			t.Fatalf("cannot connect to broker: %s", err)
+		}
+		return c
+	}
+	client, server := net.Pipe()
+	go b.server.ServeConn(server)
+	return client
+}
+
+// connect opens a connection, sends connect and checks the CONNACK return
+// code.
+func (b *brokerUnderTest) connect(t *testing.T, connect mqtt.Packet, code int) net.Conn {
+	t.Helper()
+	c := b.dial(t)
+	mqtttest.WritePacket(t, c, connect)
+	p := mqtttest.ReadPacket(t, c)
+	if connack, ok := p.(mqtt.ConnAckPacket); !ok || connack.ReturnCode != code || (code != mqtt.ConnAccepted && connack.SessionPresent) {
+		c.Close()
+		t.Fatalf("incorrect response to CONNECT (%s) = return_code=%d", p, code)
+	}
+	return c
+}
+
+func connectPacket(clientID string, clean bool) mqtt.ConnectPacket {
+	return mqtt.ConnectPacket{
+		ProtocolName:  mqtt.ProtocolName,
+		ProtocolLevel: mqtt.ProtocolLevel,
+		ClientID:      clientID,
+		CleanSession:  clean,
+	}
+}
+
+// emptyIDConnect returns a CONNECT packet with an empty client ID, which
+// ConnectPacket replaces with the default client ID.
+func emptyIDConnect(clean bool) []byte {
+	var flags byte
+	if clean {
+		flags = 2
+	}
+	return []byte{0x10, 12, 0, 4, 'M', 'Q', 'T', 'T', 4, flags, 0, 0, 0, 0}
+}
+
+func disconnect(t *testing.T, c net.Conn) {
+	t.Helper()
+	mqtttest.WritePacket(t, c, mqtt.DisconnectPacket{})
+	mqtttest.ExpectClosed(t, c)
+	c.Close()
+}
+
+func expectPublish(t *testing.T, c net.Conn, topic, payload string, retain bool) {
+	t.Helper()
+	p := mqtttest.ReadPacket(t, c)
+	publish, ok := p.(mqtt.PublishPacket)
+	if !ok || publish.Topic != topic || string(publish.Payload) != payload || publish.Retain != retain {
+		t.Errorf("incorrect PUBLISH (%s) = topic=%q payload=%dB retain=%t", p, topic, len(payload), retain)
+	}
+}
+
+// expectNothing checks that the broker does not send anything on c.
+func expectNothing(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if p, err := mqtt.PacketRead(c); err == nil {
+		t.Errorf("unexpected %s", p)
+	}
+}
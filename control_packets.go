@@ -2,6 +2,8 @@ package mqtt // import "gosrc.io/mqtt"
 
 import (
 	"encoding/binary"
+	"fmt"
+	"io"
 )
 
 // ============================================================================
@@ -19,7 +21,7 @@ type ConnectPacket struct {
 	// TODO: Should 'Will' be a sub-struct ?
 	WillFlag    bool
 	WillTopic   string
-	WillMessage string
+	WillMessage []byte
 	WillQOS     int
 	WillRetain  bool
 	Username    string
@@ -28,7 +30,7 @@ type ConnectPacket struct {
 
 // SetWill defines all the will values connect control packet at once,
 // for consistency.
-func (connect *ConnectPacket) SetWill(topic string, message string, qos int) {
+func (connect *ConnectPacket) SetWill(topic string, message []byte, qos int) {
 	connect.WillFlag = true
 	connect.WillQOS = qos
 	connect.WillTopic = topic
@@ -37,41 +39,67 @@ func (connect *ConnectPacket) SetWill(topic string, message string, qos int) {
 
 // PayloadSize calculates variable length part of CONNECT MQTT packets.
 func (connect ConnectPacket) PayloadSize() int {
-	length := 10 // This is the base length for variable part, without optional fields
+	// Protocol name, followed by protocol level, connect flags and keepalive
+	length := stringSize(defaultValue(connect.ProtocolName, ProtocolName)) + 4
 
-	// TODO This is just formal / cosmetic, but it would be nice to support any protocol names
-	length += stringSize(connect.ClientID)
-	if connect.WillFlag {
+	length += stringSize(defaultValue(connect.ClientID, DefaultClientID))
+	if connect.hasWill() {
 		length += stringSize(connect.WillTopic)
-		length += stringSize(connect.WillMessage)
+		length += bytesSize(connect.WillMessage)
 	}
 	if len(connect.Username) > 0 {
 		length += stringSize(connect.Username)
-		length += stringSize(connect.Password)
+		if len(connect.Password) > 0 {
+			length += stringSize(connect.Password)
+		}
 	}
 	return length
 }
 
 // Marshall serializes a CONNECT struct as an MQTT control packet.
 func (connect ConnectPacket) Marshall() []byte {
-	headerSize := 2
-	buf := make([]byte, headerSize+connect.PayloadSize())
+	return marshall(connect)
+}
+
+// WriteTo writes a CONNECT struct as an MQTT control packet to w.
+func (connect ConnectPacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, connect)
+}
+
+// Type returns CONNECT packet type.
+func (ConnectPacket) Type() PacketType {
+	return PacketConnect
+}
 
+// String returns a printable form of the CONNECT packet. Password is
+// never printed.
+func (connect ConnectPacket) String() string {
+	str := fmt.Sprintf("CONNECT client_id=%q protocol=%s/%d keepalive=%d clean_session=%t",
+		connect.ClientID, defaultValue(connect.ProtocolName, ProtocolName), encodeProtocolLevel(connect.ProtocolLevel),
+		connect.Keepalive, connect.CleanSession)
+	if connect.hasWill() {
+		str += fmt.Sprintf(" will_topic=%q will_qos=%d will_retain=%t", connect.WillTopic, connect.WillQOS, connect.WillRetain)
+	}
+	if len(connect.Username) > 0 {
+		str += fmt.Sprintf(" username=%q", connect.Username)
+	}
+	return str
+}
+
+func (connect ConnectPacket) encode(buf []byte) {
 	// Fixed headers
-	buf[0] = connectType << 4
-	buf[1] = byte(connect.PayloadSize())
+	nextPos := putFixedHeader(buf, connectType<<4, connect.PayloadSize())
 
 	// Variable headers
-	copy(buf[2:8], encodeProtocolName(connect.ProtocolName))
-	buf[8] = encodeProtocolLevel(connect.ProtocolLevel)
-	buf[9] = byte(connect.connectFlag())
-	binary.BigEndian.PutUint16(buf[10:12], uint16(connect.Keepalive))
-	nextPos := 12 + stringSize(connect.ClientID) // TODO Does not work for custom protocol name as position could be different
-	copy(buf[12:nextPos], encodeClientID(connect.ClientID))
-
-	if connect.WillFlag && len(connect.WillTopic) > 0 {
+	nextPos = copyBufferString(buf, nextPos, defaultValue(connect.ProtocolName, ProtocolName))
+	buf[nextPos] = encodeProtocolLevel(connect.ProtocolLevel)
+	buf[nextPos+1] = byte(connect.connectFlag())
+	binary.BigEndian.PutUint16(buf[nextPos+2:nextPos+4], uint16(connect.Keepalive))
+	nextPos = copyBufferString(buf, nextPos+4, defaultValue(connect.ClientID, DefaultClientID))
+
+	if connect.hasWill() {
 		nextPos = copyBufferString(buf, nextPos, connect.WillTopic)
-		nextPos = copyBufferString(buf, nextPos, connect.WillMessage)
+		nextPos = copyBufferBytes(buf, nextPos, connect.WillMessage)
 	}
 
 	if len(connect.Username) > 0 {
@@ -80,13 +108,16 @@ func (connect ConnectPacket) Marshall() []byte {
 			copyBufferString(buf, nextPos, connect.Password)
 		}
 	}
+}
 
-	return buf
+// hasWill reports whether the will is sent. It is only sent if there is
+// actually a topic set.
+func (connect ConnectPacket) hasWill() bool {
+	return connect.WillFlag && len(connect.WillTopic) > 0
 }
 
 func (connect ConnectPacket) connectFlag() int {
-	// Only set willFlag if there is actually a topic set.
-	willFlag := connect.WillFlag && len(connect.WillTopic) >= 0
+	willFlag := connect.hasWill()
 
 	willQOS := 0
 	willRetain := false
@@ -109,16 +140,6 @@ func (connect ConnectPacket) connectFlag() int {
 		bool2int(willFlag)<<2 | bool2int(connect.CleanSession)<<1
 }
 
-func encodeClientID(clientID string) []byte {
-	id := defaultValue(clientID, DefaultClientID)
-	return encodeString(id)
-}
-
-func encodeProtocolName(name string) []byte {
-	n := defaultValue(name, ProtocolName)
-	return encodeString(n)
-}
-
 func defaultValue(val string, defaultVal string) string {
 	if val == "" {
 		return defaultVal
@@ -139,14 +160,31 @@ type connectDecoder struct{}
 
 var connectPacket connectDecoder
 
-func (connectDecoder) decode(payload []byte) ConnectPacket {
+func (connectDecoder) decode(payload []byte) (ConnectPacket, error) {
 	var connect ConnectPacket
 	var rest []byte
+	var err error
 
-	connect.ProtocolName, rest = extractNextString(payload)
+	if connect.ProtocolName, rest, err = extractNextString(payload); err != nil {
+		return connect, err
+	}
+	if len(rest) < 4 {
+		return connect, ErrMalformedPacket
+	}
 	connect.ProtocolLevel = int(rest[0])
 
 	flag := rest[1]
+	// Reserved flag must be zero [MQTT-3.1.2-3]. Without will, will QOS and
+	// retain must be zero [MQTT-3.1.2-11] [MQTT-3.1.2-13] [MQTT-3.1.2-15],
+	// will QOS cannot be 3 [MQTT-3.1.2-14] and without user name, there is
+	// no password [MQTT-3.1.2-22].
+	switch {
+	case flag&1 != 0,
+		flag&4 == 0 && flag&56 != 0,
+		flag&24 == 24,
+		flag&64 == 0 && flag&128 != 0:
+		return connect, ErrMalformedPacket
+	}
 	connect.CleanSession = int2bool(int((flag & 2) >> 1))
 	if connect.WillFlag = int2bool(int((flag & 4) >> 2)); connect.WillFlag {
 		connect.WillQOS = int((flag & 24) >> 3)
@@ -157,21 +195,37 @@ func (connectDecoder) decode(payload []byte) ConnectPacket {
 
 	connect.Keepalive = int(binary.BigEndian.Uint16(rest[2:4]))
 	payload = rest[4:]
-	connect.ClientID, payload = extractNextString(payload)
+	if connect.ClientID, payload, err = extractNextString(payload); err != nil {
+		return connect, err
+	}
 
 	if connect.WillFlag {
-		connect.WillTopic, payload = extractNextString(payload)
-		connect.WillMessage, payload = extractNextString(payload)
+		if connect.WillTopic, payload, err = extractNextString(payload); err != nil {
+			return connect, err
+		}
+		var message []byte
+		if message, payload, err = extractNextBytes(payload); err != nil {
+			return connect, err
+		}
+		// Will message must not reference the read buffer.
+		connect.WillMessage = append([]byte{}, message...)
 	}
 
 	if usernameFlag {
-		connect.Username, payload = extractNextString(payload)
+		if connect.Username, payload, err = extractNextString(payload); err != nil {
+			return connect, err
+		}
 	}
 	if passwordFlag {
-		connect.Password, _ = extractNextString(payload)
+		// Password is binary data, not a UTF-8 string.
+		var password []byte
+		if password, _, err = extractNextBytes(payload); err != nil {
+			return connect, err
+		}
+		connect.Password = string(password)
 	}
 
-	return connect
+	return connect, nil
 }
 
 // ============================================================================
@@ -191,16 +245,29 @@ func (connack ConnAckPacket) PayloadSize() int {
 
 // Marshall serializes a CONNACK struct as an MQTT control packet.
 func (connack ConnAckPacket) Marshall() []byte {
-	fixedLength := 2
-	buf := make([]byte, connack.PayloadSize()+fixedLength)
+	return marshall(connack)
+}
+
+// WriteTo writes a CONNACK struct as an MQTT control packet to w.
+func (connack ConnAckPacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, connack)
+}
 
-	buf[0] = connackType << 4
-	buf[1] = byte(connack.PayloadSize())
-	// TODO support Session Present flag:
-	buf[2] = 0 // reserved
-	buf[3] = byte(connack.ReturnCode)
+// Type returns CONNACK packet type.
+func (ConnAckPacket) Type() PacketType {
+	return PacketConnAck
+}
+
+// String returns a printable form of the CONNACK packet.
+func (connack ConnAckPacket) String() string {
+	return fmt.Sprintf("CONNACK session_present=%t return_code=%d", connack.SessionPresent, connack.ReturnCode)
+}
 
-	return buf
+func (connack ConnAckPacket) encode(buf []byte) {
+	nextPos := putFixedHeader(buf, connackType<<4, connack.PayloadSize())
+	// Connect acknowledge flags: Only bit 0, session present, is used.
+	buf[nextPos] = byte(bool2int(connack.SessionPresent))
+	buf[nextPos+1] = byte(connack.ReturnCode)
 }
 
 // ============================================================================
@@ -209,10 +276,14 @@ type connAckDecoder struct{}
 
 var connAckPacket connAckDecoder
 
-func (connAckDecoder) decode(payload []byte) ConnAckPacket {
-	return ConnAckPacket{
-		ReturnCode: int(payload[1]),
+func (connAckDecoder) decode(payload []byte) (ConnAckPacket, error) {
+	if len(payload) < 2 {
+		return ConnAckPacket{}, ErrMalformedPacket
 	}
+	return ConnAckPacket{
+		SessionPresent: int2bool(int(payload[0] & 1)),
+		ReturnCode:     int(payload[1]),
+	}, nil
 }
 
 // ============================================================================
@@ -223,14 +294,32 @@ func (connAckDecoder) decode(payload []byte) ConnAckPacket {
 // disconnection from server.
 type DisconnectPacket struct{}
 
+func (DisconnectPacket) PayloadSize() int {
+	return 0
+}
+
 // Marshall serializes a DISCONNECT struct as an MQTT control packet.
-func (DisconnectPacket) Marshall() []byte {
-	fixedLength := 2
-	buf := make([]byte, fixedLength)
+func (disconnect DisconnectPacket) Marshall() []byte {
+	return marshall(disconnect)
+}
 
-	buf[0] = disconnectType << 4
-	buf[1] = 0
-	return buf
+// WriteTo writes a DISCONNECT struct as an MQTT control packet to w.
+func (disconnect DisconnectPacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, disconnect)
+}
+
+// Type returns DISCONNECT packet type.
+func (DisconnectPacket) Type() PacketType {
+	return PacketDisconnect
+}
+
+// String returns a printable form of the DISCONNECT packet.
+func (DisconnectPacket) String() string {
+	return "DISCONNECT"
+}
+
+func (DisconnectPacket) encode(buf []byte) {
+	putFixedHeader(buf, disconnectType<<4, 0)
 }
 
 //==============================================================================
@@ -239,9 +328,9 @@ type disconnectDecoder struct{}
 
 var disconnectPacket disconnectDecoder
 
-func (disconnectDecoder) decode(payload []byte) DisconnectPacket {
+func (disconnectDecoder) decode(payload []byte) (DisconnectPacket, error) {
 	var disconnect DisconnectPacket
-	return disconnect
+	return disconnect, nil
 }
 
 // ============================================================================
@@ -272,15 +361,57 @@ func (publish PublishPacket) PayloadSize() int {
 
 // Marshall serializes a PUBLISH struct as an MQTT control packet.
 func (publish PublishPacket) Marshall() []byte {
-	headerSize := 2
-	buf := make([]byte, headerSize+publish.PayloadSize())
+	return marshall(publish)
+}
 
+// WriteTo writes a PUBLISH struct as an MQTT control packet to w. The
+// payload is written as is after the headers, so it is never copied: Other
+// writers of w must not write between the two.
+func (publish PublishPacket) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, publish.headerSize())
+	publish.encodeHeader(buf)
+	n, err := w.Write(buf)
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(publish.Payload)
+	return int64(n + m), err
+}
+
+// Type returns PUBLISH packet type.
+func (PublishPacket) Type() PacketType {
+	return PacketPublish
+}
+
+// String returns a printable form of the PUBLISH packet. Only payload size
+// is printed.
+func (publish PublishPacket) String() string {
+	return fmt.Sprintf("PUBLISH id=%d qos=%d dup=%t retain=%t topic=%q payload=%dB",
+		publish.ID, publish.Qos, publish.Dup, publish.Retain, publish.Topic, len(publish.Payload))
+}
+
+func (publish PublishPacket) encode(buf []byte) {
+	nextPos := publish.encodeHeader(buf)
+
+	// Published message payload
+	copy(buf[nextPos:], publish.Payload)
+}
+
+// headerSize returns the size of the PUBLISH packet without its payload.
+func (publish PublishPacket) headerSize() int {
+	length := publish.PayloadSize()
+	return fixedHeaderSize(length) + length - len(publish.Payload)
+}
+
+// encodeHeader writes fixed header, topic and packet ID to buf. It returns
+// the position of the payload.
+func (publish PublishPacket) encodeHeader(buf []byte) int {
 	// Header
-	buf[0] = byte(publishType<<4 | bool2int(publish.Dup)<<3 | publish.Qos<<1 | bool2int(publish.Retain))
-	buf[1] = byte(publish.PayloadSize())
+	firstByte := byte(publishType<<4 | bool2int(publish.Dup)<<3 | publish.Qos<<1 | bool2int(publish.Retain))
+	nextPos := putFixedHeader(buf, firstByte, publish.PayloadSize())
 
 	// Topic
-	nextPos := copyBufferString(buf, 2, publish.Topic)
+	nextPos = copyBufferString(buf, nextPos, publish.Topic)
 
 	// Packet ID
 	if publish.Qos == 1 || publish.Qos == 2 {
@@ -292,12 +423,13 @@ func (publish PublishPacket) Marshall() []byte {
 		binary.BigEndian.PutUint16(buf[nextPos:nextPos+2], uint16(id))
 		nextPos = nextPos + 2
 	}
+	return nextPos
+}
 
-	// Published message payload
-	payloadSize := len(publish.Payload)
-	copy(buf[nextPos:nextPos+payloadSize], publish.Payload)
-
-	return buf
+// PacketID returns the publish packet ID. It is zero for QOS 0 messages,
+// which are not acknowledged.
+func (publish PublishPacket) PacketID() int {
+	return publish.ID
 }
 
 //==============================================================================
@@ -306,26 +438,45 @@ type publishDecoder struct{}
 
 var publishPacket publishDecoder
 
-func (publishDecoder) decode(fixedHeaderFlags int, payload []byte) PublishPacket {
-	var publish PublishPacket
+func (d publishDecoder) decode(fixedHeaderFlags int, payload []byte) (PublishPacket, error) {
+	publish, topic, err := d.decodeRaw(fixedHeaderFlags, payload)
+	publish.Topic = string(topic)
+	return publish, err
+}
 
+// decodeRaw decodes a PUBLISH packet without allocating: The topic is
+// returned as a byte slice and the payload references the packet buffer.
+func (publishDecoder) decodeRaw(fixedHeaderFlags int, payload []byte) (publish PublishPacket, topic []byte, err error) {
 	publish.Dup = int2bool(fixedHeaderFlags >> 3)
 	publish.Qos = (fixedHeaderFlags & 6) >> 1
 	publish.Retain = int2bool(fixedHeaderFlags & 1)
+	// QOS 3 is malformed [MQTT-3.3.1-4].
+	if publish.Qos == 3 {
+		err = ErrMalformedPacket
+		return
+	}
 	var rest []byte
-	publish.Topic, rest = extractNextString(payload)
+	if topic, rest, err = extractNextBytes(payload); err != nil {
+		return
+	}
+	if !validString(topic) {
+		err = ErrMalformedPacket
+		return
+	}
 	var index int
-	if len(rest) > 0 {
-		if publish.Qos == 1 || publish.Qos == 2 {
-			offset := 2
-			publish.ID = int(binary.BigEndian.Uint16(rest[:offset]))
-			index = offset
-		}
-		if len(rest) > index {
-			publish.Payload = rest[index:]
+	if publish.Qos == 1 || publish.Qos == 2 {
+		offset := 2
+		if len(rest) < offset {
+			err = ErrMalformedPacket
+			return
 		}
+		publish.ID = int(binary.BigEndian.Uint16(rest[:offset]))
+		index = offset
+	}
+	if len(rest) > index {
+		publish.Payload = rest[index:]
 	}
-	return publish
+	return
 }
 
 // ============================================================================
@@ -344,17 +495,34 @@ func (puback PubAckPacket) PayloadSize() int {
 
 // Marshall serializes a PUBACK struct as an MQTT control packet.
 func (puback PubAckPacket) Marshall() []byte {
-	fixedLength := 2
-	buf := make([]byte, fixedLength+puback.PayloadSize())
+	return marshall(puback)
+}
+
+// WriteTo writes a PUBACK struct as an MQTT control packet to w.
+func (puback PubAckPacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, puback)
+}
+
+// Type returns PUBACK packet type.
+func (PubAckPacket) Type() PacketType {
+	return PacketPubAck
+}
+
+// String returns a printable form of the PUBACK packet.
+func (puback PubAckPacket) String() string {
+	return fmt.Sprintf("PUBACK id=%d", puback.ID)
+}
 
+func (puback PubAckPacket) encode(buf []byte) {
 	// Header
-	buf[0] = pubackType << 4
-	buf[1] = byte(puback.PayloadSize())
+	nextPos := putFixedHeader(buf, pubackType<<4, puback.PayloadSize())
 
 	// Packet ID
-	binary.BigEndian.PutUint16(buf[2:4], uint16(puback.ID))
+	binary.BigEndian.PutUint16(buf[nextPos:nextPos+2], uint16(puback.ID))
+}
 
-	return buf
+func (puback PubAckPacket) ResponseID() int {
+	return puback.ID
 }
 
 //==============================================================================
@@ -363,10 +531,199 @@ type pubAckDecoder struct{}
 
 var pubAckPacket pubAckDecoder
 
-func (pubAckDecoder) decode(payload []byte) PubAckPacket {
+func (pubAckDecoder) decode(payload []byte) (PubAckPacket, error) {
+	if len(payload) < 2 {
+		return PubAckPacket{}, ErrMalformedPacket
+	}
 	return PubAckPacket{
 		ID: int(binary.BigEndian.Uint16(payload[:2])),
+	}, nil
+}
+
+// ============================================================================
+// PUBREC
+// ============================================================================
+
+// PubRecPacket is the control packet sent by the receiver of a QOS 2 PUBLISH
+// packet. It is the first step of QOS 2 protocol exchange.
+type PubRecPacket struct {
+	ID int
+}
+
+func (pubrec PubRecPacket) PayloadSize() int {
+	return 2
+}
+
+// Marshall serializes a PUBREC struct as an MQTT control packet.
+func (pubrec PubRecPacket) Marshall() []byte {
+	return marshall(pubrec)
+}
+
+// WriteTo writes a PUBREC struct as an MQTT control packet to w.
+func (pubrec PubRecPacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, pubrec)
+}
+
+// Type returns PUBREC packet type.
+func (PubRecPacket) Type() PacketType {
+	return PacketPubRec
+}
+
+// String returns a printable form of the PUBREC packet.
+func (pubrec PubRecPacket) String() string {
+	return fmt.Sprintf("PUBREC id=%d", pubrec.ID)
+}
+
+func (pubrec PubRecPacket) encode(buf []byte) {
+	// Header
+	nextPos := putFixedHeader(buf, pubrecType<<4, pubrec.PayloadSize())
+
+	// Packet ID
+	binary.BigEndian.PutUint16(buf[nextPos:nextPos+2], uint16(pubrec.ID))
+}
+
+func (pubrec PubRecPacket) ResponseID() int {
+	return pubrec.ID
+}
+
+//==============================================================================
+
+type pubRecDecoder struct{}
+
+var pubRecPacket pubRecDecoder
+
+func (pubRecDecoder) decode(payload []byte) (PubRecPacket, error) {
+	if len(payload) < 2 {
+		return PubRecPacket{}, ErrMalformedPacket
 	}
+	return PubRecPacket{
+		ID: int(binary.BigEndian.Uint16(payload[:2])),
+	}, nil
+}
+
+// ============================================================================
+// PUBREL
+// ============================================================================
+
+// PubRelPacket is the control packet sent by the sender of a QOS 2 PUBLISH
+// packet as response to PUBREC. It is the second step of QOS 2 protocol
+// exchange.
+type PubRelPacket struct {
+	ID int
+}
+
+func (pubrel PubRelPacket) PayloadSize() int {
+	return 2
+}
+
+// Marshall serializes a PUBREL struct as an MQTT control packet.
+func (pubrel PubRelPacket) Marshall() []byte {
+	return marshall(pubrel)
+}
+
+// WriteTo writes a PUBREL struct as an MQTT control packet to w.
+func (pubrel PubRelPacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, pubrel)
+}
+
+// Type returns PUBREL packet type.
+func (PubRelPacket) Type() PacketType {
+	return PacketPubRel
+}
+
+// String returns a printable form of the PUBREL packet.
+func (pubrel PubRelPacket) String() string {
+	return fmt.Sprintf("PUBREL id=%d", pubrel.ID)
+}
+
+func (pubrel PubRelPacket) encode(buf []byte) {
+	// Header
+	fixedHeaderFlags := 2 // Mandatory value
+	nextPos := putFixedHeader(buf, byte(pubrelType<<4|fixedHeaderFlags), pubrel.PayloadSize())
+
+	// Packet ID
+	binary.BigEndian.PutUint16(buf[nextPos:nextPos+2], uint16(pubrel.ID))
+}
+
+func (pubrel PubRelPacket) PacketID() int {
+	return pubrel.ID
+}
+
+//==============================================================================
+
+type pubRelDecoder struct{}
+
+var pubRelPacket pubRelDecoder
+
+func (pubRelDecoder) decode(payload []byte) (PubRelPacket, error) {
+	if len(payload) < 2 {
+		return PubRelPacket{}, ErrMalformedPacket
+	}
+	return PubRelPacket{
+		ID: int(binary.BigEndian.Uint16(payload[:2])),
+	}, nil
+}
+
+// ============================================================================
+// PUBCOMP
+// ============================================================================
+
+// PubCompPacket is the control packet sent by the receiver of a QOS 2 PUBLISH
+// packet as response to PUBREL. It is the last step of QOS 2 protocol
+// exchange.
+type PubCompPacket struct {
+	ID int
+}
+
+func (pubcomp PubCompPacket) PayloadSize() int {
+	return 2
+}
+
+// Marshall serializes a PUBCOMP struct as an MQTT control packet.
+func (pubcomp PubCompPacket) Marshall() []byte {
+	return marshall(pubcomp)
+}
+
+// WriteTo writes a PUBCOMP struct as an MQTT control packet to w.
+func (pubcomp PubCompPacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, pubcomp)
+}
+
+// Type returns PUBCOMP packet type.
+func (PubCompPacket) Type() PacketType {
+	return PacketPubComp
+}
+
+// String returns a printable form of the PUBCOMP packet.
+func (pubcomp PubCompPacket) String() string {
+	return fmt.Sprintf("PUBCOMP id=%d", pubcomp.ID)
+}
+
+func (pubcomp PubCompPacket) encode(buf []byte) {
+	// Header
+	nextPos := putFixedHeader(buf, pubcompType<<4, pubcomp.PayloadSize())
+
+	// Packet ID
+	binary.BigEndian.PutUint16(buf[nextPos:nextPos+2], uint16(pubcomp.ID))
+}
+
+func (pubcomp PubCompPacket) ResponseID() int {
+	return pubcomp.ID
+}
+
+//==============================================================================
+
+type pubCompDecoder struct{}
+
+var pubCompPacket pubCompDecoder
+
+func (pubCompDecoder) decode(payload []byte) (PubCompPacket, error) {
+	if len(payload) < 2 {
+		return PubCompPacket{}, ErrMalformedPacket
+	}
+	return PubCompPacket{
+		ID: int(binary.BigEndian.Uint16(payload[:2])),
+	}, nil
 }
 
 // ============================================================================
@@ -396,30 +753,50 @@ func (subscribe SubscribePacket) PayloadSize() int {
 
 // Marshall serializes a SUBSCRIBE struct as an MQTT control packet.
 func (subscribe SubscribePacket) Marshall() []byte {
-	fixedLength := 2
-	buf := make([]byte, fixedLength+subscribe.PayloadSize())
+	return marshall(subscribe)
+}
+
+// WriteTo writes a SUBSCRIBE struct as an MQTT control packet to w.
+func (subscribe SubscribePacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, subscribe)
+}
+
+// Type returns SUBSCRIBE packet type.
+func (SubscribePacket) Type() PacketType {
+	return PacketSubscribe
+}
 
+// String returns a printable form of the SUBSCRIBE packet.
+func (subscribe SubscribePacket) String() string {
+	str := fmt.Sprintf("SUBSCRIBE id=%d topics=[", subscribe.ID)
+	for i, topic := range subscribe.Topics {
+		if i > 0 {
+			str += " "
+		}
+		str += fmt.Sprintf("%q:%d", topic.Name, topic.QOS)
+	}
+	return str + "]"
+}
+
+func (subscribe SubscribePacket) encode(buf []byte) {
 	// Header
 	fixedHeaderFlags := 2 // mandatory value
-	buf[0] = byte(subscribeType<<4 | fixedHeaderFlags)
-	buf[1] = byte(subscribe.PayloadSize())
+	nextPos := putFixedHeader(buf, byte(subscribeType<<4|fixedHeaderFlags), subscribe.PayloadSize())
 
 	// Packet ID (it must be non zero, so we use 1 if value is zero to generate a valid packet)
 	id := 1
 	if subscribe.ID > id {
 		id = subscribe.ID
 	}
-	binary.BigEndian.PutUint16(buf[2:4], uint16(id))
+	binary.BigEndian.PutUint16(buf[nextPos:nextPos+2], uint16(id))
 
 	// Topic filters
-	nextPos := 4
+	nextPos += 2
 	for _, topic := range subscribe.Topics {
 		nextPos = copyBufferString(buf, nextPos, topic.Name)
 		buf[nextPos] = byte(topic.QOS)
 		nextPos++
 	}
-
-	return buf
 }
 
 func (subscribe SubscribePacket) PacketID() int {
@@ -432,20 +809,34 @@ type subscribeDecoder struct{}
 
 var subscribePacket subscribeDecoder
 
-func (subscribeDecoder) decode(payload []byte) SubscribePacket {
+func (subscribeDecoder) decode(payload []byte) (SubscribePacket, error) {
 	subscribe := SubscribePacket{}
+	if len(payload) < 2 {
+		return subscribe, ErrMalformedPacket
+	}
 	subscribe.ID = int(binary.BigEndian.Uint16(payload[:2]))
 
 	for remaining := payload[2:]; len(remaining) > 0; {
 		topic := Topic{}
 		var rest []byte
-		topic.Name, rest = extractNextString(remaining)
+		var err error
+		if topic.Name, rest, err = extractNextString(remaining); err != nil {
+			return subscribe, err
+		}
+		// Reserved bits must be zero and QOS cannot be 3 [MQTT-3.8.3-4].
+		if len(rest) < 1 || rest[0] > 2 {
+			return subscribe, ErrMalformedPacket
+		}
 		topic.QOS = int(rest[0])
 		subscribe.Topics = append(subscribe.Topics, topic)
 		remaining = rest[1:]
 	}
+	// At least one subscription is required [MQTT-3.8.3-3].
+	if len(subscribe.Topics) == 0 {
+		return subscribe, ErrMalformedPacket
+	}
 
-	return subscribe
+	return subscribe, nil
 }
 
 // ============================================================================
@@ -467,24 +858,37 @@ func (suback SubAckPacket) PayloadSize() int {
 
 // Marshall serializes a SUBACK struct as an MQTT control packet.
 func (suback SubAckPacket) Marshall() []byte {
-	fixedLength := 2
-	buf := make([]byte, fixedLength+suback.PayloadSize())
+	return marshall(suback)
+}
+
+// WriteTo writes a SUBACK struct as an MQTT control packet to w.
+func (suback SubAckPacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, suback)
+}
+
+// Type returns SUBACK packet type.
+func (SubAckPacket) Type() PacketType {
+	return PacketSubAck
+}
+
+// String returns a printable form of the SUBACK packet.
+func (suback SubAckPacket) String() string {
+	return fmt.Sprintf("SUBACK id=%d return_codes=%v", suback.ID, suback.ReturnCodes)
+}
 
+func (suback SubAckPacket) encode(buf []byte) {
 	// Header
-	buf[0] = byte(subackType << 4)
-	buf[1] = byte(suback.PayloadSize())
+	nextPos := putFixedHeader(buf, byte(subackType<<4), suback.PayloadSize())
 
 	// Packet ID
-	binary.BigEndian.PutUint16(buf[2:4], uint16(suback.ID))
+	binary.BigEndian.PutUint16(buf[nextPos:nextPos+2], uint16(suback.ID))
 
 	// Return codes
-	nextPos := 4
+	nextPos += 2
 	for _, rc := range suback.ReturnCodes {
 		buf[nextPos] = byte(rc)
 		nextPos++
 	}
-
-	return buf
 }
 
 func (suback SubAckPacket) ResponseID() int {
@@ -501,16 +905,17 @@ var subAckPacket subAckDecoder
 // Client could read the current subscription state map to read the status of each subscription.
 // We should probably return error if a subscription is rejected or if
 // one of the QOS is lower than the level we asked for.
-func (subAckDecoder) decode(payload []byte) SubAckPacket {
+func (subAckDecoder) decode(payload []byte) (SubAckPacket, error) {
 	var suback SubAckPacket
 
+	if len(payload) < 2 {
+		return suback, ErrMalformedPacket
+	}
 	suback.ID = int(binary.BigEndian.Uint16(payload[:2]))
-	if len(payload) >= 2 {
-		for _, v := range payload[2:] {
-			suback.ReturnCodes = append(suback.ReturnCodes, int(v))
-		}
+	for _, v := range payload[2:] {
+		suback.ReturnCodes = append(suback.ReturnCodes, int(v))
 	}
-	return suback
+	return suback, nil
 }
 
 // ============================================================================
@@ -534,28 +939,41 @@ func (unsubscribe UnsubscribePacket) PayloadSize() int {
 
 // Marshall serializes a UNSUBSCRIBE struct as an MQTT control packet.
 func (unsubscribe UnsubscribePacket) Marshall() []byte {
-	fixedLength := 2
-	buf := make([]byte, fixedLength+unsubscribe.PayloadSize())
+	return marshall(unsubscribe)
+}
+
+// WriteTo writes a UNSUBSCRIBE struct as an MQTT control packet to w.
+func (unsubscribe UnsubscribePacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, unsubscribe)
+}
 
+// Type returns UNSUBSCRIBE packet type.
+func (UnsubscribePacket) Type() PacketType {
+	return PacketUnsubscribe
+}
+
+// String returns a printable form of the UNSUBSCRIBE packet.
+func (unsubscribe UnsubscribePacket) String() string {
+	return fmt.Sprintf("UNSUBSCRIBE id=%d topics=%q", unsubscribe.ID, unsubscribe.Topics)
+}
+
+func (unsubscribe UnsubscribePacket) encode(buf []byte) {
 	// Header
 	fixedHeaderFlags := 2 // mandatory value
-	buf[0] = byte(unsubscribeType<<4 | fixedHeaderFlags)
-	buf[1] = byte(unsubscribe.PayloadSize())
+	nextPos := putFixedHeader(buf, byte(unsubscribeType<<4|fixedHeaderFlags), unsubscribe.PayloadSize())
 
 	// Packet ID (it must be non zero, so we use 1 if value is zero to generate a valid packet)
 	id := 1
 	if unsubscribe.ID > id {
 		id = unsubscribe.ID
 	}
-	binary.BigEndian.PutUint16(buf[2:4], uint16(id))
+	binary.BigEndian.PutUint16(buf[nextPos:nextPos+2], uint16(id))
 
 	// Topics name
-	nextPos := 4
+	nextPos += 2
 	for _, topic := range unsubscribe.Topics {
 		nextPos = copyBufferString(buf, nextPos, topic)
 	}
-
-	return buf
 }
 
 func (unsubscribe UnsubscribePacket) PacketID() int {
@@ -568,17 +986,27 @@ type unsubscribeDecoder struct{}
 
 var unsubscribePacket unsubscribeDecoder
 
-func (unsubscribeDecoder) decode(payload []byte) UnsubscribePacket {
+func (unsubscribeDecoder) decode(payload []byte) (UnsubscribePacket, error) {
 	unsubscribe := UnsubscribePacket{}
+	if len(payload) < 2 {
+		return unsubscribe, ErrMalformedPacket
+	}
 	unsubscribe.ID = int(binary.BigEndian.Uint16(payload[:2]))
 
 	for remaining := payload[2:]; len(remaining) > 0; {
 		var topic string
-		topic, remaining = extractNextString(remaining)
+		var err error
+		if topic, remaining, err = extractNextString(remaining); err != nil {
+			return unsubscribe, err
+		}
 		unsubscribe.Topics = append(unsubscribe.Topics, topic)
 	}
+	// At least one topic filter is required [MQTT-3.10.3-2].
+	if len(unsubscribe.Topics) == 0 {
+		return unsubscribe, ErrMalformedPacket
+	}
 
-	return unsubscribe
+	return unsubscribe, nil
 }
 
 // ============================================================================
@@ -597,18 +1025,30 @@ func (unsub UnsubAckPacket) PayloadSize() int {
 
 // Marshall serializes a UNSUBACK struct as an MQTT control packet.
 func (unsub UnsubAckPacket) Marshall() []byte {
-	fixedLength := 2
-	buf := make([]byte, fixedLength+unsub.PayloadSize())
+	return marshall(unsub)
+}
+
+// WriteTo writes a UNSUBACK struct as an MQTT control packet to w.
+func (unsub UnsubAckPacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, unsub)
+}
+
+// Type returns UNSUBACK packet type.
+func (UnsubAckPacket) Type() PacketType {
+	return PacketUnsubAck
+}
+
+// String returns a printable form of the UNSUBACK packet.
+func (unsub UnsubAckPacket) String() string {
+	return fmt.Sprintf("UNSUBACK id=%d", unsub.ID)
+}
 
+func (unsub UnsubAckPacket) encode(buf []byte) {
 	// Header
-	fixedHeaderFlags := 2 // Mandatory value
-	buf[0] = byte(unsubackType<<4 | fixedHeaderFlags)
-	buf[1] = byte(unsub.PayloadSize())
+	nextPos := putFixedHeader(buf, byte(unsubackType<<4), unsub.PayloadSize())
 
 	// Packet ID
-	binary.BigEndian.PutUint16(buf[2:4], uint16(unsub.ID))
-
-	return buf
+	binary.BigEndian.PutUint16(buf[nextPos:nextPos+2], uint16(unsub.ID))
 }
 
 func (unsub UnsubAckPacket) ResponseID() int {
@@ -621,12 +1061,13 @@ type unsubAckDecoder struct{}
 
 var unsubAckPacket unsubAckDecoder
 
-func (unsubAckDecoder) decode(payload []byte) UnsubAckPacket {
+func (unsubAckDecoder) decode(payload []byte) (UnsubAckPacket, error) {
 	unsuback := UnsubAckPacket{}
-	if len(payload) >= 2 {
-		unsuback.ID = int(binary.BigEndian.Uint16(payload[:2]))
+	if len(payload) < 2 {
+		return unsuback, ErrMalformedPacket
 	}
-	return unsuback
+	unsuback.ID = int(binary.BigEndian.Uint16(payload[:2]))
+	return unsuback, nil
 }
 
 // ============================================================================
@@ -637,16 +1078,33 @@ func (unsubAckDecoder) decode(payload []byte) UnsubAckPacket {
 ////// keepalive. Client expects to receive a PingRespPacket
 type PingReqPacket struct{}
 
+func (PingReqPacket) PayloadSize() int {
+	return 0
+}
+
 // Marshall serializes a PINGREQ struct as an MQTT control packet.
 func (pingreq PingReqPacket) Marshall() []byte {
-	fixedLength := 2
-	buf := make([]byte, fixedLength)
+	return marshall(pingreq)
+}
 
-	// Header
-	buf[0] = byte(pingreqType << 4)
-	buf[1] = byte(0)
+// WriteTo writes a PINGREQ struct as an MQTT control packet to w.
+func (pingreq PingReqPacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, pingreq)
+}
 
-	return buf
+// Type returns PINGREQ packet type.
+func (PingReqPacket) Type() PacketType {
+	return PacketPingReq
+}
+
+// String returns a printable form of the PINGREQ packet.
+func (PingReqPacket) String() string {
+	return "PINGREQ"
+}
+
+func (PingReqPacket) encode(buf []byte) {
+	// Header
+	putFixedHeader(buf, byte(pingreqType<<4), 0)
 }
 
 //==============================================================================
@@ -655,9 +1113,9 @@ type pingReqDecoder struct{}
 
 var pingReqPacket pingReqDecoder
 
-func (pingReqDecoder) decode(payload []byte) PingReqPacket {
+func (pingReqDecoder) decode(payload []byte) (PingReqPacket, error) {
 	var ping PingReqPacket
-	return ping
+	return ping, nil
 }
 
 // ============================================================================
@@ -669,16 +1127,33 @@ func (pingReqDecoder) decode(payload []byte) PingReqPacket {
 type PingRespPacket struct {
 }
 
+func (PingRespPacket) PayloadSize() int {
+	return 0
+}
+
 // Marshall serializes a PINGRESP struct as an MQTT control packet.
 func (pdu PingRespPacket) Marshall() []byte {
-	fixedLength := 2
-	buf := make([]byte, fixedLength)
+	return marshall(pdu)
+}
 
-	// Header
-	buf[0] = byte(pingrespType << 4)
-	buf[1] = byte(0)
+// WriteTo writes a PINGRESP struct as an MQTT control packet to w.
+func (pdu PingRespPacket) WriteTo(w io.Writer) (int64, error) {
+	return writePacket(w, pdu)
+}
+
+// Type returns PINGRESP packet type.
+func (PingRespPacket) Type() PacketType {
+	return PacketPingResp
+}
 
-	return buf
+// String returns a printable form of the PINGRESP packet.
+func (PingRespPacket) String() string {
+	return "PINGRESP"
+}
+
+func (PingRespPacket) encode(buf []byte) {
+	// Header
+	putFixedHeader(buf, byte(pingrespType<<4), 0)
 }
 
 //==============================================================================
@@ -687,7 +1162,7 @@ type pingRespDecoder struct{}
 
 var pingRespPacket pingRespDecoder
 
-func (pingRespDecoder) decode(payload []byte) PingRespPacket {
+func (pingRespDecoder) decode(payload []byte) (PingRespPacket, error) {
 	var ping PingRespPacket
-	return ping
+	return ping, nil
 }
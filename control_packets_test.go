@@ -3,6 +3,7 @@ package mqtt // import "gosrc.io/mqtt"
 import (
 	"bytes"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -18,18 +19,23 @@ func TestIncrementalConnectFlag(t *testing.T) {
 	c.CleanSession = true
 	assertConnectFlagValue(t, "incorrect connect flag: cleanSession is not true (%d)", c.connectFlag(), 2)
 
-	c.SetWill("topic/a", "Disconnected", 0)
+	c.SetWill("topic/a", []byte("Disconnected"), 0)
 	assertConnectFlagValue(t, "incorrect connect flag: willFlag is not true (%d)", c.connectFlag(), 6)
 
-	c.SetWill("topic/a", "Disconnected", 1)
+	c.SetWill("topic/a", []byte("Disconnected"), 1)
 	assertConnectFlagValue(t, "incorrect connect flag: willQOS is not properly set (%d)", c.connectFlag(), 14)
 
-	c.SetWill("topic/a", "Disconnected", 2)
+	c.SetWill("topic/a", []byte("Disconnected"), 2)
 	assertConnectFlagValue(t, "incorrect connect flag: willQOS is not properly set (%d)", c.connectFlag(), 22)
 
 	c.WillRetain = true
 	assertConnectFlagValue(t, "incorrect connect flag: willRetain is not properly set (%d)", c.connectFlag(), 54)
 
+	c.WillTopic = ""
+	assertConnectFlagValue(t, "incorrect connect flag: willFlag must not be set without topic (%d)", c.connectFlag(), 2)
+
+	c.SetWill("topic/a", []byte("Disconnected"), 2)
+	c.WillRetain = true
 	c.Username = "User1"
 	assertConnectFlagValue(t, "incorrect connect flag: usernameFlag is not properly set (%d)", c.connectFlag(), 118)
 
@@ -46,7 +52,7 @@ func getConnect() ConnectPacket {
 	connect.Keepalive = 42
 	connect.ClientID = "TestClientID"
 	connect.WillTopic = "test/will"
-	connect.WillMessage = "test message"
+	connect.WillMessage = []byte("test message")
 	connect.Username = "testuser"
 	connect.Password = "testpass"
 	return connect
@@ -62,7 +68,7 @@ func TestConnectDecode(t *testing.T) {
 	} else {
 		switch p := packet.(type) {
 		case ConnectPacket:
-			if p != connect {
+			if !reflect.DeepEqual(p, connect) {
 				t.Errorf("unmarshalled connect does not match original (%+v) = %+v", p, connect)
 			}
 		default:
@@ -81,8 +87,74 @@ func BenchmarkConnectMarshall(b *testing.B) {
 	}
 }
 
+// BenchmarkPublishDecode measures the generic decoding path, which allocates
+// the decoded packet.
+func BenchmarkPublishDecode(b *testing.B) {
+	decoder := NewDecoder(&repeatReader{data: getPublish().Marshall()})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decoder.Decode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPublishReceive measures the client receive path, from the
+// connection to the delivered message.
+func BenchmarkPublishReceive(b *testing.B) {
+	benchmarkReceive(b, OptInbound{})
+}
+
+// BenchmarkPublishReceiveBorrowed measures the client receive path when
+// message payloads are borrowed from the pool.
+func BenchmarkPublishReceiveBorrowed(b *testing.B) {
+	benchmarkReceive(b, OptInbound{BorrowPayloads: true})
+}
+
+func benchmarkReceive(b *testing.B, opt OptInbound) {
+	messages := make(chan Message, 100)
+	done := make(chan struct{})
+	go func() {
+		for m := range messages {
+			m.Release()
+		}
+		close(done)
+	}()
+	r := newReceiver(&repeatReader{data: getPublish().Marshall()}, nil, newInbox(messages, OptInbound{}, nil), sender{}, opt, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.receive(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	close(messages)
+	<-done
+}
+
 // Helpers
 
+func getPublish() PublishPacket {
+	return PublishPacket{Topic: "sensors/living-room/temp", Payload: bytes.Repeat([]byte{'x'}, 256)}
+}
+
+// repeatReader endlessly reads the same data, to simulate a stream of
+// identical packets.
+type repeatReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+	return n, nil
+}
+
 func assertConnectFlagValue(t *testing.T, message string, flag int, expected int) {
 	if flag != expected {
 		t.Errorf(message, flag)
@@ -114,6 +186,20 @@ func TestConnAckEncodeDecode(t *testing.T) {
 	}
 }
 
+func TestConnAckSessionPresent(t *testing.T) {
+	buf := ConnAckPacket{SessionPresent: true}.Marshall()
+	if buf[2] != 1 {
+		t.Errorf("incorrect connect acknowledge flags (%d) = %d", buf[2], 1)
+	}
+	packet, err := PacketRead(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("cannot decode connack control packet: %s", err)
+	}
+	if p, ok := packet.(ConnAckPacket); !ok || !p.SessionPresent {
+		t.Errorf("incorrect session present flag: %s", packet)
+	}
+}
+
 // ============================================================================
 // DISCONNECT
 // ============================================================================
@@ -405,6 +491,10 @@ func TestUnsubAckEncodeDecode(t *testing.T) {
 	ua := &UnsubAckPacket{}
 	ua.ID = id
 	buf := ua.Marshall()
+	// Fixed header flags are reserved and must be 0 [MQTT-2.2.2-1].
+	if buf[0] != 0xB0 {
+		t.Errorf("incorrect fixed header (%#x) = 0xb0", buf[0])
+	}
 
 	reader := bytes.NewReader(buf)
 	if packet, err := PacketRead(reader); err != nil {
@@ -464,3 +554,58 @@ func TestPingResp(t *testing.T) {
 		}
 	}
 }
+
+// ============================================================================
+// Packet interface
+// ============================================================================
+
+func TestPacketType(t *testing.T) {
+	packets := map[PacketType]Packet{
+		PacketConnect:     ConnectPacket{},
+		PacketConnAck:     ConnAckPacket{},
+		PacketPublish:     PublishPacket{},
+		PacketPubAck:      PubAckPacket{},
+		PacketPubRec:      PubRecPacket{},
+		PacketPubRel:      PubRelPacket{},
+		PacketPubComp:     PubCompPacket{},
+		PacketSubscribe:   SubscribePacket{},
+		PacketSubAck:      SubAckPacket{},
+		PacketUnsubscribe: UnsubscribePacket{},
+		PacketUnsubAck:    UnsubAckPacket{},
+		PacketPingReq:     PingReqPacket{},
+		PacketPingResp:    PingRespPacket{},
+		PacketDisconnect:  DisconnectPacket{},
+	}
+
+	for packetType, p := range packets {
+		if p.Type() != packetType {
+			t.Errorf("incorrect packet type for %T (%s) = %s", p, p.Type(), packetType)
+		}
+		// Packet type is encoded in the first 4 bits of the fixed header.
+		if encoded := PacketType(p.Marshall()[0] >> 4); encoded != packetType {
+			t.Errorf("incorrect encoded packet type for %T (%s) = %s", p, encoded, packetType)
+		}
+	}
+}
+
+func TestPacketTypeString(t *testing.T) {
+	if s := PacketPubRel.String(); s != "PUBREL" {
+		t.Errorf("incorrect packet type name (%q) = %q", s, "PUBREL")
+	}
+	if s := PacketType(42).String(); s != "PacketType(42)" {
+		t.Errorf("incorrect unknown packet type name (%q) = %q", s, "PacketType(42)")
+	}
+}
+
+func TestPacketString(t *testing.T) {
+	publish := PublishPacket{ID: 12, Qos: 1, Topic: "test/1", Payload: []byte("Hi")}
+	expected := `PUBLISH id=12 qos=1 dup=false retain=false topic="test/1" payload=2B`
+	if s := publish.String(); s != expected {
+		t.Errorf("incorrect publish string (%s) = %s", s, expected)
+	}
+
+	connect := getConnect()
+	if s := connect.String(); strings.Contains(s, connect.Password) {
+		t.Errorf("connect string should not contain password: %s", s)
+	}
+}
@@ -7,5 +7,11 @@ struct.
 
 The messages are received on a message channel. The channel can be buffered. The main goal of the channel is to handle
 back pressure and make sure the client will not read message faster than it is able to process.
+By default, the client stops reading from the connection when the channel is full. OptInbound.Overflow can instead drop
+the newest or the oldest messages, or spill them to a bounded buffer. Dropped messages are counted and notified as
+StateMessageDropped events.
+
+Messages can also be dispatched to handlers, registered on the client ServeMux with a topic filter. Messages that do
+not match any handler are sent to the message channel.
 */
 package mqtt // import "gosrc.io/mqtt"
@@ -1,9 +1,12 @@
 package mqtt // import "gosrc.io/mqtt"
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
+	"strconv"
+	"unicode/utf8"
 )
 
 // MQTT Control Packet types
@@ -26,6 +29,55 @@ const (
 	reserved2Type
 )
 
+// PacketType identifies the kind of an MQTT control packet, as encoded in the
+// first four bits of the packet fixed header.
+type PacketType int
+
+// MQTT Control Packet types.
+const (
+	PacketConnect     PacketType = connectType
+	PacketConnAck     PacketType = connackType
+	PacketPublish     PacketType = publishType
+	PacketPubAck      PacketType = pubackType
+	PacketPubRec      PacketType = pubrecType
+	PacketPubRel      PacketType = pubrelType
+	PacketPubComp     PacketType = pubcompType
+	PacketSubscribe   PacketType = subscribeType
+	PacketSubAck      PacketType = subackType
+	PacketUnsubscribe PacketType = unsubscribeType
+	PacketUnsubAck    PacketType = unsubackType
+	PacketPingReq     PacketType = pingreqType
+	PacketPingResp    PacketType = pingrespType
+	PacketDisconnect  PacketType = disconnectType
+)
+
+var packetTypeNames = [...]string{
+	reserved1Type:   "RESERVED",
+	connectType:     "CONNECT",
+	connackType:     "CONNACK",
+	publishType:     "PUBLISH",
+	pubackType:      "PUBACK",
+	pubrecType:      "PUBREC",
+	pubrelType:      "PUBREL",
+	pubcompType:     "PUBCOMP",
+	subscribeType:   "SUBSCRIBE",
+	subackType:      "SUBACK",
+	unsubscribeType: "UNSUBSCRIBE",
+	unsubackType:    "UNSUBACK",
+	pingreqType:     "PINGREQ",
+	pingrespType:    "PINGRESP",
+	disconnectType:  "DISCONNECT",
+	reserved2Type:   "RESERVED",
+}
+
+// String returns the control packet name, as used in MQTT specification.
+func (t PacketType) String() string {
+	if t < 0 || int(t) >= len(packetTypeNames) {
+		return "PacketType(" + strconv.Itoa(int(t)) + ")"
+	}
+	return packetTypeNames[t]
+}
+
 // MQTT error codes returned on CONNECT.
 const (
 	ConnAccepted                     = 0x00
@@ -49,12 +101,16 @@ const (
 // Errors MQTT client can return.
 var (
 	ErrMalformedLength                  = errors.New("malformed mqtt packet remaining length")
+	ErrMalformedPacket                  = errors.New("malformed mqtt control packet")
+	ErrPacketTooLarge                   = errors.New("mqtt control packet exceeds maximum packet size")
+	ErrUnsupportedPacketType            = errors.New("unsupported mqtt control packet type")
 	ErrConnRefusedBadProtocolVersion    = errors.New("connection refused, unacceptable protocol version")
 	ErrConnRefusedIDRejected            = errors.New("connection refused, identifier rejected")
 	ErrConnRefusedServerUnavailable     = errors.New("connection refused, server unavailable")
 	ErrConnRefusedBadUsernameOrPassword = errors.New("connection refused, bad user name or password")
 	ErrConnRefusedNotAuthorized         = errors.New("connection refused, not authorized")
 	ErrConnUnknown                      = errors.New("connection refused, unknown error")
+	ErrPacketIDExhausted                = errors.New("no mqtt packet identifier available, all are in flight")
 )
 
 // Marshaller interface is shared by all MQTT control packets
@@ -62,6 +118,27 @@ type Marshaller interface {
 	Marshall() []byte
 }
 
+// Packet is implemented by all MQTT control packets. On top of Marshall,
+// packets can be written directly to a stream, without having to
+// build an intermediate buffer containing the whole packet.
+//
+// String returns a human readable form of the packet, suitable for logs
+// and protocol traces. It never contains the password of CONNECT packets.
+type Packet interface {
+	Marshaller
+	io.WriterTo
+	Type() PacketType
+	String() string
+}
+
+// encodable is implemented by control packets that know their size in
+// advance and can serialize themselves into a caller provided buffer. It
+// allows the Encoder to reuse the same buffer for all packets.
+type encodable interface {
+	PayloadSize() int
+	encode(buf []byte)
+}
+
 // =============================================================================
 
 // ConnAckError translates an MQTT ConnAck error into a Go error.
@@ -84,7 +161,21 @@ func ConnAckError(returnCode int) error {
 // Decode returns parsed struct from byte array. It assumes payload does not contain
 // MQTT control packet fixed header, as parsing fixed header is needed to extract
 // the packet type code we have to decode.
-func Decode(packetType int, fixedHeaderFlags int, payload []byte) Marshaller {
+// It returns nil if the packet type is not supported or if the packet is malformed.
+func Decode(packetType int, fixedHeaderFlags int, payload []byte) Packet {
+	p, err := decodePacket(packetType, fixedHeaderFlags, payload)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+func decodePacket(packetType int, fixedHeaderFlags int, payload []byte) (Packet, error) {
+	// Packets with invalid fixed header flags are malformed [MQTT-2.2.2-2].
+	if packetType != publishType && fixedHeaderFlags != reservedFlags(packetType) {
+		return nil, ErrMalformedPacket
+	}
+
 	switch packetType {
 	case connectType:
 		return connectPacket.decode(payload)
@@ -94,6 +185,12 @@ func Decode(packetType int, fixedHeaderFlags int, payload []byte) Marshaller {
 		return publishPacket.decode(fixedHeaderFlags, payload)
 	case pubackType:
 		return pubAckPacket.decode(payload)
+	case pubrecType:
+		return pubRecPacket.decode(payload)
+	case pubrelType:
+		return pubRelPacket.decode(payload)
+	case pubcompType:
+		return pubCompPacket.decode(payload)
 	case subscribeType:
 		return subscribePacket.decode(payload)
 	case subackType:
@@ -109,64 +206,120 @@ func Decode(packetType int, fixedHeaderFlags int, payload []byte) Marshaller {
 	case disconnectType:
 		return disconnectPacket.decode(payload)
 	default: // Unsupported MQTT packet type
-		return nil
+		return nil, ErrUnsupportedPacketType
 	}
 }
 
-//==============================================================================
-
-// PacketRead returns unmarshalled packet from io.Reader stream
-func PacketRead(r io.Reader) (Marshaller, error) {
-	var err error
-	fixedHeader := make([]byte, 1)
-
-	if _, err = io.ReadFull(r, fixedHeader); err != nil {
-		//fmt.Printf("Read error %q", err.Error())
-		return nil, err
+// reservedFlags returns the fixed header flags of packets other than PUBLISH
+// [MQTT-2.2.2-1].
+func reservedFlags(packetType int) int {
+	switch packetType {
+	case pubrelType, subscribeType, unsubscribeType:
+		return 2
+	default:
+		return 0
 	}
+}
 
-	packetType := fixedHeader[0] >> 4
-	fixedHeaderFlags := fixedHeader[0] & 15 // keep only last 4 bits
+//==============================================================================
 
-	// fmt.Printf("PacketType: %d\n", packetType)
-	length, _ := readRemainingLength(r)
-	// fmt.Printf("Length: %d\n", length)
-	payload := make([]byte, length)
-	if _, err = io.ReadFull(r, payload); err != nil {
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			//fmt.Printf("Connection closed unexpectedly\n")
-		}
-		return nil, err
-	}
-	return Decode(int(packetType), int(fixedHeaderFlags), payload), err
+// PacketRead returns unmarshalled packet from io.Reader stream.
+// It does not read more bytes than the packet it returns, so the reader can
+// still be used afterward, for example to switch to a Decoder.
+func PacketRead(r io.Reader) (Packet, error) {
+	return NewDecoder(r).Decode()
 }
 
 // ReadRemainingLength decodes MQTT Packet remaining length field
 // Reference: http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html#_Toc398718023
 func readRemainingLength(r io.Reader) (int, error) {
+	return decodeRemainingLength(r, make([]byte, 1))
+}
+
+// decodeRemainingLength reads the remaining length field using scratch as a
+// one byte read buffer, so that callers can avoid allocating on each packet.
+func decodeRemainingLength(r io.Reader, scratch []byte) (int, error) {
 	var multiplier uint32 = 1
 	var value uint32
-	var err error
-	encodedByte := make([]byte, 1)
+	encodedByte := scratch[:1]
 	for ok := true; ok; ok = encodedByte[0]&128 != 0 {
+		if multiplier > 128*128*128 {
+			return 0, ErrMalformedLength
+		}
 		if _, err := io.ReadFull(r, encodedByte); err != nil {
 			return 0, err
 		}
 		value += uint32(encodedByte[0]&127) * multiplier
 		multiplier *= 128
-		if multiplier > 128*128*128 {
-			err = ErrMalformedLength
-			return 0, err
+	}
+
+	return int(value), nil
+}
+
+// remainingLengthSize returns the number of bytes needed to encode the
+// remaining length field.
+func remainingLengthSize(length int) int {
+	size := 1
+	for length > 127 {
+		length /= 128
+		size++
+	}
+	return size
+}
+
+// fixedHeaderSize returns the size of the fixed header for a packet whose
+// variable header and payload are length bytes long.
+func fixedHeaderSize(length int) int {
+	return 1 + remainingLengthSize(length)
+}
+
+// putFixedHeader writes the control packet first byte and the encoded
+// remaining length at the beginning of buf. It returns the position of the
+// variable header.
+func putFixedHeader(buf []byte, firstByte byte, length int) int {
+	buf[0] = firstByte
+	pos := 1
+	for {
+		encodedByte := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			encodedByte |= 128
 		}
+		buf[pos] = encodedByte
+		pos++
+		if length == 0 {
+			return pos
+		}
+	}
+}
+
+// extractNextString reads a UTF-8 encoded string. Strings with ill-formed
+// UTF-8 or null characters are malformed [MQTT-1.5.3-1] [MQTT-1.5.3-2].
+func extractNextString(data []byte) (string, []byte, error) {
+	b, rest, err := extractNextBytes(data)
+	if err != nil {
+		return "", nil, err
 	}
+	if !validString(b) {
+		return "", nil, ErrMalformedPacket
+	}
+	return string(b), rest, nil
+}
 
-	return int(value), err
+func validString(b []byte) bool {
+	return utf8.Valid(b) && bytes.IndexByte(b, 0) < 0
 }
 
-func extractNextString(data []byte) (string, []byte) {
+func extractNextBytes(data []byte) ([]byte, []byte, error) {
 	offset := 2
+	if len(data) < offset {
+		return nil, nil, ErrMalformedPacket
+	}
 	length := int(binary.BigEndian.Uint16(data[:offset]))
-	return string(data[offset : length+offset]), data[length+offset:]
+	if len(data) < length+offset {
+		return nil, nil, ErrMalformedPacket
+	}
+	return data[offset : length+offset], data[length+offset:], nil
 }
 
 //==============================================================================
@@ -175,9 +328,42 @@ func extractNextString(data []byte) (string, []byte) {
 
 // We assume we are provided with a long enough bytes array to write the string into.
 func copyBufferString(buf []byte, pos int, s string) int {
-	nextPos := pos + stringSize(s)
-	copy(buf[pos:nextPos], encodeString(s))
-	return nextPos
+	if len(s) == 0 {
+		return pos
+	}
+	binary.BigEndian.PutUint16(buf[pos:pos+2], uint16(len(s)))
+	return pos + 2 + copy(buf[pos+2:], s)
+}
+
+// copyBufferBytes writes binary data b, prefixed with its length, at
+// position pos. Unlike strings, binary data is written even if empty.
+func copyBufferBytes(buf []byte, pos int, b []byte) int {
+	binary.BigEndian.PutUint16(buf[pos:pos+2], uint16(len(b)))
+	return pos + 2 + copy(buf[pos+2:], b)
+}
+
+// marshall serializes a control packet into a newly allocated buffer of the
+// exact packet size.
+func marshall(p encodable) []byte {
+	length := p.PayloadSize()
+	buf := make([]byte, fixedHeaderSize(length)+length)
+	p.encode(buf)
+	return buf
+}
+
+// PacketSize returns the size in bytes of the serialized control packet.
+func PacketSize(p Packet) int {
+	if ep, ok := p.(encodable); ok {
+		length := ep.PayloadSize()
+		return fixedHeaderSize(length) + length
+	}
+	return len(p.Marshall())
+}
+
+// writePacket writes the serialized control packet to w.
+func writePacket(w io.Writer, p encodable) (int64, error) {
+	n, err := w.Write(marshall(p))
+	return int64(n), err
 }
 
 //==============================================================================
@@ -200,6 +386,13 @@ func stringSize(s string) int {
 	return 2 + len(s)
 }
 
+// Binary data
+// ===========
+
+func bytesSize(b []byte) int {
+	return 2 + len(b)
+}
+
 // Integers
 // ========
 
@@ -9,6 +9,29 @@ func TestReadRemainingLength(t *testing.T) {
 	bufferCheck([]byte{0}, 0, t)
 	bufferCheck([]byte{64}, 64, t)
 	bufferCheck([]byte{193, 2}, 321, t)
+	bufferCheck([]byte{128, 128, 128, 1}, 2097152, t)
+	bufferCheck([]byte{255, 255, 255, 127}, 268435455, t)
+}
+
+func TestReadRemainingLengthMalformed(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{255, 255, 255, 255, 127})
+	if _, err := readRemainingLength(buf); err != ErrMalformedLength {
+		t.Errorf("incorrect error for 5 bytes remaining length (%v) = %v", err, ErrMalformedLength)
+	}
+}
+
+func TestPutFixedHeader(t *testing.T) {
+	for _, length := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+		buf := make([]byte, fixedHeaderSize(length))
+		pos := putFixedHeader(buf, publishType<<4, length)
+		if pos != len(buf) {
+			t.Errorf("incorrect fixed header size for length %d (%d) = %d", length, pos, len(buf))
+		}
+		l, err := readRemainingLength(bytes.NewReader(buf[1:]))
+		if err != nil || l != length {
+			t.Errorf("incorrect remaining length (%d) = %d", l, length)
+		}
+	}
 }
 
 func bufferCheck(input []byte, expected int, t *testing.T) {
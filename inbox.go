@@ -0,0 +1,166 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import "sync"
+
+// OverflowPolicy defines how the client behaves when the application does
+// not read messages from the default message channel fast enough.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock stops reading from the connection until the application
+	// reads the message. This is the default policy. Note that keepalive
+	// responses cannot be processed while the client is blocked.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards received messages when the message channel
+	// is full.
+	OverflowDropNewest
+	// OverflowDropOldest keeps received messages in a bounded buffer and
+	// discards the oldest buffered message when the buffer is full.
+	OverflowDropOldest
+	// OverflowSpill keeps received messages in a bounded buffer and blocks
+	// like OverflowBlock when the buffer is full.
+	OverflowSpill
+)
+
+// defaultInboxSize is the default buffer size for OverflowDropOldest and
+// OverflowSpill policies.
+const defaultInboxSize = 256
+
+//=============================================================================
+
+// inbox delivers received messages to the application message channel,
+// applying the overflow policy. The inbox outlives connections, so that
+// buffered messages are kept on reconnect.
+type inbox struct {
+	out    chan<- Message
+	policy OverflowPolicy
+	// Buffer for OverflowDropOldest and OverflowSpill policies
+	buf    chan Message
+	onDrop func(m Message)
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// newInbox creates an inbox delivering to out. onDrop is called for each
+// message dropped by the inbox.
+func newInbox(out chan<- Message, opt OptInbound, onDrop func(m Message)) *inbox {
+	ib := &inbox{
+		out:    out,
+		policy: opt.Overflow,
+		onDrop: onDrop,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	switch ib.policy {
+	case OverflowDropOldest, OverflowSpill:
+		size := opt.BufferSize
+		if size <= 0 {
+			size = defaultInboxSize
+		}
+		ib.buf = make(chan Message, size)
+		go ib.forward()
+	default:
+		close(ib.done)
+	}
+	return ib
+}
+
+// put delivers m according to the overflow policy. When put has to block,
+// it returns as soon as quit is closed, dropping the message. This makes
+// sure the receiver never gets stuck on a full channel when the connection
+// is closed.
+func (ib *inbox) put(m Message, quit <-chan struct{}) {
+	// Nobody is listening: Message is lost anyway.
+	if ib.out == nil {
+		ib.drop(m)
+		return
+	}
+
+	switch ib.policy {
+	case OverflowDropNewest:
+		select {
+		case ib.out <- m:
+		default:
+			ib.drop(m)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case ib.buf <- m:
+				return
+			default:
+			}
+			// Buffer is full: Make room for the new message.
+			select {
+			case old := <-ib.buf:
+				ib.drop(old)
+			default:
+			}
+		}
+	case OverflowSpill:
+		select {
+		case ib.buf <- m:
+		case <-quit:
+			ib.drop(m)
+		case <-ib.stop:
+			ib.drop(m)
+		}
+	default:
+		select {
+		case ib.out <- m:
+		case <-quit:
+			ib.drop(m)
+		case <-ib.stop:
+			ib.drop(m)
+		}
+	}
+}
+
+// forward moves buffered messages to the message channel.
+func (ib *inbox) forward() {
+	defer close(ib.done)
+	for {
+		select {
+		case m := <-ib.buf:
+			select {
+			case ib.out <- m:
+			case <-ib.stop:
+				ib.drop(m)
+				return
+			}
+		case <-ib.stop:
+			return
+		}
+	}
+}
+
+// close stops the inbox and waits until it does not use the message channel
+// anymore. Messages still buffered are dropped.
+func (ib *inbox) close() {
+	ib.stopOnce.Do(func() {
+		close(ib.stop)
+	})
+	<-ib.done
+
+	for ib.buf != nil {
+		select {
+		case m := <-ib.buf:
+			ib.drop(m)
+		default:
+			return
+		}
+	}
+}
+
+// drop discards message m. Dropped messages are acknowledged, as they will
+// never be processed by the application.
+func (ib *inbox) drop(m Message) {
+	m.Ack()
+	m.Release()
+	if ib.onDrop != nil {
+		ib.onDrop(m)
+	}
+}
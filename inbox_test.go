@@ -0,0 +1,121 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInboxDropNewest(t *testing.T) {
+	messages := make(chan Message, 1)
+	var dropped []string
+	ib := newInbox(messages, OptInbound{Overflow: OverflowDropNewest}, func(m Message) {
+		dropped = append(dropped, m.Topic)
+	})
+	defer ib.close()
+
+	ib.put(Message{Topic: "test/1"}, nil)
+	ib.put(Message{Topic: "test/2"}, nil)
+
+	if m := <-messages; m.Topic != "test/1" {
+		t.Errorf("incorrect delivered message (%s) = %s", m.Topic, "test/1")
+	}
+	if len(dropped) != 1 || dropped[0] != "test/2" {
+		t.Errorf("incorrect dropped messages (%v) = %v", dropped, []string{"test/2"})
+	}
+}
+
+func TestInboxDropOldest(t *testing.T) {
+	messages := make(chan Message)
+	drops := make(chan string, 10)
+	ib := newInbox(messages, OptInbound{Overflow: OverflowDropOldest, BufferSize: 2}, func(m Message) {
+		drops <- m.Topic
+	})
+
+	// Forwarder holds the first message, waiting for the application.
+	ib.put(Message{Topic: "test/1"}, nil)
+	waitForForwarder(t, ib)
+	for _, topic := range []string{"test/2", "test/3", "test/4"} {
+		ib.put(Message{Topic: topic}, nil)
+	}
+
+	if topic := <-drops; topic != "test/2" {
+		t.Errorf("incorrect dropped message (%s) = %s", topic, "test/2")
+	}
+	for _, expected := range []string{"test/1", "test/3", "test/4"} {
+		if m := <-messages; m.Topic != expected {
+			t.Errorf("incorrect delivered message (%s) = %s", m.Topic, expected)
+		}
+	}
+	ib.close()
+}
+
+func TestInboxSpill(t *testing.T) {
+	messages := make(chan Message)
+	ib := newInbox(messages, OptInbound{Overflow: OverflowSpill, BufferSize: 1}, nil)
+
+	ib.put(Message{Topic: "test/1"}, nil)
+	waitForForwarder(t, ib)
+	ib.put(Message{Topic: "test/2"}, nil)
+
+	// Buffer is full: put must block until connection is closed.
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ib.put(Message{Topic: "test/3"}, quit)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("put should block when spill buffer is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(quit)
+	<-done
+
+	for _, expected := range []string{"test/1", "test/2"} {
+		if m := <-messages; m.Topic != expected {
+			t.Errorf("incorrect delivered message (%s) = %s", m.Topic, expected)
+		}
+	}
+	ib.close()
+}
+
+func TestInboxBlockQuit(t *testing.T) {
+	var dropped int
+	ib := newInbox(make(chan Message), OptInbound{}, func(m Message) {
+		dropped++
+	})
+
+	quit := make(chan struct{})
+	close(quit)
+	ib.put(Message{Topic: "test/1"}, quit)
+	if dropped != 1 {
+		t.Errorf("incorrect dropped count (%d) = %d", dropped, 1)
+	}
+}
+
+func TestInboxCloseUnblocksForwarder(t *testing.T) {
+	var dropped int
+	ib := newInbox(make(chan Message), OptInbound{Overflow: OverflowSpill}, func(m Message) {
+		dropped++
+	})
+	ib.put(Message{Topic: "test/1"}, nil)
+	ib.put(Message{Topic: "test/2"}, nil)
+
+	ib.close()
+	if dropped != 2 {
+		t.Errorf("incorrect dropped count (%d) = %d", dropped, 2)
+	}
+}
+
+// waitForForwarder waits until the forwarder has taken all buffered messages.
+func waitForForwarder(t *testing.T, ib *inbox) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(ib.buf) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("forwarder did not take buffered message")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,6 +1,9 @@
 package mqtt // import "gosrc.io/mqtt"
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 const (
 	keepaliveReset = iota
@@ -9,9 +12,13 @@ const (
 
 type keepaliveAction func()
 
-func startKeepalive(keepaliveDuration int, action keepaliveAction) chan int {
+func startKeepalive(keepaliveDuration int, action keepaliveAction, wg *sync.WaitGroup) chan int {
 	channel := make(chan int)
-	go keepalive(keepaliveDuration, channel, action)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		keepalive(keepaliveDuration, channel, action)
+	}()
 	return channel
 }
 
@@ -0,0 +1,80 @@
+package mqtt // import "gosrc.io/mqtt"
+
+// Logger is the interface used by the client to report its activity.
+// keyvals are alternating keys and values, in the same way as log/slog
+// attributes. Records carry structured fields with keys "client_id",
+// "broker", "packet_type", "packet_id" and "error" when relevant.
+//
+// A *slog.Logger satisfies Logger (see NewSlogLogger). By default, the
+// client does not log anything.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// Keys of structured log fields
+const (
+	logKeyClientID   = "client_id"
+	logKeyBroker     = "broker"
+	logKeyPacketType = "packet_type"
+	logKeyPacketID   = "packet_id"
+	logKeyError      = "error"
+	logKeyTopic      = "topic"
+)
+
+//=============================================================================
+
+// NopLogger is a Logger discarding all log records. It is used when no
+// logger is configured.
+type NopLogger struct{}
+
+// Debug implements Logger.
+func (NopLogger) Debug(string, ...interface{}) {}
+
+// Info implements Logger.
+func (NopLogger) Info(string, ...interface{}) {}
+
+// Warn implements Logger.
+func (NopLogger) Warn(string, ...interface{}) {}
+
+// Error implements Logger.
+func (NopLogger) Error(string, ...interface{}) {}
+
+// fieldLogger adds the same fields to all log records.
+type fieldLogger struct {
+	logger Logger
+	fields []interface{}
+}
+
+// withFields returns a logger adding keyvals to all records of logger. It
+// returns a silent logger if logger is nil.
+func withFields(logger Logger, keyvals ...interface{}) Logger {
+	if logger == nil {
+		return NopLogger{}
+	}
+	return fieldLogger{logger: logger, fields: keyvals}
+}
+
+func (l fieldLogger) Debug(msg string, keyvals ...interface{}) {
+	l.logger.Debug(msg, l.with(keyvals)...)
+}
+
+func (l fieldLogger) Info(msg string, keyvals ...interface{}) {
+	l.logger.Info(msg, l.with(keyvals)...)
+}
+
+func (l fieldLogger) Warn(msg string, keyvals ...interface{}) {
+	l.logger.Warn(msg, l.with(keyvals)...)
+}
+
+func (l fieldLogger) Error(msg string, keyvals ...interface{}) {
+	l.logger.Error(msg, l.with(keyvals)...)
+}
+
+func (l fieldLogger) with(keyvals []interface{}) []interface{} {
+	all := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	all = append(all, l.fields...)
+	return append(all, keyvals...)
+}
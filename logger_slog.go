@@ -0,0 +1,15 @@
+//go:build go1.21
+// +build go1.21
+
+package mqtt // import "gosrc.io/mqtt"
+
+import "log/slog"
+
+// NewSlogLogger returns a Logger writing records to l, or to the default
+// slog logger if l is nil.
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return l
+}
@@ -0,0 +1,27 @@
+//go:build go1.21
+// +build go1.21
+
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	logger := withFields(NewSlogLogger(slog.New(handler)), logKeyClientID, "test-client")
+	logger.Error("cannot send packet", logKeyPacketType, PacketPublish, logKeyError, errors.New("broken pipe"))
+
+	record := buf.String()
+	for _, field := range []string{"level=ERROR", `msg="cannot send packet"`, "client_id=test-client",
+		"packet_type=PUBLISH", `error="broken pipe"`} {
+		if !strings.Contains(record, field) {
+			t.Errorf("log record %q does not contain %q", record, field)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testLogRecord struct {
+	level   string
+	msg     string
+	keyvals []interface{}
+}
+
+// testLogger records log records.
+type testLogger struct {
+	records []testLogRecord
+}
+
+func (l *testLogger) Debug(msg string, keyvals ...interface{}) { l.record("debug", msg, keyvals) }
+func (l *testLogger) Info(msg string, keyvals ...interface{})  { l.record("info", msg, keyvals) }
+func (l *testLogger) Warn(msg string, keyvals ...interface{})  { l.record("warn", msg, keyvals) }
+func (l *testLogger) Error(msg string, keyvals ...interface{}) { l.record("error", msg, keyvals) }
+
+func (l *testLogger) record(level, msg string, keyvals []interface{}) {
+	l.records = append(l.records, testLogRecord{level: level, msg: msg, keyvals: keyvals})
+}
+
+func TestLoggerWithFields(t *testing.T) {
+	var recorder testLogger
+	logger := withFields(&recorder, logKeyClientID, "test-client", logKeyBroker, "tcp://localhost:1883")
+	logger.Warn("message dropped", logKeyPacketID, 5)
+
+	expected := testLogRecord{
+		level:   "warn",
+		msg:     "message dropped",
+		keyvals: []interface{}{logKeyClientID, "test-client", logKeyBroker, "tcp://localhost:1883", logKeyPacketID, 5},
+	}
+	if len(recorder.records) != 1 || !reflect.DeepEqual(recorder.records[0], expected) {
+		t.Errorf("incorrect log records (%+v) = %+v", recorder.records, expected)
+	}
+}
+
+func TestLoggerDefaultSilent(t *testing.T) {
+	if _, ok := withFields(nil, logKeyClientID, "test-client").(NopLogger); !ok {
+		t.Error("logger should be silent when no logger is configured")
+	}
+}
+
+func TestClientLogger(t *testing.T) {
+	var recorder testLogger
+	c := NewClient(DefaultMQTTServer)
+	c.ClientID = "test-client"
+	c.Logger = &recorder
+	c.handleQOSResponse(SubAckPacket{ID: 3})
+
+	if len(recorder.records) != 1 {
+		t.Fatalf("incorrect number of log records (%d) = %d", len(recorder.records), 1)
+	}
+	expected := []interface{}{logKeyClientID, "test-client", logKeyBroker, DefaultMQTTServer,
+		logKeyPacketType, PacketSubAck, logKeyPacketID, 3}
+	if keyvals := recorder.records[0].keyvals; !reflect.DeepEqual(keyvals, expected) {
+		t.Errorf("incorrect log fields (%v) = %v", keyvals, expected)
+	}
+}
@@ -0,0 +1,11 @@
+package metrics // import "gosrc.io/mqtt/metrics"
+
+import "expvar"
+
+// Publish exposes the collector metrics as an expvar variable with the given
+// name. Like expvar.Publish, it panics if the name is already used.
+func (c *Collector) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return c.Snapshot()
+	}))
+}
@@ -0,0 +1,209 @@
+// Package metrics collects MQTT client metrics and exposes them with expvar
+// or in Prometheus text exposition format.
+//
+// A Collector is an mqtt.Observer. It can be shared by several clients, in
+// which case metrics are aggregated:
+//
+//	collector := metrics.NewCollector()
+//	client.Observer = collector
+//	collector.Publish("mqtt")
+//	http.Handle("/metrics", collector.Handler())
+package metrics // import "gosrc.io/mqtt/metrics"
+
+import (
+	"sync/atomic"
+	"time"
+
+	"gosrc.io/mqtt"
+)
+
+// packetTypes is the number of MQTT control packet types, as packet type is
+// encoded on 4 bits.
+const packetTypes = 16
+
+// latencyBuckets are the upper bounds of publish to acknowledgement latency
+// histogram buckets.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Collector counts client metrics events. It is safe for concurrent use.
+type Collector struct {
+	packetsSent     [packetTypes]uint64
+	packetsReceived [packetTypes]uint64
+	bytesSent       [packetTypes]uint64
+	bytesReceived   [packetTypes]uint64
+
+	// Publish latency histograms for QOS 1 and QOS 2
+	latency [2]histogram
+
+	inflight   int64
+	reconnects uint64
+	dropped    uint64
+	// Last ping round trip time, in nanoseconds
+	pingRTT int64
+}
+
+var _ mqtt.Observer = (*Collector)(nil)
+
+// NewCollector returns a new collector, with all metrics at zero.
+func NewCollector() *Collector {
+	c := &Collector{}
+	for i := range c.latency {
+		c.latency[i].counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	return c
+}
+
+// PacketSent implements mqtt.Observer.
+func (c *Collector) PacketSent(t mqtt.PacketType, size int) {
+	if i, ok := packetIndex(t); ok {
+		atomic.AddUint64(&c.packetsSent[i], 1)
+		atomic.AddUint64(&c.bytesSent[i], uint64(size))
+	}
+}
+
+// PacketReceived implements mqtt.Observer.
+func (c *Collector) PacketReceived(t mqtt.PacketType, size int) {
+	if i, ok := packetIndex(t); ok {
+		atomic.AddUint64(&c.packetsReceived[i], 1)
+		atomic.AddUint64(&c.bytesReceived[i], uint64(size))
+	}
+}
+
+// PublishAcked implements mqtt.Observer.
+func (c *Collector) PublishAcked(qos int, latency time.Duration) {
+	if qos == 1 || qos == 2 {
+		c.latency[qos-1].observe(latency)
+	}
+}
+
+// InflightChanged implements mqtt.Observer. When the collector is shared by
+// several clients, the in-flight gauge is the count of the last client that
+// changed.
+func (c *Collector) InflightChanged(count int) {
+	atomic.StoreInt64(&c.inflight, int64(count))
+}
+
+// Reconnected implements mqtt.Observer.
+func (c *Collector) Reconnected() {
+	atomic.AddUint64(&c.reconnects, 1)
+}
+
+// PingRTT implements mqtt.Observer.
+func (c *Collector) PingRTT(rtt time.Duration) {
+	atomic.StoreInt64(&c.pingRTT, int64(rtt))
+}
+
+// MessageDropped implements mqtt.Observer.
+func (c *Collector) MessageDropped() {
+	atomic.AddUint64(&c.dropped, 1)
+}
+
+// Snapshot returns the current value of all metrics.
+func (c *Collector) Snapshot() Snapshot {
+	s := Snapshot{
+		PacketsSent:     make(map[string]uint64),
+		PacketsReceived: make(map[string]uint64),
+		BytesSent:       make(map[string]uint64),
+		BytesReceived:   make(map[string]uint64),
+		PublishLatency:  make(map[int]Histogram),
+		Inflight:        int(atomic.LoadInt64(&c.inflight)),
+		Reconnects:      atomic.LoadUint64(&c.reconnects),
+		DroppedMessages: atomic.LoadUint64(&c.dropped),
+		PingRTT:         time.Duration(atomic.LoadInt64(&c.pingRTT)),
+	}
+	for i := 0; i < packetTypes; i++ {
+		name := mqtt.PacketType(i).String()
+		addCount(s.PacketsSent, name, atomic.LoadUint64(&c.packetsSent[i]))
+		addCount(s.PacketsReceived, name, atomic.LoadUint64(&c.packetsReceived[i]))
+		addCount(s.BytesSent, name, atomic.LoadUint64(&c.bytesSent[i]))
+		addCount(s.BytesReceived, name, atomic.LoadUint64(&c.bytesReceived[i]))
+	}
+	for i := range c.latency {
+		s.PublishLatency[i+1] = c.latency[i].snapshot()
+	}
+	return s
+}
+
+//=============================================================================
+
+// Snapshot is the value of client metrics at a given time. Packet and byte
+// counts are indexed by packet type name, like "PUBLISH". Only packet types
+// that have been seen are present. Both reserved packet types are counted as
+// "RESERVED".
+type Snapshot struct {
+	PacketsSent     map[string]uint64
+	PacketsReceived map[string]uint64
+	BytesSent       map[string]uint64
+	BytesReceived   map[string]uint64
+	// PublishLatency is the publish to acknowledgement latency, by QOS.
+	PublishLatency  map[int]Histogram
+	Inflight        int
+	Reconnects      uint64
+	DroppedMessages uint64
+	// PingRTT is the last keepalive round trip time.
+	PingRTT time.Duration
+}
+
+// Histogram is a snapshot of a latency distribution. Counts are not
+// cumulative: Counts[i] is the number of observations lower or equal to
+// Bounds[i] and greater than the previous bound. The last count is for
+// observations greater than all bounds.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+type histogram struct {
+	counts []uint64
+	sum    int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := len(latencyBuckets)
+	for j, bound := range latencyBuckets {
+		if d <= bound {
+			i = j
+			break
+		}
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Bounds: latencyBuckets,
+		Counts: make([]uint64, len(h.counts)),
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+	// Count is computed from the loaded counts, so that it is consistent
+	// with them while observations are added.
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+		s.Count += s.Counts[i]
+	}
+	return s
+}
+
+func packetIndex(t mqtt.PacketType) (int, bool) {
+	return int(t), t >= 0 && t < packetTypes
+}
+
+// addCount adds n to the count of packet type name. Counts are summed, as
+// reserved packet types 0 and 15 have the same name.
+func addCount(counts map[string]uint64, name string, n uint64) {
+	if n > 0 {
+		counts[name] += n
+	}
+}
@@ -0,0 +1,164 @@
+package metrics // import "gosrc.io/mqtt/metrics"
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gosrc.io/mqtt"
+)
+
+func getCollector() *Collector {
+	c := NewCollector()
+	c.PacketSent(mqtt.PacketPublish, 20)
+	c.PacketSent(mqtt.PacketPublish, 30)
+	c.PacketReceived(mqtt.PacketPubAck, 4)
+	c.PublishAcked(1, 3*time.Millisecond)
+	c.PublishAcked(1, 2*time.Second)
+	c.InflightChanged(3)
+	c.Reconnected()
+	c.PingRTT(20 * time.Millisecond)
+	c.MessageDropped()
+	return c
+}
+
+func TestCollectorSnapshot(t *testing.T) {
+	s := getCollector().Snapshot()
+
+	if n := s.PacketsSent["PUBLISH"]; n != 2 {
+		t.Errorf("incorrect publish packets sent (%d) = %d", n, 2)
+	}
+	if n := s.BytesSent["PUBLISH"]; n != 50 {
+		t.Errorf("incorrect publish bytes sent (%d) = %d", n, 50)
+	}
+	if n := s.PacketsReceived["PUBACK"]; n != 1 {
+		t.Errorf("incorrect puback packets received (%d) = %d", n, 1)
+	}
+	if _, found := s.PacketsSent["PUBACK"]; found {
+		t.Error("packet types that have not been sent should not be reported")
+	}
+	if s.Inflight != 3 || s.Reconnects != 1 || s.DroppedMessages != 1 || s.PingRTT != 20*time.Millisecond {
+		t.Errorf("incorrect gauges and counters: %+v", s)
+	}
+
+	h := s.PublishLatency[1]
+	if h.Count != 2 || h.Sum != 2003*time.Millisecond {
+		t.Errorf("incorrect latency histogram (count=%d, sum=%s) = (count=2, sum=2.003s)", h.Count, h.Sum)
+	}
+	// 3ms is in 5ms bucket, 2s in 5s bucket
+	if h.Counts[1] != 1 || h.Counts[7] != 1 {
+		t.Errorf("incorrect latency buckets: %v", h.Counts)
+	}
+}
+
+func TestCollectorReservedTypes(t *testing.T) {
+	c := NewCollector()
+	c.PacketReceived(mqtt.PacketType(0), 2)
+	c.PacketReceived(mqtt.PacketType(15), 3)
+
+	s := c.Snapshot()
+	if n := s.PacketsReceived["RESERVED"]; n != 2 {
+		t.Errorf("incorrect reserved packets received (%d) = %d", n, 2)
+	}
+	if n := s.BytesReceived["RESERVED"]; n != 5 {
+		t.Errorf("incorrect reserved bytes received (%d) = %d", n, 5)
+	}
+}
+
+func TestCollectorPrometheus(t *testing.T) {
+	c := getCollector()
+	rec := httptest.NewRecorder()
+	c.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != prometheusContentType {
+		t.Errorf("incorrect content type (%s) = %s", ct, prometheusContentType)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE mqtt_client_packets_sent_total counter",
+		`mqtt_client_packets_sent_total{type="PUBLISH"} 2`,
+		`mqtt_client_bytes_received_total{type="PUBACK"} 4`,
+		"# TYPE mqtt_client_publish_ack_latency_seconds histogram",
+		`mqtt_client_publish_ack_latency_seconds_bucket{qos="1",le="0.001"} 0`,
+		`mqtt_client_publish_ack_latency_seconds_bucket{qos="1",le="0.005"} 1`,
+		`mqtt_client_publish_ack_latency_seconds_bucket{qos="1",le="5"} 2`,
+		`mqtt_client_publish_ack_latency_seconds_bucket{qos="1",le="+Inf"} 2`,
+		`mqtt_client_publish_ack_latency_seconds_sum{qos="1"} 2.003`,
+		`mqtt_client_publish_ack_latency_seconds_count{qos="2"} 0`,
+		"mqtt_client_inflight 3",
+		"mqtt_client_reconnects_total 1",
+		"mqtt_client_dropped_messages_total 1",
+		"mqtt_client_ping_rtt_seconds 0.02",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("prometheus output does not contain %q:\n%s", line, body)
+		}
+	}
+}
+
+// TestCollectorPrometheusConcurrent checks that histogram buckets stay
+// monotonic while latencies are observed.
+func TestCollectorPrometheusConcurrent(t *testing.T) {
+	c := NewCollector()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				c.PublishAcked(1, time.Millisecond)
+				c.PublishAcked(1, time.Minute)
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		var buf bytes.Buffer
+		if err := c.WritePrometheus(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var previous, count string
+		var last int
+		for _, line := range strings.Split(buf.String(), "\n") {
+			fields := strings.Fields(line)
+			switch {
+			case strings.HasPrefix(line, `mqtt_client_publish_ack_latency_seconds_bucket{qos="1"`):
+				var n int
+				fmt.Sscan(fields[1], &n)
+				if n < last {
+					t.Fatalf("histogram is not monotonic: %s after %s", line, previous)
+				}
+				previous, last = line, n
+			case strings.HasPrefix(line, `mqtt_client_publish_ack_latency_seconds_count{qos="1"}`):
+				count = fields[1]
+			}
+		}
+		if count != strconv.Itoa(last) {
+			t.Fatalf("incorrect histogram count (%s) = %d", count, last)
+		}
+	}
+}
+
+func TestCollectorExpvar(t *testing.T) {
+	getCollector().Publish("mqtt_test")
+
+	var s Snapshot
+	v := expvar.Get("mqtt_test")
+	if v == nil {
+		t.Fatal("collector is not published")
+	}
+	if err := json.NewDecoder(bytes.NewBufferString(v.String())).Decode(&s); err != nil {
+		t.Fatalf("cannot decode expvar metrics: %s", err)
+	}
+	if s.PacketsSent["PUBLISH"] != 2 || s.PublishLatency[1].Count != 2 {
+		t.Errorf("incorrect expvar metrics: %+v", s)
+	}
+}
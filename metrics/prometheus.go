@@ -0,0 +1,92 @@
+package metrics // import "gosrc.io/mqtt/metrics"
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// prometheusContentType is the content type of Prometheus text exposition
+// format.
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler returns an HTTP handler serving the collector metrics in
+// Prometheus text exposition format.
+func (c *Collector) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", prometheusContentType)
+		_ = c.WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes the collector metrics to w in Prometheus text
+// exposition format.
+func (c *Collector) WritePrometheus(w io.Writer) error {
+	s := c.Snapshot()
+	bw := bufio.NewWriter(w)
+
+	writeByType(bw, "mqtt_client_packets_sent_total", "Number of MQTT control packets sent.", s.PacketsSent)
+	writeByType(bw, "mqtt_client_packets_received_total", "Number of MQTT control packets received.", s.PacketsReceived)
+	writeByType(bw, "mqtt_client_bytes_sent_total", "Number of bytes sent, by MQTT control packet type.", s.BytesSent)
+	writeByType(bw, "mqtt_client_bytes_received_total", "Number of bytes received, by MQTT control packet type.", s.BytesReceived)
+
+	writeHeader(bw, "mqtt_client_publish_ack_latency_seconds", "Latency between publish and acknowledgement.", "histogram")
+	for qos := 1; qos <= 2; qos++ {
+		h := s.PublishLatency[qos]
+		var cumulative uint64
+		for i, bound := range h.Bounds {
+			cumulative += h.Counts[i]
+			fmt.Fprintf(bw, "mqtt_client_publish_ack_latency_seconds_bucket{qos=\"%d\",le=\"%s\"} %d\n",
+				qos, formatFloat(bound.Seconds()), cumulative)
+		}
+		// +Inf bucket is computed from the same counts, so that buckets
+		// are always monotonic.
+		if len(h.Counts) > len(h.Bounds) {
+			cumulative += h.Counts[len(h.Bounds)]
+		}
+		fmt.Fprintf(bw, "mqtt_client_publish_ack_latency_seconds_bucket{qos=\"%d\",le=\"+Inf\"} %d\n", qos, cumulative)
+		fmt.Fprintf(bw, "mqtt_client_publish_ack_latency_seconds_sum{qos=\"%d\"} %s\n", qos, formatFloat(h.Sum.Seconds()))
+		fmt.Fprintf(bw, "mqtt_client_publish_ack_latency_seconds_count{qos=\"%d\"} %d\n", qos, cumulative)
+	}
+
+	writeValue(bw, "mqtt_client_inflight", "Number of packets waiting for acknowledgement.", "gauge",
+		strconv.Itoa(s.Inflight))
+	writeValue(bw, "mqtt_client_reconnects_total", "Number of reconnections.", "counter",
+		strconv.FormatUint(s.Reconnects, 10))
+	writeValue(bw, "mqtt_client_dropped_messages_total", "Number of received messages dropped by overflow policy.", "counter",
+		strconv.FormatUint(s.DroppedMessages, 10))
+	writeValue(bw, "mqtt_client_ping_rtt_seconds", "Last keepalive round trip time.", "gauge",
+		formatFloat(s.PingRTT.Seconds()))
+
+	return bw.Flush()
+}
+
+func writeHeader(w io.Writer, name, help, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeValue(w io.Writer, name, help, metricType, value string) {
+	writeHeader(w, name, help, metricType)
+	fmt.Fprintf(w, "%s %s\n", name, value)
+}
+
+// writeByType writes a counter labelled with packet type, sorted by type for
+// stable output.
+func writeByType(w io.Writer, name, help string, counts map[string]uint64) {
+	writeHeader(w, name, help, "counter")
+	types := make([]string, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(w, "%s{type=%q} %d\n", name, t, counts[t])
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
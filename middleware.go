@@ -0,0 +1,172 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Middleware wraps a message handler to add behavior around inbound message
+// processing, like panic recovery, payload decompression or deduplication.
+//
+// A middleware that does not pass a message to the next handler should
+// acknowledge and release it, in case the client is configured for manual
+// acknowledgement or borrowed payloads.
+type Middleware func(Handler) Handler
+
+// Chain wraps handler h with middlewares. The first middleware is the
+// outermost one: It is the first to see messages.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Use appends middlewares to the chain applied to all received messages,
+// before they are dispatched to Mux handlers or to the default message
+// channel. Middlewares are applied on next connection, so they should be
+// added before calling Connect.
+func (c *Client) Use(middlewares ...Middleware) {
+	c.mu.Lock()
+	c.middlewares = append(c.middlewares, middlewares...)
+	c.mu.Unlock()
+}
+
+//=============================================================================
+// Built-in middlewares
+
+// Recover returns a middleware recovering from panics in next handlers.
+// The message is acknowledged and released, so that a panicking handler does
+// not block acknowledgements of next messages in manual ack mode. onPanic is
+// then called with the message and the recovered value. If it is nil, the
+// panic is silently ignored. To log panics with the client logger:
+//
+//	client.Use(mqtt.Recover(func(m mqtt.Message, v interface{}) {
+//		client.Logger.Error("panic in message handler", "topic", m.Topic, "panic", v)
+//	}))
+//
+// Without Recover, a panic in a handler crashes the program.
+func Recover(onPanic func(m Message, v interface{})) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(m Message) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				m.Ack()
+				m.Release()
+				if onPanic != nil {
+					onPanic(m, v)
+				}
+			}()
+			next.HandleMessage(m)
+		})
+	}
+}
+
+// gzipMagic is the header of gzip compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Gunzip returns a middleware decompressing gzip compressed payloads.
+// Payloads that are not gzip compressed, that cannot be decompressed or whose
+// decompressed size would exceed maxSize bytes are passed unchanged.
+// A maxSize of zero means no limit.
+func Gunzip(maxSize int) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(m Message) {
+			if payload, err := gunzip(m.Payload, maxSize); err == nil {
+				m.Payload = payload
+			}
+			next.HandleMessage(m)
+		})
+	}
+}
+
+func gunzip(data []byte, maxSize int) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return nil, gzip.ErrHeader
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var r io.Reader = zr
+	if maxSize > 0 {
+		r = io.LimitReader(zr, int64(maxSize)+1)
+	}
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && len(payload) > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+	return payload, nil
+}
+
+// Dedupe returns a middleware dropping QOS 1 messages redelivered by the
+// server: Messages with the Dup flag set, whose packet ID, topic and payload
+// are identical to one of the last size QOS 1 messages it has seen. Other
+// messages are never dropped, so repeated values published by devices are
+// all delivered. QOS 2 messages do not need deduplication, as they are
+// delivered exactly once.
+func Dedupe(size int) Middleware {
+	return func(next Handler) Handler {
+		d := &deduper{seen: make(map[uint64]int), ring: make([]uint64, 0, size)}
+		return HandlerFunc(func(m Message) {
+			if size > 0 && m.QOS == 1 && d.duplicate(m) {
+				m.Ack()
+				m.Release()
+				return
+			}
+			next.HandleMessage(m)
+		})
+	}
+}
+
+// deduper keeps hashes of the last messages in a ring buffer.
+type deduper struct {
+	mu   sync.Mutex
+	seen map[uint64]int // Number of occurrences of each hash in ring
+	ring []uint64
+	next int
+}
+
+// duplicate records message hash and reports whether the message is a
+// redelivery of a message already seen.
+func (d *deduper) duplicate(m Message) bool {
+	h := fnv.New64a()
+	h.Write([]byte{byte(m.ID >> 8), byte(m.ID)})
+	io.WriteString(h, m.Topic)
+	h.Write([]byte{0}) // Topic cannot contain null character
+	h.Write(m.Payload)
+	sum := h.Sum64()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen[sum] > 0 {
+		// Packet ID can be reused for the same message once acknowledged:
+		// Only redeliveries are duplicates.
+		return m.Dup
+	}
+
+	if len(d.ring) < cap(d.ring) {
+		d.ring = append(d.ring, sum)
+	} else {
+		old := d.ring[d.next]
+		if d.seen[old]--; d.seen[old] <= 0 {
+			delete(d.seen, old)
+		}
+		d.ring[d.next] = sum
+		d.next = (d.next + 1) % len(d.ring)
+	}
+	d.seen[sum]++
+	return false
+}
@@ -0,0 +1,148 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(m Message) {
+				calls = append(calls, name)
+				next.HandleMessage(m)
+			})
+		}
+	}
+	h := Chain(HandlerFunc(func(Message) { calls = append(calls, "handler") }), trace("first"), trace("second"))
+	h.HandleMessage(Message{})
+
+	if strings.Join(calls, ",") != "first,second,handler" {
+		t.Errorf("incorrect middleware call order: %v", calls)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	var recovered interface{}
+	h := Chain(HandlerFunc(func(Message) { panic("boom") }), Recover(func(m Message, v interface{}) {
+		recovered = v
+	}))
+	h.HandleMessage(Message{Topic: "test/1"})
+
+	if recovered != "boom" {
+		t.Errorf("incorrect recovered value (%v) = %v", recovered, "boom")
+	}
+
+	// Default is to ignore the panic.
+	h = Chain(HandlerFunc(func(Message) { panic("boom") }), Recover(nil))
+	h.HandleMessage(Message{Topic: "test/1"})
+}
+
+func TestRecoverAck(t *testing.T) {
+	s, out := newTestSender()
+	handler := func(m Message) {
+		if m.ID == 1 {
+			panic("boom")
+		}
+		m.Ack()
+	}
+	r := newReceiver(nil, nil, nil, s, OptInbound{ManualAck: true, BorrowPayloads: true}, nil,
+		Recover(nil), func(Handler) Handler { return HandlerFunc(handler) })
+
+	// Message whose handler panicked does not block next acknowledgements.
+	receivePacket(t, r, PublishPacket{ID: 1, Qos: 1, Topic: "test/1", Payload: []byte("Hi")})
+	receivePacket(t, r, PublishPacket{ID: 2, Qos: 1, Topic: "test/1", Payload: []byte("Hi")})
+	assertPacket(t, out, PubAckPacket{ID: 1})
+	assertPacket(t, out, PubAckPacket{ID: 2})
+}
+
+func TestGunzip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("uncompressed payload"))
+	zw.Close()
+	compressed := buf.Bytes()
+
+	var received []byte
+	h := Chain(HandlerFunc(func(m Message) { received = m.Payload }), Gunzip(100))
+
+	h.HandleMessage(Message{Payload: compressed})
+	if string(received) != "uncompressed payload" {
+		t.Errorf("incorrect decompressed payload (%q) = %q", received, "uncompressed payload")
+	}
+
+	h.HandleMessage(Message{Payload: []byte("plain")})
+	if string(received) != "plain" {
+		t.Errorf("uncompressed payload should not be modified (%q) = %q", received, "plain")
+	}
+
+	// Decompressed payload larger than the limit is passed unchanged.
+	h = Chain(HandlerFunc(func(m Message) { received = m.Payload }), Gunzip(5))
+	h.HandleMessage(Message{Payload: compressed})
+	if !bytes.Equal(received, compressed) {
+		t.Error("payload exceeding decompression limit should not be modified")
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	var received []string
+	h := Chain(HandlerFunc(func(m Message) { received = append(received, string(m.Payload)) }), Dedupe(2))
+
+	for _, m := range []Message{
+		{ID: 1, Payload: []byte("a")},
+		{ID: 1, Payload: []byte("a"), Dup: true},
+		{ID: 2, Payload: []byte("b")},
+		{ID: 3, Payload: []byte("c")},
+		{ID: 1, Payload: []byte("a"), Dup: true},
+	} {
+		m.Topic = "test/1"
+		m.QOS = 1
+		h.HandleMessage(m)
+	}
+	// ID 1 is forgotten after 2 other messages.
+	if strings.Join(received, ",") != "a,b,c,a" {
+		t.Errorf("incorrect deduplicated messages: %v", received)
+	}
+
+	// Repeated values are not duplicates, unless redelivered.
+	received = nil
+	for _, m := range []Message{
+		{Topic: "test/1", Payload: []byte("a")},
+		{Topic: "test/1", Payload: []byte("a")},
+		{Topic: "test/1", Payload: []byte("a"), QOS: 1, ID: 4},
+		{Topic: "test/1", Payload: []byte("a"), QOS: 1, ID: 4},
+		{Topic: "test/2", Payload: []byte("a"), QOS: 1, ID: 4, Dup: true},
+	} {
+		h.HandleMessage(m)
+	}
+	if len(received) != 5 {
+		t.Errorf("incorrect count of repeated messages (%d) = 5", len(received))
+	}
+}
+
+func TestReceiverMiddlewares(t *testing.T) {
+	var calls []string
+	mw := func(next Handler) Handler {
+		return HandlerFunc(func(m Message) {
+			calls = append(calls, "middleware:"+m.Topic)
+			next.HandleMessage(m)
+		})
+	}
+	mux := NewServeMux()
+	mux.HandleFunc("a/#", func(m Message) { calls = append(calls, "handler:"+m.Topic) })
+
+	messages := make(chan Message, 1)
+	r := newReceiver(nil, nil, newInbox(messages, OptInbound{}, nil), sender{}, OptInbound{}, mux, mw)
+	r.handler.HandleMessage(Message{Topic: "a/b"})
+	r.handler.HandleMessage(Message{Topic: "c"})
+
+	if strings.Join(calls, ",") != "middleware:a/b,handler:a/b,middleware:c" {
+		t.Errorf("incorrect calls: %v", calls)
+	}
+	if m := <-messages; m.Topic != "c" {
+		t.Errorf("incorrect fallback message topic (%q) = %q", m.Topic, "c")
+	}
+}
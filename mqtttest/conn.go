@@ -0,0 +1,66 @@
+package mqtttest // import "gosrc.io/mqtt/mqtttest"
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gosrc.io/mqtt"
+)
+
+// ============================================================================
+// Raw connection helpers, to test MQTT servers like the broker package.
+
+// WritePacket writes packet p to connection c. The test fails if the
+// packet cannot be written within ExpectTimeout.
+func WritePacket(t testing.TB, c net.Conn, p mqtt.Packet) {
+	t.Helper()
+	c.SetWriteDeadline(time.Now().Add(ExpectTimeout))
+	if _, err := p.WriteTo(c); err != nil {
+		t.Fatalf("cannot write %s: %s", p.Type(), err)
+	}
+}
+
+// ReadPacket reads the next packet from connection c. The test fails if no
+// packet is received within ExpectTimeout.
+func ReadPacket(t testing.TB, c net.Conn) mqtt.Packet {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(ExpectTimeout))
+	p, err := mqtt.PacketRead(c)
+	if err != nil {
+		t.Fatalf("cannot read packet: %s", err)
+	}
+	return p
+}
+
+// ExpectClosed checks that the other party closes connection c without
+// sending anything.
+func ExpectClosed(t testing.TB, c net.Conn) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(ExpectTimeout))
+	p, err := mqtt.PacketRead(c)
+	if err == nil {
+		t.Errorf("unexpected %s, connection should be closed", p)
+		return
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Error("connection was not closed")
+	}
+}
+
+// WaitSubscription waits until the server has acknowledged the subscription
+// of client c to topic filter. The test fails if it takes more than
+// ExpectTimeout.
+func WaitSubscription(t testing.TB, c *mqtt.Client, filter string) {
+	t.Helper()
+	deadline := time.Now().Add(ExpectTimeout)
+	for {
+		if _, ok := c.ActiveSubscriptions()[filter]; ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscription to %s was not acknowledged", filter)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,343 @@
+package mqtttest // import "gosrc.io/mqtt/mqtttest"
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"gosrc.io/mqtt"
+)
+
+// ErrFaultClosed is returned by FaultConn operations once the connection is
+// closed, by a scheduled fault or by Close.
+var ErrFaultClosed = errors.New("mqtttest: connection closed")
+
+// Fault defines the faults injected in one direction of a connection.
+// Offsets count the bytes transferred in this direction since the
+// connection was opened, starting at 0.
+type Fault struct {
+	// Latency delays each transfer.
+	Latency time.Duration
+	// Bandwidth limits the throughput, in bytes per second. Zero is
+	// unlimited.
+	Bandwidth int
+	// Fragment splits transfers into chunks of at most Fragment bytes,
+	// each delayed by Latency. Zero does not split.
+	Fragment int
+	// Corrupt lists the offsets of the bytes inverted during transfer.
+	Corrupt []int64
+	// PauseAfter pauses the transfers after PauseAfter bytes, until
+	// FaultConn Resume is called. Zero disables the pause.
+	PauseAfter int64
+	// CloseAfter closes the connection after CloseAfter bytes, possibly in
+	// the middle of a packet. Zero disables the close.
+	CloseAfter int64
+}
+
+// Faults defines the faults injected in a connection. Write faults apply to
+// the data written to the connection, Read faults to the data read from
+// it.
+type Faults struct {
+	Write Fault
+	Read  Fault
+}
+
+// ============================================================================
+// FaultConn
+
+// FaultConn is a net.Conn injecting faults in an underlying connection.
+type FaultConn struct {
+	net.Conn
+
+	read  stream
+	write stream
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewFaultConn returns a connection injecting faults in conn.
+func NewFaultConn(conn net.Conn, faults Faults) *FaultConn {
+	return &FaultConn{
+		Conn:   conn,
+		read:   stream{fault: faults.Read},
+		write:  stream{fault: faults.Write},
+		closed: make(chan struct{}),
+	}
+}
+
+// Read reads data from the connection, applying Read faults. A paused read
+// still honors the read deadline.
+func (c *FaultConn) Read(b []byte) (int, error) {
+	if err := c.read.wait(c.closed); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b[:c.read.limit(len(b))])
+	if n > 0 && c.read.transferred(b[:n]) {
+		_ = c.Close()
+	}
+	return n, err
+}
+
+// Write writes data to the connection, applying Write faults. Data is not
+// modified when corrupted: a copy is written.
+func (c *FaultConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		if err := c.write.wait(c.closed); err != nil {
+			return written, err
+		}
+		n := c.write.limit(len(b) - written)
+		chunk := append([]byte(nil), b[written:written+n]...)
+		closing := c.write.transferred(chunk)
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if closing {
+			_ = c.Close()
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close closes the connection, unblocking paused transfers.
+func (c *FaultConn) Close() error {
+	err := ErrFaultClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *FaultConn) SetDeadline(t time.Time) error {
+	c.read.setDeadline(t)
+	c.write.setDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline.
+func (c *FaultConn) SetReadDeadline(t time.Time) error {
+	c.read.setDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline.
+func (c *FaultConn) SetWriteDeadline(t time.Time) error {
+	c.write.setDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// PauseReads blocks reads until Resume is called, as if the other party
+// stopped sending data.
+func (c *FaultConn) PauseReads() {
+	c.read.pause()
+}
+
+// PauseWrites blocks writes until Resume is called, as if the network
+// stopped delivering data.
+func (c *FaultConn) PauseWrites() {
+	c.write.pause()
+}
+
+// Resume resumes paused reads and writes.
+func (c *FaultConn) Resume() {
+	c.read.resume()
+	c.write.resume()
+}
+
+// BytesRead returns the number of bytes read from the connection.
+func (c *FaultConn) BytesRead() int64 {
+	return c.read.offset()
+}
+
+// BytesWritten returns the number of bytes written to the connection.
+func (c *FaultConn) BytesWritten() int64 {
+	return c.write.offset()
+}
+
+// ============================================================================
+// FaultDialer
+
+// FaultDialer is an mqtt.Dialer injecting faults in the connections it
+// opens, to be set as client Dialer.
+type FaultDialer struct {
+	// Dialer opens the underlying connections, for example the Dialer of a
+	// Server. Default is a net.Dialer.
+	Dialer mqtt.Dialer
+	// Faults defines the faults injected in each connection: The first
+	// connection uses the first Faults, the second connection the second
+	// Faults, and so on. The last Faults are used for all remaining
+	// connections. Default is to inject no fault.
+	Faults []Faults
+
+	mu    sync.Mutex
+	conns []*FaultConn
+}
+
+// Dial opens a connection to address with the underlying dialer and wraps it
+// in a FaultConn.
+func (d *FaultDialer) Dial(network, address string) (net.Conn, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var faults Faults
+	if len(d.Faults) > 0 {
+		faults = d.Faults[len(d.Faults)-1]
+		if index := len(d.conns); index < len(d.Faults) {
+			faults = d.Faults[index]
+		}
+	}
+	fc := NewFaultConn(conn, faults)
+	d.conns = append(d.conns, fc)
+	return fc, nil
+}
+
+// Conns returns the connections opened so far, in order.
+func (d *FaultDialer) Conns() []*FaultConn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*FaultConn(nil), d.conns...)
+}
+
+// ============================================================================
+// Internal
+
+// stream applies a Fault to one direction of a connection.
+type stream struct {
+	fault Fault
+
+	mu       sync.Mutex
+	count    int64
+	paused   chan struct{} // Closed on resume
+	pausedAt bool          // PauseAfter was reached
+	deadline time.Time
+}
+
+// wait blocks while the stream is paused. It fails when the connection is
+// closed or the deadline is exceeded.
+func (s *stream) wait(closed <-chan struct{}) error {
+	select {
+	case <-closed:
+		return ErrFaultClosed
+	default:
+	}
+
+	s.mu.Lock()
+	paused, deadline := s.paused, s.deadline
+	s.mu.Unlock()
+	if paused == nil {
+		return nil
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-paused:
+		return nil
+	case <-closed:
+		return ErrFaultClosed
+	case <-timeout:
+		return timeoutError{}
+	}
+}
+
+// limit returns the number of bytes to transfer at most, out of n. The
+// transfer stops at scheduled pause and close offsets.
+func (s *stream) limit(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fault.Fragment > 0 && n > s.fault.Fragment {
+		n = s.fault.Fragment
+	}
+	for _, offset := range []int64{s.fault.PauseAfter, s.fault.CloseAfter} {
+		if offset > 0 && s.count < offset && s.count+int64(n) > offset {
+			n = int(offset - s.count)
+		}
+	}
+	return n
+}
+
+// transferred accounts for the transfer of b, corrupting scheduled bytes and
+// applying latency and bandwidth delay. It reports whether the connection
+// must be closed.
+func (s *stream) transferred(b []byte) (closing bool) {
+	s.mu.Lock()
+	start := s.count
+	for _, offset := range s.fault.Corrupt {
+		if offset >= start && offset < start+int64(len(b)) {
+			b[offset-start] ^= 0xFF
+		}
+	}
+	s.count += int64(len(b))
+	if s.fault.PauseAfter > 0 && !s.pausedAt && s.count >= s.fault.PauseAfter {
+		s.pausedAt = true
+		s.pauseLocked()
+	}
+	closing = s.fault.CloseAfter > 0 && s.count >= s.fault.CloseAfter
+	s.mu.Unlock()
+
+	delay := s.fault.Latency
+	if s.fault.Bandwidth > 0 {
+		delay += time.Duration(int64(len(b)) * int64(time.Second) / int64(s.fault.Bandwidth))
+	}
+	time.Sleep(delay)
+	return closing
+}
+
+func (s *stream) pause() {
+	s.mu.Lock()
+	s.pauseLocked()
+	s.mu.Unlock()
+}
+
+func (s *stream) pauseLocked() {
+	if s.paused == nil {
+		s.paused = make(chan struct{})
+	}
+}
+
+func (s *stream) resume() {
+	s.mu.Lock()
+	if s.paused != nil {
+		close(s.paused)
+		s.paused = nil
+	}
+	s.mu.Unlock()
+}
+
+func (s *stream) setDeadline(t time.Time) {
+	s.mu.Lock()
+	s.deadline = t
+	s.mu.Unlock()
+}
+
+func (s *stream) offset() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// timeoutError is returned when a deadline is exceeded while paused, like
+// net package timeout errors.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mqtttest: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,236 @@
+package mqtttest // import "gosrc.io/mqtt/mqtttest"
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"gosrc.io/mqtt"
+)
+
+func TestFaultConn_Fragment(t *testing.T) {
+	client, server := net.Pipe()
+	c := NewFaultConn(client, Faults{Write: Fault{Fragment: 3}})
+	defer c.Close()
+
+	go c.Write([]byte("0123456789"))
+	// net.Pipe delivers each write separately.
+	for _, expected := range []string{"012", "345", "678", "9"} {
+		buf := make([]byte, 10)
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(buf[:n]); s != expected {
+			t.Errorf("incorrect fragment (%q) = %q", s, expected)
+		}
+	}
+	if n := c.BytesWritten(); n != 10 {
+		t.Errorf("incorrect bytes written (%d) = 10", n)
+	}
+}
+
+func TestFaultConn_Corrupt(t *testing.T) {
+	client, server := net.Pipe()
+	c := NewFaultConn(client, Faults{
+		Write: Fault{Corrupt: []int64{1}},
+		Read:  Fault{Corrupt: []int64{0, 4}},
+	})
+	defer c.Close()
+
+	data := []byte("abc")
+	go c.Write(data)
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte{'a', 'b' ^ 0xFF, 'c'}) {
+		t.Errorf("incorrect corrupted write: %q", buf)
+	}
+	if string(data) != "abc" {
+		t.Errorf("written data should not be modified: %q", data)
+	}
+
+	go server.Write([]byte("defgh"))
+	buf = make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte{'d' ^ 0xFF, 'e', 'f', 'g', 'h' ^ 0xFF}) {
+		t.Errorf("incorrect corrupted read: %q", buf)
+	}
+}
+
+func TestFaultConn_CloseAfter(t *testing.T) {
+	client, server := net.Pipe()
+	c := NewFaultConn(client, Faults{Write: Fault{CloseAfter: 4}})
+	defer server.Close()
+
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(server)
+		received <- data
+	}()
+	n, err := c.Write([]byte("0123456789"))
+	if err != ErrFaultClosed || n != 4 {
+		t.Errorf("incorrect write result (%d, %v) = (4, %v)", n, err, ErrFaultClosed)
+	}
+	if data := <-received; string(data) != "0123" {
+		t.Errorf("incorrect data before close (%q) = %q", data, "0123")
+	}
+	if _, err := c.Write([]byte("a")); err != ErrFaultClosed {
+		t.Errorf("write after close should fail: %v", err)
+	}
+}
+
+func TestFaultConn_Pause(t *testing.T) {
+	client, server := net.Pipe()
+	c := NewFaultConn(client, Faults{Read: Fault{PauseAfter: 2}})
+	defer c.Close()
+	go server.Write([]byte("abcd"))
+
+	buf := make([]byte, 4)
+	if n, err := c.Read(buf); err != nil || n != 2 {
+		t.Fatalf("incorrect read before pause (%d, %v) = (2, nil)", n, err)
+	}
+
+	// Deadline is honored while paused.
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := c.Read(buf)
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("paused read should time out: %v", err)
+	}
+
+	c.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c.Resume()
+	}()
+	start := time.Now()
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "cd" {
+		t.Fatalf("incorrect read after resume (%q, %v) = (%q, nil)", buf[:n], err, "cd")
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("read was not paused: returned after %s", d)
+	}
+
+	c.PauseReads()
+	go c.Close()
+	if _, err := c.Read(buf); err != ErrFaultClosed {
+		t.Errorf("close should unblock paused read: %v", err)
+	}
+}
+
+func TestFaultConn_Latency(t *testing.T) {
+	client, server := net.Pipe()
+	// 2 fragments, each delayed by latency and 10 bytes at 1000 bytes/s.
+	c := NewFaultConn(client, Faults{Write: Fault{Latency: 10 * time.Millisecond, Bandwidth: 1000, Fragment: 10}})
+	defer c.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	start := time.Now()
+	if _, err := c.Write(make([]byte, 20)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("write was not delayed: returned after %s", d)
+	}
+}
+
+// ============================================================================
+// Client resilience
+
+func TestFaultDialer_Fragmented(t *testing.T) {
+	s := NewServer(t, Script{
+		Expect(mqtt.PacketConnect),
+		ConnAck(mqtt.ConnAccepted),
+		ExpectPacket(mqtt.PublishPacket{Topic: "test/1", Payload: bytes.Repeat([]byte("x"), 1000)}),
+	})
+	defer s.Close()
+
+	// Packets are split in single bytes in both directions.
+	d := &FaultDialer{Dialer: s.Dialer(), Faults: []Faults{{Write: Fault{Fragment: 1}, Read: Fault{Fragment: 1}}}}
+	c := mqtt.NewClient(s.Addr)
+	c.Dialer = d
+	if err := c.Connect(nil); err != nil {
+		t.Fatalf("connection failed: %s", err)
+	}
+	defer c.Disconnect()
+	if err := c.Publish("test/1", bytes.Repeat([]byte("x"), 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if s.WaitFor(mqtt.PacketPublish, time.Second) == nil {
+		t.Error("fragmented PUBLISH was not received")
+	}
+}
+
+func TestFaultDialer_CorruptConnAck(t *testing.T) {
+	s := NewServer(t, Script{
+		Expect(mqtt.PacketConnect),
+		ConnAck(mqtt.ConnAccepted),
+	})
+	defer s.Close()
+
+	// CONNACK return code is the fourth byte.
+	d := &FaultDialer{Dialer: s.Dialer(), Faults: []Faults{{Read: Fault{Corrupt: []int64{3}}}}}
+	c := mqtt.NewClient(s.Addr)
+	c.Dialer = d
+	if err := c.Connect(nil); err == nil {
+		c.Disconnect()
+		t.Fatal("connection with corrupted CONNACK should fail")
+	}
+}
+
+func TestFaultDialer_CloseMidPacket(t *testing.T) {
+	s := NewServer(t,
+		Script{
+			Expect(mqtt.PacketConnect),
+			ConnAck(mqtt.ConnAccepted),
+		},
+		Script{
+			Expect(mqtt.PacketConnect),
+			ConnAck(mqtt.ConnAccepted),
+			Drop(mqtt.PacketPingReq),
+			Expect(mqtt.PacketPublish),
+			PubAck(),
+		},
+	)
+	defer s.Close()
+
+	connect := mqtt.PacketSize(mqtt.ConnectPacket{
+		ClientID:      "test",
+		ProtocolName:  mqtt.ProtocolName,
+		ProtocolLevel: mqtt.ProtocolLevel,
+		CleanSession:  true,
+		Keepalive:     30,
+	})
+	// First connection is closed in the middle of the PUBLISH.
+	d := &FaultDialer{Dialer: s.Dialer(), Faults: []Faults{{Write: Fault{CloseAfter: int64(connect + 10)}}, {}}}
+	c := mqtt.NewClient(s.Addr)
+	c.ClientID = "test"
+	c.Dialer = d
+	cm := mqtt.NewClientManager(c, nil)
+	cm.Start()
+	defer cm.Stop()
+	if err := c.PublishMessage(mqtt.Message{Topic: "test/1", Payload: []byte("Hello, world"), QOS: 1}); err != nil {
+		t.Fatalf("publish failed: %s", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for len(s.Received(mqtt.PacketPublish)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("publish was not sent again after reconnection")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	publish := s.Received(mqtt.PacketPublish)[0].(mqtt.PublishPacket)
+	if !publish.Dup || string(publish.Payload) != "Hello, world" {
+		t.Errorf("incorrect publish sent again: %v", publish)
+	}
+	if n := len(d.Conns()); n != 2 {
+		t.Errorf("incorrect connections count (%d) = 2", n)
+	}
+}
@@ -0,0 +1,170 @@
+package mqtttest // import "gosrc.io/mqtt/mqtttest"
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gosrc.io/mqtt"
+)
+
+func TestServer_Script(t *testing.T) {
+	s := NewServer(t, Script{
+		Expect(mqtt.PacketConnect),
+		ConnAck(mqtt.ConnAccepted),
+		Expect(mqtt.PacketSubscribe),
+		SubAck(1),
+		Send(mqtt.PublishPacket{Topic: "test/1", Payload: []byte("Hi")}),
+	})
+	defer s.Close()
+
+	messages := make(chan mqtt.Message, 1)
+	c := mqtt.NewClient(s.Addr)
+	c.ClientID = "test"
+	if err := c.Connect(messages); err != nil {
+		t.Fatalf("connection failed: %s", err)
+	}
+	defer c.Disconnect()
+	if err := c.Subscribe(mqtt.Topic{Name: "test/#", QOS: 1}); err != nil {
+		t.Fatalf("subscription failed: %s", err)
+	}
+
+	select {
+	case m := <-messages:
+		if m.Topic != "test/1" || string(m.Payload) != "Hi" {
+			t.Errorf("incorrect message received: %s %q", m.Topic, m.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+
+	connect, ok := s.WaitFor(mqtt.PacketConnect, time.Second).(mqtt.ConnectPacket)
+	if !ok || connect.ClientID != "test" {
+		t.Errorf("incorrect CONNECT captured: %v", connect)
+	}
+	subscribe, ok := s.WaitFor(mqtt.PacketSubscribe, time.Second).(mqtt.SubscribePacket)
+	if !ok || len(subscribe.Topics) != 1 || subscribe.Topics[0] != (mqtt.Topic{Name: "test/#", QOS: 1}) {
+		t.Errorf("incorrect SUBSCRIBE captured: %v", subscribe)
+	}
+
+	// CONNECT, CONNACK, SUBSCRIBE, SUBACK, PUBLISH
+	packets := s.Packets()
+	if len(packets) != 5 {
+		t.Fatalf("incorrect captured packets count (%d) = 5", len(packets))
+	}
+	suback, ok := packets[3].Packet.(mqtt.SubAckPacket)
+	if !ok || packets[3].Direction != ToClient || suback.ID != subscribe.ID {
+		t.Errorf("incorrect SUBACK captured: %v", packets[3].Packet)
+	}
+}
+
+func TestServer_Pipe(t *testing.T) {
+	s := NewServer(t, Script{
+		Expect(mqtt.PacketConnect),
+		ConnAck(mqtt.ConnAccepted),
+		ExpectPacket(mqtt.PublishPacket{ID: 1, Topic: "test/1", Payload: []byte("Hi"), Qos: 1}),
+		PubAck(),
+	})
+	defer s.Close()
+
+	c := mqtt.NewClient("tcp://broker.invalid:1883")
+	c.Dialer = s.Dialer()
+	if err := c.Connect(nil); err != nil {
+		t.Fatalf("connection failed: %s", err)
+	}
+	if err := c.PublishMessage(mqtt.Message{Topic: "test/1", Payload: []byte("Hi"), QOS: 1}); err != nil {
+		t.Fatalf("publish failed: %s", err)
+	}
+	if s.WaitFor(mqtt.PacketPubAck, time.Second) != nil {
+		t.Error("PUBACK should not be captured as received")
+	}
+	c.Disconnect()
+	if s.WaitFor(mqtt.PacketDisconnect, time.Second) == nil {
+		t.Error("DISCONNECT was not captured")
+	}
+	if n := s.Connections(); n != 1 {
+		t.Errorf("incorrect connections count (%d) = 1", n)
+	}
+}
+
+func TestServer_Disconnect(t *testing.T) {
+	s := NewServer(t,
+		Script{
+			Expect(mqtt.PacketConnect),
+			ConnAck(mqtt.ConnAccepted),
+			Expect(mqtt.PacketPublish),
+			// Publish is not acknowledged before disconnection.
+			Disconnect(),
+		},
+		Script{
+			Expect(mqtt.PacketConnect),
+			ConnAck(mqtt.ConnAccepted),
+			Drop(mqtt.PacketPingReq),
+			Expect(mqtt.PacketPublish),
+			PubAck(),
+		},
+	)
+	defer s.Close()
+
+	c := mqtt.NewClient(s.Addr)
+	cm := mqtt.NewClientManager(c, nil)
+	cm.Start()
+	defer cm.Stop()
+	if err := c.PublishMessage(mqtt.Message{Topic: "test/1", Payload: []byte("Hi"), QOS: 1}); err != nil {
+		t.Fatalf("publish failed: %s", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for len(s.Received(mqtt.PacketPublish)) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("publish was not sent again after reconnection")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for _, p := range s.Packets() {
+		if publish, ok := p.Packet.(mqtt.PublishPacket); ok && p.Conn == 1 && !publish.Dup {
+			t.Error("publish sent again should be flagged as duplicate")
+		}
+	}
+	if n := s.Connections(); n != 2 {
+		t.Errorf("incorrect connections count (%d) = 2", n)
+	}
+}
+
+func TestServer_Delay(t *testing.T) {
+	delay := 100 * time.Millisecond
+	s := NewServer(t, Script{
+		Expect(mqtt.PacketConnect),
+		Delay(delay),
+		ConnAck(mqtt.ConnAccepted),
+	})
+	defer s.Close()
+
+	c := mqtt.NewClient(s.Addr)
+	start := time.Now()
+	if err := c.Connect(nil); err != nil {
+		t.Fatalf("connection failed: %s", err)
+	}
+	defer c.Disconnect()
+	if d := time.Since(start); d < delay {
+		t.Errorf("CONNACK was not delayed: connected after %s", d)
+	}
+}
+
+func TestRawConnHelpers(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		// Echo first packet, then close the connection.
+		if p, err := mqtt.PacketRead(server); err == nil {
+			_, _ = p.WriteTo(server)
+		}
+		server.Close()
+	}()
+
+	WritePacket(t, client, mqtt.PingReqPacket{})
+	if p := ReadPacket(t, client); p.Type() != mqtt.PacketPingReq {
+		t.Errorf("incorrect packet type (%s) = %s", p.Type(), mqtt.PacketPingReq)
+	}
+	ExpectClosed(t, client)
+}
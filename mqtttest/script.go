@@ -0,0 +1,253 @@
+package mqtttest // import "gosrc.io/mqtt/mqtttest"
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"gosrc.io/mqtt"
+)
+
+// ExpectTimeout is the time Expect steps wait for a packet from the client,
+// and the time raw connection helpers wait for a packet or a subscription.
+const ExpectTimeout = time.Second
+
+// errDisconnect stops a script without error.
+var errDisconnect = errors.New("mqtttest: disconnect")
+
+// Script is the list of steps played by the server for a client
+// connection. When all steps are played, the server keeps capturing the
+// packets sent by the client, without replying, until the connection is
+// closed.
+type Script []Step
+
+// Step is an action of a script. A step returning an error stops the
+// script: The error is reported as a test error and the connection is
+// closed.
+type Step func(c *Conn) error
+
+// Conn is a client connection to the server, on which steps are played.
+type Conn struct {
+	s       *Server
+	nc      net.Conn
+	index   int
+	decoder *mqtt.Decoder
+	// Last packet received, by type
+	last map[mqtt.PacketType]mqtt.Packet
+	// Packet types ignored by Read
+	dropped map[mqtt.PacketType]bool
+}
+
+func newConn(s *Server, nc net.Conn, index int) *Conn {
+	return &Conn{
+		s:       s,
+		nc:      nc,
+		index:   index,
+		decoder: mqtt.NewDecoder(bufio.NewReader(nc)),
+		last:    make(map[mqtt.PacketType]mqtt.Packet),
+		dropped: make(map[mqtt.PacketType]bool),
+	}
+}
+
+// Read returns the next packet sent by the client, skipping dropped packet
+// types. It fails if no packet is received within timeout, unless timeout
+// is zero.
+func (c *Conn) Read(timeout time.Duration) (mqtt.Packet, error) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := c.nc.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	for {
+		p, err := c.decoder.Decode()
+		if err != nil {
+			return nil, err
+		}
+		c.s.capture(p, FromClient, c.index)
+		if c.dropped[p.Type()] {
+			continue
+		}
+		c.last[p.Type()] = p
+		return p, nil
+	}
+}
+
+// Write sends packet p to the client.
+func (c *Conn) Write(p mqtt.Packet) error {
+	if err := c.nc.SetWriteDeadline(time.Now().Add(ExpectTimeout)); err != nil {
+		return err
+	}
+	if _, err := p.WriteTo(c.nc); err != nil {
+		return err
+	}
+	c.s.capture(p, ToClient, c.index)
+	return nil
+}
+
+// Last returns the last packet of type t read on the connection, or nil.
+func (c *Conn) Last(t mqtt.PacketType) mqtt.Packet {
+	return c.last[t]
+}
+
+// play plays script on the connection.
+func (c *Conn) play(script Script) {
+	for i, step := range script {
+		if err := step(c); err != nil {
+			if err != errDisconnect && !c.s.isClosed() {
+				c.s.t.Errorf("mqtttest: connection %d, step %d: %s", c.index, i+1, err)
+			}
+			return
+		}
+	}
+	for {
+		if _, err := c.Read(0); err != nil {
+			return
+		}
+	}
+}
+
+// ============================================================================
+// Steps
+
+// Expect reads the next packet from the client and checks its type.
+func Expect(t mqtt.PacketType) Step {
+	return func(c *Conn) error {
+		p, err := c.Read(ExpectTimeout)
+		if err != nil {
+			return fmt.Errorf("did not receive %s: %s", t, err)
+		}
+		if p.Type() != t {
+			return fmt.Errorf("incorrect packet received (%s) = %s", p, t)
+		}
+		return nil
+	}
+}
+
+// ExpectPacket reads the next packet from the client and checks that it is
+// equal to expected, as defined by reflect.DeepEqual.
+func ExpectPacket(expected mqtt.Packet) Step {
+	return func(c *Conn) error {
+		p, err := c.Read(ExpectTimeout)
+		if err != nil {
+			return fmt.Errorf("did not receive %s: %s", expected, err)
+		}
+		if !reflect.DeepEqual(p, expected) {
+			return fmt.Errorf("incorrect packet received (%s) = %s", p, expected)
+		}
+		return nil
+	}
+}
+
+// Send sends packet p to the client.
+func Send(p mqtt.Packet) Step {
+	return func(c *Conn) error {
+		return c.Write(p)
+	}
+}
+
+// Reply sends to the client the packet returned by reply, called with the
+// connection, for example to use the ID of the last packet received with
+// Conn Last.
+func Reply(reply func(c *Conn) (mqtt.Packet, error)) Step {
+	return func(c *Conn) error {
+		p, err := reply(c)
+		if err != nil {
+			return err
+		}
+		return c.Write(p)
+	}
+}
+
+// ConnAck replies to CONNECT with return code code.
+func ConnAck(code int) Step {
+	return Send(mqtt.ConnAckPacket{ReturnCode: code})
+}
+
+// SubAck replies to the last SUBSCRIBE with return codes, the granted QOS
+// of each topic or 0x80 for refused subscriptions.
+func SubAck(codes ...int) Step {
+	return Reply(func(c *Conn) (mqtt.Packet, error) {
+		subscribe, ok := c.Last(mqtt.PacketSubscribe).(mqtt.SubscribePacket)
+		if !ok {
+			return nil, errors.New("no SUBSCRIBE to acknowledge")
+		}
+		return mqtt.SubAckPacket{ID: subscribe.ID, ReturnCodes: codes}, nil
+	})
+}
+
+// UnsubAck replies to the last UNSUBSCRIBE.
+func UnsubAck() Step {
+	return Reply(func(c *Conn) (mqtt.Packet, error) {
+		unsubscribe, ok := c.Last(mqtt.PacketUnsubscribe).(mqtt.UnsubscribePacket)
+		if !ok {
+			return nil, errors.New("no UNSUBSCRIBE to acknowledge")
+		}
+		return mqtt.UnsubAckPacket{ID: unsubscribe.ID}, nil
+	})
+}
+
+// PubAck replies to the last QOS 1 PUBLISH.
+func PubAck() Step {
+	return Reply(func(c *Conn) (mqtt.Packet, error) {
+		publish, ok := c.Last(mqtt.PacketPublish).(mqtt.PublishPacket)
+		if !ok {
+			return nil, errors.New("no PUBLISH to acknowledge")
+		}
+		return mqtt.PubAckPacket{ID: publish.ID}, nil
+	})
+}
+
+// PubRec replies to the last QOS 2 PUBLISH.
+func PubRec() Step {
+	return Reply(func(c *Conn) (mqtt.Packet, error) {
+		publish, ok := c.Last(mqtt.PacketPublish).(mqtt.PublishPacket)
+		if !ok {
+			return nil, errors.New("no PUBLISH to acknowledge")
+		}
+		return mqtt.PubRecPacket{ID: publish.ID}, nil
+	})
+}
+
+// PubComp replies to the last PUBREL.
+func PubComp() Step {
+	return Reply(func(c *Conn) (mqtt.Packet, error) {
+		pubrel, ok := c.Last(mqtt.PacketPubRel).(mqtt.PubRelPacket)
+		if !ok {
+			return nil, errors.New("no PUBREL to complete")
+		}
+		return mqtt.PubCompPacket{ID: pubrel.ID}, nil
+	})
+}
+
+// Delay pauses the script for duration d.
+func Delay(d time.Duration) Step {
+	return func(c *Conn) error {
+		time.Sleep(d)
+		return nil
+	}
+}
+
+// Drop ignores packets of the given types for the rest of the script: They
+// are captured, but skipped by the following steps. It is useful to
+// ignore keepalive PINGREQ, or to simulate a broker losing messages.
+func Drop(types ...mqtt.PacketType) Step {
+	return func(c *Conn) error {
+		for _, t := range types {
+			c.dropped[t] = true
+		}
+		return nil
+	}
+}
+
+// Disconnect closes the connection and ends the script.
+func Disconnect() Step {
+	return func(c *Conn) error {
+		_ = c.nc.Close()
+		return errDisconnect
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Package mqtttest provides a fake MQTT broker for testing MQTT clients.
+
+The fake broker plays a script for each client connection: A list of steps
+expecting packets from the client and sending replies. All packets are
+captured for later assertions:
+
+	s := mqtttest.NewServer(t, mqtttest.Script{
+		mqtttest.Expect(mqtt.PacketConnect),
+		mqtttest.ConnAck(mqtt.ConnAccepted),
+		mqtttest.Expect(mqtt.PacketSubscribe),
+		mqtttest.SubAck(1),
+	})
+	defer s.Close()
+
+	client := mqtt.NewClient(s.Addr)
+
+The server listens on an ephemeral TCP port. Clients can also connect
+through an in-memory net.Pipe, with the server Dialer:
+
+	client.Dialer = s.Dialer()
+
+Network failures are simulated with a FaultDialer, wrapping connections to
+add latency, limit bandwidth, fragment or corrupt data, pause transfers or
+close connections in the middle of a packet:
+
+	client.Dialer = &mqtttest.FaultDialer{
+		Dialer: s.Dialer(),
+		Faults: []mqtttest.Faults{{Write: mqtttest.Fault{CloseAfter: 100}}, {}},
+	}
+
+MQTT servers are tested from the client side of a raw connection, with
+WritePacket, ReadPacket and ExpectClosed:
+
+	mqtttest.WritePacket(t, conn, mqtt.ConnectPacket{ClientID: "test"})
+	connack := mqtttest.ReadPacket(t, conn)
+*/
+package mqtttest // import "gosrc.io/mqtt/mqtttest"
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gosrc.io/mqtt"
+)
+
+var errServerClosed = errors.New("mqtttest: server closed")
+
+// Direction tells which side sent a captured packet.
+type Direction int
+
+const (
+	// FromClient is the direction of packets received by the server.
+	FromClient Direction = iota
+	// ToClient is the direction of packets sent by the server.
+	ToClient
+)
+
+// Packet is a packet captured by the server.
+type Packet struct {
+	mqtt.Packet
+	Direction Direction
+	// Conn is the index of the connection, starting at 0.
+	Conn int
+	Time time.Time
+}
+
+// Server is a fake MQTT broker playing scripts. Script failures are
+// reported as test errors.
+type Server struct {
+	// Addr is the server address, to use with mqtt.NewClient.
+	Addr string
+
+	t        testing.TB
+	scripts  []Script
+	listener net.Listener
+
+	mu      sync.Mutex
+	conns   []net.Conn
+	packets []Packet
+	closed  bool
+	// Connections being served
+	wg sync.WaitGroup
+}
+
+// NewServer starts a fake broker on an ephemeral local TCP port. Each client
+// connection plays the next script: The first connection plays the first
+// script, the second connection the second script, and so on. The last
+// script is played for all remaining connections.
+func NewServer(t testing.TB, scripts ...Script) *Server {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("mqtttest: cannot listen: %s", err)
+	}
+	s := &Server{
+		Addr:     "tcp://" + l.Addr().String(),
+		t:        t,
+		scripts:  scripts,
+		listener: l,
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s
+}
+
+// Dialer returns a dialer connecting clients to the server through
+// in-memory connections. The dial address is ignored.
+func (s *Server) Dialer() mqtt.Dialer {
+	return pipeDialer{s}
+}
+
+// Close stops the server, closes client connections and waits for scripts
+// to terminate.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	_ = s.listener.Close()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Packets returns all captured packets, in order.
+func (s *Server) Packets() []Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Packet(nil), s.packets...)
+}
+
+// Received returns the captured packets of type t sent by clients.
+func (s *Server) Received(t mqtt.PacketType) []mqtt.Packet {
+	var packets []mqtt.Packet
+	for _, p := range s.Packets() {
+		if p.Direction == FromClient && p.Type() == t {
+			packets = append(packets, p.Packet)
+		}
+	}
+	return packets
+}
+
+// Connections returns the number of client connections accepted so far.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// WaitFor waits until a client has sent a packet of type t, and returns
+// it. It returns nil after timeout.
+func (s *Server) WaitFor(t mqtt.PacketType, timeout time.Duration) mqtt.Packet {
+	deadline := time.Now().Add(timeout)
+	for {
+		if packets := s.Received(t); len(packets) > 0 {
+			return packets[0]
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// ============================================================================
+// Internal
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.serve(c)
+	}
+}
+
+// serve plays the script of connection c in a new go routine. It reports
+// false if the server is closed.
+func (s *Server) serve(c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		_ = c.Close()
+		return false
+	}
+	index := len(s.conns)
+	s.conns = append(s.conns, c)
+	var script Script
+	if len(s.scripts) > 0 {
+		script = s.scripts[len(s.scripts)-1]
+		if index < len(s.scripts) {
+			script = s.scripts[index]
+		}
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer c.Close()
+		newConn(s, c, index).play(script)
+	}()
+	return true
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) capture(p mqtt.Packet, d Direction, index int) {
+	s.mu.Lock()
+	s.packets = append(s.packets, Packet{Packet: p, Direction: d, Conn: index, Time: time.Now()})
+	s.mu.Unlock()
+}
+
+// pipeDialer connects clients to the server with net.Pipe.
+type pipeDialer struct {
+	s *Server
+}
+
+func (d pipeDialer) Dial(network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	if !d.s.serve(server) {
+		_ = client.Close()
+		return nil, errServerClosed
+	}
+	return client, nil
+}
@@ -0,0 +1,127 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"sync"
+
+	"gosrc.io/mqtt/topic"
+)
+
+// Handler processes messages received from the MQTT server.
+//
+// When the client borrows payloads (see OptInbound), the message payload is
+// only valid until HandleMessage returns: The client releases it itself
+// after the handlers have been called.
+type Handler interface {
+	HandleMessage(m Message)
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as message
+// handlers.
+type HandlerFunc func(m Message)
+
+// HandleMessage calls f(m).
+func (f HandlerFunc) HandleMessage(m Message) {
+	f(m)
+}
+
+//=============================================================================
+
+// ServeMux is an MQTT message multiplexer. It matches the topic of each
+// message against a list of registered topic filters and calls the handlers
+// of all the filters that match, in registration order. Topic filters can
+// contain wildcards.
+// It is safe for concurrent use.
+type ServeMux struct {
+	mu sync.RWMutex
+	// entries is never modified in place, but replaced on each change, so
+	// that dispatch can iterate on it without holding the lock.
+	entries []muxEntry
+}
+
+type muxEntry struct {
+	filter  string
+	handler Handler
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{}
+}
+
+// Handle registers the handler for the given topic filter. If a handler
+// already exists for filter, Handle replaces it.
+// Handle panics if filter is not a valid topic filter or if handler is nil.
+func (mux *ServeMux) Handle(filter string, handler Handler) {
+	if _, err := mux.handle(filter, handler); err != nil {
+		panic("mqtt: invalid topic filter " + filter + ": " + err.Error())
+	}
+}
+
+// HandleFunc registers the handler function for the given topic filter.
+func (mux *ServeMux) HandleFunc(filter string, handler func(Message)) {
+	if handler == nil {
+		panic("mqtt: nil handler")
+	}
+	mux.Handle(filter, HandlerFunc(handler))
+}
+
+// handle registers the handler for the given topic filter and returns the
+// handler it replaces, if any.
+func (mux *ServeMux) handle(filter string, handler Handler) (Handler, error) {
+	if err := topic.ValidateFilter(filter); err != nil {
+		return nil, err
+	}
+	if handler == nil {
+		panic("mqtt: nil handler")
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	var previous Handler
+	entries := make([]muxEntry, 0, len(mux.entries)+1)
+	for _, e := range mux.entries {
+		if e.filter != filter {
+			entries = append(entries, e)
+		} else {
+			previous = e.handler
+		}
+	}
+	mux.entries = append(entries, muxEntry{filter: filter, handler: handler})
+	return previous, nil
+}
+
+// Remove unregisters the handler for the given topic filter.
+func (mux *ServeMux) Remove(filter string) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	entries := make([]muxEntry, 0, len(mux.entries))
+	for _, e := range mux.entries {
+		if e.filter != filter {
+			entries = append(entries, e)
+		}
+	}
+	mux.entries = entries
+}
+
+// HandleMessage dispatches the message to the handlers of all topic
+// filters matching the message topic.
+func (mux *ServeMux) HandleMessage(m Message) {
+	mux.dispatch(m)
+}
+
+// dispatch calls matching handlers and reports whether at least one
+// handler matched the message topic.
+func (mux *ServeMux) dispatch(m Message) bool {
+	mux.mu.RLock()
+	entries := mux.entries
+	mux.mu.RUnlock()
+
+	matched := false
+	for _, e := range entries {
+		if topic.Match(e.filter, m.Topic) {
+			e.handler.HandleMessage(m)
+			matched = true
+		}
+	}
+	return matched
+}
@@ -0,0 +1,106 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"testing"
+)
+
+func TestServeMuxDispatch(t *testing.T) {
+	var calls []string
+	mux := NewServeMux()
+	mux.HandleFunc("sensors/+/temp", func(m Message) { calls = append(calls, "temp:"+m.Topic) })
+	mux.HandleFunc("sensors/#", func(m Message) { calls = append(calls, "all:"+m.Topic) })
+
+	if !mux.dispatch(Message{Topic: "sensors/kitchen/temp"}) {
+		t.Error("message should match registered handlers")
+	}
+	if len(calls) != 2 || calls[0] != "temp:sensors/kitchen/temp" || calls[1] != "all:sensors/kitchen/temp" {
+		t.Errorf("incorrect handler calls: %v", calls)
+	}
+
+	calls = nil
+	if mux.dispatch(Message{Topic: "actuators/kitchen/light"}) {
+		t.Error("message should not match any handler")
+	}
+	if len(calls) != 0 {
+		t.Errorf("no handler should have been called: %v", calls)
+	}
+}
+
+func TestServeMuxReplaceAndRemove(t *testing.T) {
+	var calls []string
+	mux := NewServeMux()
+	mux.HandleFunc("a/b", func(m Message) { calls = append(calls, "first") })
+	mux.HandleFunc("a/b", func(m Message) { calls = append(calls, "second") })
+
+	mux.dispatch(Message{Topic: "a/b"})
+	if len(calls) != 1 || calls[0] != "second" {
+		t.Errorf("handler was not replaced: %v", calls)
+	}
+
+	mux.Remove("a/b")
+	if mux.dispatch(Message{Topic: "a/b"}) {
+		t.Error("removed handler should not match")
+	}
+}
+
+func TestServeMuxInvalidFilter(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Handle should panic on invalid topic filter")
+		}
+	}()
+	NewServeMux().HandleFunc("sensors/#/temp", func(Message) {})
+}
+
+func TestReceiverDispatch(t *testing.T) {
+	mux := NewServeMux()
+	var handled []Message
+	mux.HandleFunc("sensors/#", func(m Message) { handled = append(handled, m) })
+
+	messages := make(chan Message, 1)
+	r := newReceiver(nil, nil, newInbox(messages, OptInbound{}, nil), sender{}, OptInbound{BorrowPayloads: true}, mux)
+	r.deliver(r.newMessage(PublishPacket{Topic: "sensors/temp", Payload: []byte("21")}))
+	r.deliver(r.newMessage(PublishPacket{Topic: "other", Payload: []byte("fallback")}))
+
+	if len(handled) != 1 || handled[0].Topic != "sensors/temp" {
+		t.Fatalf("incorrect handled messages: %+v", handled)
+	}
+	// Client releases borrowed payloads itself after calling handlers.
+	if handled[0].buf != nil {
+		t.Error("message passed to handlers should not be released by handlers")
+	}
+
+	select {
+	case m := <-messages:
+		if m.Topic != "other" || string(m.Payload) != "fallback" {
+			t.Errorf("incorrect fallback message: %+v", m)
+		}
+	default:
+		t.Error("message matching no handler should be sent to default channel")
+	}
+}
+
+func TestSubscribeHandlerError(t *testing.T) {
+	var calls []string
+	client := NewClient("tcp://localhost:1883")
+	client.Mux.HandleFunc("a/b", func(m Message) { calls = append(calls, "first") })
+	client.Disconnect()
+
+	// Handler is not left registered for a topic that is not subscribed.
+	if err := client.SubscribeHandler(Topic{Name: "c/d"}, HandlerFunc(func(Message) {})); err != ErrClientClosed {
+		t.Errorf("incorrect subscribe error (%v) = %v", err, ErrClientClosed)
+	}
+	if client.Mux.dispatch(Message{Topic: "c/d"}) {
+		t.Error("handler should be removed when subscribe fails")
+	}
+
+	// Replaced handler is restored.
+	second := HandlerFunc(func(m Message) { calls = append(calls, "second") })
+	if err := client.SubscribeHandler(Topic{Name: "a/b"}, second); err != ErrClientClosed {
+		t.Errorf("incorrect subscribe error (%v) = %v", err, ErrClientClosed)
+	}
+	client.Mux.dispatch(Message{Topic: "a/b"})
+	if len(calls) != 1 || calls[0] != "first" {
+		t.Errorf("previous handler was not restored: %v", calls)
+	}
+}
@@ -0,0 +1,79 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Observer receives metrics events from the client. Its methods are called
+// from client goroutines, possibly concurrently: They must be safe for
+// concurrent use and must not block. The metrics package provides an
+// implementation exposing counters with expvar and in Prometheus text
+// format.
+type Observer interface {
+	// PacketSent is called for each control packet written to the
+	// connection, with its size in bytes.
+	PacketSent(t PacketType, size int)
+	// PacketReceived is called for each control packet read from the
+	// connection, with its size in bytes.
+	PacketReceived(t PacketType, size int)
+	// PublishAcked is called when the server completes the acknowledgement
+	// of a QOS 1 or 2 message, with the time elapsed since publish.
+	PublishAcked(qos int, latency time.Duration)
+	// InflightChanged is called with the number of packets waiting for an
+	// acknowledgement, when it changes.
+	InflightChanged(count int)
+	// Reconnected is called when the client manager has reconnected the
+	// client.
+	Reconnected()
+	// PingRTT is called with the round trip time of keepalive PINGREQ.
+	PingRTT(rtt time.Duration)
+	// MessageDropped is called for each received message dropped because of
+	// inbound overflow policy.
+	MessageDropped()
+}
+
+// nopObserver ignores all metrics events.
+type nopObserver struct{}
+
+func (nopObserver) PacketSent(PacketType, int)      {}
+func (nopObserver) PacketReceived(PacketType, int)  {}
+func (nopObserver) PublishAcked(int, time.Duration) {}
+func (nopObserver) InflightChanged(int)             {}
+func (nopObserver) Reconnected()                    {}
+func (nopObserver) PingRTT(time.Duration)           {}
+func (nopObserver) MessageDropped()                 {}
+
+//=============================================================================
+
+// connMonitor reports the activity of a connection to the client logger
+// and observer.
+type connMonitor struct {
+	log      Logger
+	observer Observer
+	// Time of the PINGREQ waiting for PINGRESP, in Unix nanoseconds
+	pingSent int64
+}
+
+func newConnMonitor(logger Logger, observer Observer) *connMonitor {
+	if logger == nil {
+		logger = NopLogger{}
+	}
+	if observer == nil {
+		observer = nopObserver{}
+	}
+	return &connMonitor{log: logger, observer: observer}
+}
+
+// pingRequested records PINGREQ send time. A pending PINGREQ is not
+// replaced, so that the round trip time is not underestimated.
+func (m *connMonitor) pingRequested() {
+	atomic.CompareAndSwapInt64(&m.pingSent, 0, time.Now().UnixNano())
+}
+
+// pingResponded reports round trip time of pending PINGREQ, if any.
+func (m *connMonitor) pingResponded() {
+	if sent := atomic.SwapInt64(&m.pingSent, 0); sent != 0 {
+		m.observer.PingRTT(time.Duration(time.Now().UnixNano() - sent))
+	}
+}
@@ -0,0 +1,87 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testObserver records metrics events.
+type testObserver struct {
+	mu       sync.Mutex
+	received []PacketType
+	acked    []int
+	inflight []int
+	pings    int
+	nopObserver
+}
+
+func (o *testObserver) PacketReceived(t PacketType, size int) {
+	o.mu.Lock()
+	o.received = append(o.received, t)
+	o.mu.Unlock()
+}
+
+func (o *testObserver) PublishAcked(qos int, latency time.Duration) {
+	o.mu.Lock()
+	o.acked = append(o.acked, qos)
+	o.mu.Unlock()
+}
+
+func (o *testObserver) InflightChanged(count int) {
+	o.mu.Lock()
+	o.inflight = append(o.inflight, count)
+	o.mu.Unlock()
+}
+
+func (o *testObserver) PingRTT(rtt time.Duration) {
+	o.mu.Lock()
+	o.pings++
+	o.mu.Unlock()
+}
+
+func TestReceiverObserver(t *testing.T) {
+	var observer testObserver
+	s, _ := newTestSender()
+	r := newReceiver(nil, nil, newInbox(make(chan Message, 1), OptInbound{}, nil), s, OptInbound{}, nil)
+	r.mon = newConnMonitor(nil, &observer)
+
+	// PINGRESP without PINGREQ has no round trip time.
+	receivePacket(t, r, PingRespPacket{})
+	r.mon.pingRequested()
+	receivePacket(t, r, PingRespPacket{})
+	receivePacket(t, r, PublishPacket{Topic: "test/1"})
+
+	if len(observer.received) != 3 || observer.received[2] != PacketPublish {
+		t.Errorf("incorrect received packets (%v) = %v", observer.received, []PacketType{PacketPingResp, PacketPingResp, PacketPublish})
+	}
+	if observer.pings != 1 {
+		t.Errorf("incorrect number of ping round trips (%d) = %d", observer.pings, 1)
+	}
+}
+
+func TestClientPublishObserver(t *testing.T) {
+	var observer testObserver
+	c := NewClient(DefaultMQTTServer)
+	c.Observer = &observer
+
+	c.addInflight(PublishPacket{ID: 1, Qos: 1})
+	c.addInflight(PublishPacket{ID: 2, Qos: 2})
+	c.addInflight(PubRelPacket{ID: 2})
+	c.deleteInflight(1)
+	c.deleteInflight(2)
+
+	if len(observer.acked) != 2 || observer.acked[0] != 1 || observer.acked[1] != 2 {
+		t.Errorf("incorrect acknowledged publish QOS (%v) = %v", observer.acked, []int{1, 2})
+	}
+	expected := []int{1, 2, 2, 1, 0}
+	if len(observer.inflight) != len(expected) {
+		t.Fatalf("incorrect inflight counts (%v) = %v", observer.inflight, expected)
+	}
+	for i := range expected {
+		if observer.inflight[i] != expected[i] {
+			t.Errorf("incorrect inflight counts (%v) = %v", observer.inflight, expected)
+			break
+		}
+	}
+}
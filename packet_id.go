@@ -0,0 +1,51 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import "sync"
+
+// maxPacketID is the largest MQTT packet identifier. Packet identifiers are
+// encoded on 16 bits and zero is not a valid value [MQTT-2.3.1-1].
+const maxPacketID = 65535
+
+// packetIDs allocates packet identifiers for control packets that are
+// acknowledged by the server. An identifier cannot be reused while the
+// packet it identifies is still in flight, so it has to be released when
+// the acknowledgement is received.
+// It is safe for concurrent use.
+type packetIDs struct {
+	mu       sync.Mutex
+	last     uint16
+	inflight map[uint16]struct{}
+}
+
+// acquire returns the next available packet identifier, wrapping around
+// after 65535 and skipping identifiers still in flight. It returns
+// ErrPacketIDExhausted if all identifiers are in flight.
+func (ids *packetIDs) acquire() (int, error) {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	if len(ids.inflight) >= maxPacketID {
+		return 0, ErrPacketIDExhausted
+	}
+	if ids.inflight == nil {
+		ids.inflight = make(map[uint16]struct{})
+	}
+
+	for {
+		ids.last++
+		if ids.last == 0 {
+			continue
+		}
+		if _, used := ids.inflight[ids.last]; !used {
+			ids.inflight[ids.last] = struct{}{}
+			return int(ids.last), nil
+		}
+	}
+}
+
+// release makes the packet identifier available again.
+func (ids *packetIDs) release(id int) {
+	ids.mu.Lock()
+	delete(ids.inflight, uint16(id))
+	ids.mu.Unlock()
+}
@@ -0,0 +1,83 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPacketIDNeverZero(t *testing.T) {
+	var ids packetIDs
+	ids.last = maxPacketID - 1
+
+	for _, expected := range []int{maxPacketID, 1, 2} {
+		id, err := ids.acquire()
+		if err != nil {
+			t.Fatalf("cannot acquire packet id: %s", err)
+		}
+		if id != expected {
+			t.Errorf("incorrect packet id after wraparound (%d) = %d", id, expected)
+		}
+	}
+}
+
+func TestPacketIDSkipsInflight(t *testing.T) {
+	var ids packetIDs
+	first, _ := ids.acquire()
+	second, _ := ids.acquire()
+	ids.release(second)
+
+	// Wrap around: First id is still in flight and must not be reused.
+	ids.last = maxPacketID
+	id, _ := ids.acquire()
+	if id == first {
+		t.Errorf("packet id %d is in flight and should not be reused", first)
+	}
+	if id != second {
+		t.Errorf("incorrect packet id (%d) = %d", id, second)
+	}
+}
+
+func TestPacketIDExhausted(t *testing.T) {
+	var ids packetIDs
+	for i := 0; i < maxPacketID; i++ {
+		if _, err := ids.acquire(); err != nil {
+			t.Fatalf("cannot acquire packet id #%d: %s", i, err)
+		}
+	}
+
+	if _, err := ids.acquire(); err != ErrPacketIDExhausted {
+		t.Errorf("incorrect error when all ids are in flight (%v) = %v", err, ErrPacketIDExhausted)
+	}
+
+	ids.release(42)
+	if id, err := ids.acquire(); err != nil || id != 42 {
+		t.Errorf("incorrect released packet id (%d) = %d", id, 42)
+	}
+}
+
+func TestPacketIDConcurrentAcquire(t *testing.T) {
+	var ids packetIDs
+	var wg sync.WaitGroup
+	results := make(chan int, 1000)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id, _ := ids.acquire()
+				results <- id
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	seen := make(map[int]bool)
+	for id := range results {
+		if seen[id] {
+			t.Errorf("packet id %d allocated twice", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,69 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import "sync"
+
+// Payload buffers larger than maxPooledPayload are not put back in the pool,
+// to avoid keeping large chunks of memory alive after a burst of big messages.
+const maxPooledPayload = 64 << 10
+
+// maxCachedTopics limits the number of topic names the receiver keeps to
+// avoid allocating a new string for each message it receives.
+const maxCachedTopics = 1024
+
+//==============================================================================
+
+// payloadBuffer is a pooled buffer holding a borrowed message payload.
+type payloadBuffer struct {
+	b []byte
+	// Buffer has been given back to the pool
+	released bool
+}
+
+var payloadPool = sync.Pool{
+	New: func() interface{} {
+		return new(payloadBuffer)
+	},
+}
+
+// borrowPayload copies data into a buffer taken from the pool. The buffer
+// must be given back with release when the payload is not used anymore.
+func borrowPayload(data []byte) ([]byte, *payloadBuffer) {
+	pb := payloadPool.Get().(*payloadBuffer)
+	pb.b = append(pb.b[:0], data...)
+	pb.released = false
+	return pb.b, pb
+}
+
+// release gives the buffer back to the pool. Releasing it again, for example
+// from Recover after a handler released the message and panicked, does
+// nothing.
+func (pb *payloadBuffer) release() {
+	if pb.released {
+		return
+	}
+	pb.released = true
+	if cap(pb.b) > maxPooledPayload {
+		return
+	}
+	payloadPool.Put(pb)
+}
+
+//==============================================================================
+
+// topicCache interns topic names of received messages. Subscribers usually
+// receive messages on a limited set of topics, so we can reuse the same
+// strings instead of allocating a new one for each message.
+// It is not safe for concurrent use.
+type topicCache map[string]string
+
+func (c topicCache) intern(b []byte) string {
+	// Lookup with a converted byte slice does not allocate.
+	if s, ok := c[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	if len(c) < maxCachedTopics {
+		c[s] = s
+	}
+	return s
+}
@@ -1,19 +1,37 @@
 package mqtt // import "gosrc.io/mqtt"
 
 import (
+	"bufio"
 	"io"
-	"log"
+	"sync"
 )
 
 type receiver struct {
-	// Connection to read the MQTT data from
-	conn io.Reader
+	// Decoder reading the MQTT data from the connection
+	decoder *Decoder
 	// sender is the struct managing the go routine to send
 	sender sender
-	// Channel to send back message received (PUBLISH control packets) to the client using the library
-	messageChannel chan<- Message
+	// Inbox sending back message received (PUBLISH control packets) to the client using the library
+	inbox *inbox
 	// Channel to send back QOS packet (acks) to the internal client process.
 	qosChannel chan<- QOSResponse
+	// Router dispatching messages to handlers. Messages matching no handler
+	// are sent to the message channel.
+	mux *ServeMux
+	// Handler processing all received messages: Middlewares wrapping deliver
+	handler Handler
+
+	// Topic names of received messages, to avoid allocating them on each message
+	topics topicCache
+	// Read message payloads into pooled buffers that are released by the client
+	borrowPayloads bool
+	// Acknowledgements waiting for the application, in manual ack mode (nil otherwise)
+	acks *ackQueue
+	// QOS 2 messages received and not yet released by the server (PUBREL),
+	// with their pending acknowledgement in manual ack mode.
+	unreleased map[int]*ackTicket
+
+	mon *connMonitor
 }
 
 // Receiver actually need:
@@ -22,56 +40,172 @@ type receiver struct {
 // - Error send channel to trigger teardown
 // - MessageSendChannel to dispatch messages to client
 // Returns teardown channel used to notify when the receiver terminates.
-func spawnReceiver(conn io.Reader, messageChannel chan<- Message, s sender) <-chan QOSResponse {
+// The receiver go routine is tracked in wg. Acknowledgements delayed by the
+// application are sent with the sender returned by getSender, as the client
+// may have reconnected in the meantime.
+func spawnReceiver(conn io.Reader, ib *inbox, s sender, getSender func() sender, opt OptInbound, mux *ServeMux, middlewares []Middleware, wg *sync.WaitGroup, mon *connMonitor) <-chan QOSResponse {
 	qosChannel := make(chan QOSResponse)
-	go receiverLoop(conn, qosChannel, messageChannel, s)
+	r := newReceiver(bufio.NewReader(conn), qosChannel, ib, s, opt, mux, middlewares...)
+	r.mon = mon
+	if r.acks != nil {
+		r.acks.sender = getSender
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.loop()
+	}()
 	return qosChannel
 }
 
-// Receive, decode and dispatch messages to the message channel
-func receiverLoop(conn io.Reader, qosChannel chan<- QOSResponse, message chan<- Message, s sender) {
-	var p Marshaller
-	var err error
+func newReceiver(conn io.Reader, qosChannel chan<- QOSResponse, ib *inbox, s sender, opt OptInbound, mux *ServeMux, middlewares ...Middleware) *receiver {
+	r := &receiver{
+		decoder:        NewDecoder(conn),
+		sender:         s,
+		inbox:          ib,
+		qosChannel:     qosChannel,
+		mux:            mux,
+		topics:         make(topicCache),
+		borrowPayloads: opt.BorrowPayloads,
+		unreleased:     make(map[int]*ackTicket),
+		mon:            newConnMonitor(nil, nil),
+	}
+	if opt.ManualAck {
+		r.acks = newAckQueue(func() sender { return s })
+	}
+	r.handler = Chain(HandlerFunc(r.deliver), middlewares...)
+	return r
+}
 
-Loop:
+// Receive, decode and dispatch messages to the message channel
+func (r *receiver) loop() {
 	for {
-		if p, err = PacketRead(conn); err != nil {
+		if err := r.receive(); err != nil {
 			if err == io.EOF {
-				log.Printf("Connection closed\n")
+				r.mon.log.Info("connection closed by server")
+			} else {
+				r.mon.log.Error("packet read error", logKeyError, err)
 			}
-			log.Printf("packet read error: %q\n", err)
-			break Loop
+			break
+		}
+	}
+
+	// Loop ended, send receiver close signal
+	close(r.qosChannel)
+}
+
+// receive reads and dispatches the next packet from the connection.
+func (r *receiver) receive() error {
+	packetType, fixedHeaderFlags, payload, err := r.decoder.readPacket()
+	if err != nil {
+		return err
+	}
+	r.mon.observer.PacketReceived(PacketType(packetType), fixedHeaderSize(len(payload))+len(payload))
+
+	// Only broadcast message back to client when we receive publish packets.
+	// They are decoded directly from the read buffer, as they are the bulk of
+	// the traffic.
+	if packetType == publishType {
+		publish, topic, err := publishPacket.decodeRaw(fixedHeaderFlags, payload)
+		if err != nil {
+			return err
 		}
-		// fmt.Printf("Received: %+v\n", p)
-
-		sendAckIfNeeded(p, s)
-
-		// Only broadcast message back to client when we receive publish packets
-		switch packetType := p.(type) {
-		case PublishPacket:
-			m := Message{}
-			m.Topic = packetType.Topic
-			m.Payload = packetType.Payload
-			message <- m // TODO Back pressure. We may block on processing message if client does not read fast enough. Make sure we can quit.
-		default:
-			if ResponsePacket, ok := p.(QOSResponse); ok {
-				qosChannel <- ResponsePacket
+		publish.Topic = r.topics.intern(topic)
+
+		ack, deliver := r.acknowledge(publish)
+		if deliver {
+			m := r.newMessage(publish)
+			m.ack = ack
+			r.handler.HandleMessage(m)
+		}
+		return nil
+	}
+
+	p, err := decodePacket(packetType, fixedHeaderFlags, payload)
+	if err != nil {
+		return err
+	}
+	switch packet := p.(type) {
+	case PubRelPacket:
+		// Server released QOS 2 message: We will not receive it again.
+		delete(r.unreleased, packet.ID)
+		r.sender.send(PubCompPacket{ID: packet.ID})
+	case PingRespPacket:
+		r.mon.pingResponded()
+	case QOSResponse:
+		select {
+		case r.qosChannel <- packet:
+		case <-r.sender.done:
+		}
+	}
+	return nil
+}
+
+// acknowledge sends or schedules the acknowledgement of a publish packet,
+// depending on its QOS. It reports whether the message must be delivered:
+// QOS 2 messages are delivered only once, even if the server sends them
+// again before releasing them.
+func (r *receiver) acknowledge(publish PublishPacket) (*ackTicket, bool) {
+	switch publish.Qos {
+	case 1:
+		return r.ack(PubAckPacket{ID: publish.ID}), true
+	case 2:
+		if ticket, found := r.unreleased[publish.ID]; found {
+			// Duplicate: PUBREC is sent again only if we have already sent
+			// it. Otherwise, it is still waiting in the ack queue.
+			if ticket == nil || ticket.isSent() {
+				r.sender.send(PubRecPacket{ID: publish.ID})
 			}
+			return nil, false
 		}
+		ticket := r.ack(PubRecPacket{ID: publish.ID})
+		r.unreleased[publish.ID] = ticket
+		return ticket, true
 	}
+	return nil, true
+}
 
-	// Loop ended, send receiver close signal
-	close(qosChannel)
+// ack sends the ack packet right away, or returns a ticket to send it when
+// the application acknowledges the message in manual ack mode.
+func (r *receiver) ack(packet Packet) *ackTicket {
+	if r.acks == nil {
+		r.sender.send(packet)
+		return nil
+	}
+	return r.acks.add(packet)
+}
+
+// newMessage builds the message delivered to the client from a publish
+// packet whose payload still references the read buffer.
+func (r *receiver) newMessage(publish PublishPacket) Message {
+	m := Message{
+		Topic:  publish.Topic,
+		QOS:    publish.Qos,
+		Retain: publish.Retain,
+		Dup:    publish.Dup,
+		ID:     publish.ID,
+	}
+	switch {
+	case publish.Payload == nil:
+	case r.borrowPayloads:
+		m.Payload, m.buf = borrowPayload(publish.Payload)
+	default:
+		m.Payload = append([]byte(nil), publish.Payload...)
+	}
+	return m
 }
 
-// Send acks if needed, depending on packet QOS
-func sendAckIfNeeded(pkt Marshaller, s sender) {
-	switch p := pkt.(type) {
-	case PublishPacket:
-		if p.Qos == 1 {
-			puback := PubAckPacket{ID: p.ID}
-			buf := puback.Marshall()
-			s.send(buf)
+// deliver dispatches the message to the handlers matching its topic, or to
+// the message channel inbox if there is none.
+func (r *receiver) deliver(m Message) {
+	if r.mux != nil {
+		// Handlers do not own borrowed payloads: We release them when handlers return.
+		hm := m
+		hm.buf = nil
+		if r.mux.dispatch(hm) {
+			m.Release()
+			return
 		}
 	}
+	r.inbox.put(m, r.sender.done)
 }
@@ -0,0 +1,131 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReceiverBorrowedPayload(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	_ = encoder.Encode(PublishPacket{Topic: "test/1", Payload: []byte("first")})
+	_ = encoder.Encode(PublishPacket{Topic: "test/1", Payload: []byte("other")})
+
+	messages := make(chan Message, 2)
+	r := newReceiver(&buf, nil, newInbox(messages, OptInbound{}, nil), sender{}, OptInbound{BorrowPayloads: true}, nil)
+	for i := 0; i < 2; i++ {
+		if err := r.receive(); err != nil {
+			t.Fatalf("cannot receive publish packet: %s", err)
+		}
+	}
+
+	m1, m2 := <-messages, <-messages
+	if string(m1.Payload) != "first" || string(m2.Payload) != "other" {
+		t.Errorf("incorrect borrowed payloads (%q, %q) = (%q, %q)", m1.Payload, m2.Payload, "first", "other")
+	}
+	if m1.buf == nil {
+		t.Error("borrowed message should reference its pooled buffer")
+	}
+	m1.Release()
+	m2.Release()
+}
+
+func TestTopicCache(t *testing.T) {
+	cache := make(topicCache)
+	t1 := cache.intern([]byte("test/1"))
+	t2 := cache.intern([]byte("test/1"))
+	if t1 != "test/1" || t2 != "test/1" {
+		t.Errorf("incorrect interned topic (%q) = %q", t2, "test/1")
+	}
+	if len(cache) != 1 {
+		t.Errorf("incorrect topic cache size (%d) = %d", len(cache), 1)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		cache.intern([]byte("test/1"))
+	})
+	if allocs != 0 {
+		t.Errorf("interning a known topic should not allocate (%v)", allocs)
+	}
+}
+
+func TestReceiverQOS2(t *testing.T) {
+	s, out := newTestSender()
+	messages := make(chan Message, 10)
+	r := newReceiver(nil, nil, newInbox(messages, OptInbound{}, nil), s, OptInbound{}, nil)
+
+	publish := PublishPacket{ID: 7, Qos: 2, Topic: "test/1", Payload: []byte("Hi")}
+	receivePacket(t, r, publish)
+	assertPacket(t, out, PubRecPacket{ID: 7})
+
+	// Duplicate sent before PUBREL is not delivered twice.
+	publish.Dup = true
+	receivePacket(t, r, publish)
+	assertPacket(t, out, PubRecPacket{ID: 7})
+
+	receivePacket(t, r, PubRelPacket{ID: 7})
+	assertPacket(t, out, PubCompPacket{ID: 7})
+
+	if len(messages) != 1 {
+		t.Errorf("incorrect number of delivered messages (%d) = %d", len(messages), 1)
+	}
+}
+
+func TestReceiverManualAck(t *testing.T) {
+	s, out := newTestSender()
+	messages := make(chan Message, 10)
+	r := newReceiver(nil, nil, newInbox(messages, OptInbound{}, nil), s, OptInbound{ManualAck: true}, nil)
+
+	receivePacket(t, r, PublishPacket{ID: 1, Qos: 1, Topic: "test/1"})
+	receivePacket(t, r, PublishPacket{ID: 2, Qos: 2, Topic: "test/2"})
+	receivePacket(t, r, PublishPacket{Topic: "test/3"})
+	assertNoPacket(t, out)
+
+	m1, m2, m3 := <-messages, <-messages, <-messages
+	m3.Ack() // QOS 0: Nothing to send
+
+	// QOS 2 duplicate before application ack: Not delivered, PUBREC not sent yet.
+	receivePacket(t, r, PublishPacket{ID: 2, Qos: 2, Dup: true, Topic: "test/2"})
+	assertNoPacket(t, out)
+
+	m2.Ack()
+	assertNoPacket(t, out)
+
+	// QOS 2 duplicate after application ack, while PUBREC waits for the
+	// previous message ack: PUBREC is not sent twice.
+	receivePacket(t, r, PublishPacket{ID: 2, Qos: 2, Dup: true, Topic: "test/2"})
+	assertNoPacket(t, out)
+
+	m1.Ack()
+	assertPacket(t, out, PubAckPacket{ID: 1})
+	assertPacket(t, out, PubRecPacket{ID: 2})
+
+	// QOS 2 duplicate after application ack: PUBREC is sent again.
+	receivePacket(t, r, PublishPacket{ID: 2, Qos: 2, Dup: true, Topic: "test/2"})
+	assertPacket(t, out, PubRecPacket{ID: 2})
+	if len(messages) != 0 {
+		t.Errorf("duplicate message should not be delivered (%d)", len(messages))
+	}
+}
+
+func TestReceiverMessageMetadata(t *testing.T) {
+	s, _ := newTestSender()
+	messages := make(chan Message, 1)
+	r := newReceiver(nil, nil, newInbox(messages, OptInbound{}, nil), s, OptInbound{}, nil)
+
+	receivePacket(t, r, PublishPacket{ID: 3, Qos: 1, Dup: true, Retain: true, Topic: "test/1"})
+	m := <-messages
+	if m.QOS != 1 || !m.Retain || !m.Dup || m.ID != 3 {
+		t.Errorf("incorrect message metadata (qos=%d retain=%t dup=%t id=%d) = (qos=1 retain=true dup=true id=3)",
+			m.QOS, m.Retain, m.Dup, m.ID)
+	}
+}
+
+// receivePacket makes receiver read and dispatch packet p.
+func receivePacket(t *testing.T, r *receiver, p Packet) {
+	t.Helper()
+	r.decoder = NewDecoder(bytes.NewReader(p.Marshall()))
+	if err := r.receive(); err != nil {
+		t.Fatalf("cannot receive packet %s: %s", p, err)
+	}
+}
@@ -3,47 +3,78 @@ package mqtt // import "gosrc.io/mqtt"
 import (
 	"io"
 	"net"
+	"sync"
 )
 
 // Sender need the following interface:
 // - Net.conn to send TCP packets
 // - Error send channel to trigger teardown on send error
-// - SendChannel receiving []byte
+// - SendChannel receiving control packets
 // - KeepaliveCtl to reset keepalive packet timer after a send
 // - Way to stop the sender when client wants to stop / disconnect
 
 type sender struct {
 	done <-chan struct{}
-	out  chan<- []byte
+	out  chan<- Packet
 	quit chan<- struct{}
 }
 
-func initSender(conn net.Conn, keepalive int) sender {
+// initSender starts the sender and keepalive go routines. They are tracked
+// in wg, so that the client can wait for their termination.
+func initSender(conn net.Conn, keepalive int, wg *sync.WaitGroup, mon *connMonitor) sender {
 	tearDown := make(chan struct{})
-	out := make(chan []byte)
+	out := make(chan Packet)
 	quit := make(chan struct{})
+	// Large PUBLISH are encoded with several writes: The keepalive PINGREQ
+	// must not be written in between.
+	var writeMu sync.Mutex
 
 	// Start go routine that manage keepalive timer:
 	var keepaliveCtl chan int
 	if keepalive > 0 {
 		keepaliveCtl = startKeepalive(keepalive, func() {
 			pingReq := PingReqPacket{}
-			buf := pingReq.Marshall()
-			conn.Write(buf)
-		})
+			writeMu.Lock()
+			n, err := pingReq.WriteTo(conn)
+			writeMu.Unlock()
+			if err == nil {
+				mon.pingRequested()
+				mon.observer.PacketSent(PacketPingReq, int(n))
+			}
+		}, wg)
 	}
 
 	s := sender{done: tearDown, out: out, quit: quit}
-	go senderLoop(conn, keepaliveCtl, out, quit, tearDown)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		senderLoop(conn, &writeMu, keepaliveCtl, out, quit, tearDown, mon)
+	}()
 	return s
 }
 
-func senderLoop(conn io.WriteCloser, keepaliveCtl chan int, out <-chan []byte, quit <-chan struct{}, tearDown chan<- struct{}) {
+func senderLoop(conn io.WriteCloser, writeMu sync.Locker, keepaliveCtl chan int, out <-chan Packet, quit <-chan struct{}, tearDown chan<- struct{}, mon *connMonitor) {
+	defer close(tearDown)
+	encoder := NewEncoder(conn)
 Loop:
 	for {
 		select {
-		case buf := <-out:
-			conn.Write(buf) // TODO Trigger teardown and stop on write error
+		case packet := <-out:
+			writeMu.Lock()
+			err := encoder.Encode(packet)
+			writeMu.Unlock()
+			switch {
+			case err == ErrPacketTooLarge:
+				// Nothing was written: The connection can still be used.
+				mon.log.Error("cannot send packet", logKeyPacketType, packet.Type(), logKeyError, err)
+			case err != nil:
+				// Connection is broken: Closing it terminates the receiver too.
+				mon.log.Error("cannot send packet", logKeyPacketType, packet.Type(), logKeyError, err)
+				terminateSender(conn, keepaliveCtl)
+				break Loop
+			default:
+				mon.observer.PacketSent(packet.Type(), PacketSize(packet))
+			}
 			keepaliveSignal(keepaliveCtl, keepaliveReset)
 		case <-quit:
 			// Client want this sender to terminate
@@ -53,8 +84,25 @@ Loop:
 	}
 }
 
-func (s sender) send(buf []byte) {
-	s.out <- buf
+// send passes the packet to the sender loop. It does not block if the
+// sender is terminated, or if it is the zero sender of a client that has
+// never been connected: Inflight packets are then sent on next connection.
+func (s sender) send(packet Packet) {
+	if s.out == nil {
+		return
+	}
+	select {
+	case s.out <- packet:
+	case <-s.done:
+	}
+}
+
+// stop asks the sender to terminate, if it is not already terminated.
+func (s sender) stop() {
+	select {
+	case s.quit <- struct{}{}:
+	case <-s.done:
+	}
 }
 
 // clean-up:
@@ -0,0 +1,26 @@
+package mqtt // import "gosrc.io/mqtt"
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSenderWriteError(t *testing.T) {
+	conn, server := net.Pipe()
+	_ = server.Close()
+
+	var wg sync.WaitGroup
+	s := initSender(conn, 30, &wg, newConnMonitor(nil, nil))
+	s.send(PingReqPacket{})
+
+	// Sender stops on write error, instead of writing to a dead connection.
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("sender should stop on write error")
+	}
+	wg.Wait()
+	s.stop()
+}
@@ -0,0 +1,50 @@
+//go:build go1.18
+// +build go1.18
+
+package topic // import "gosrc.io/mqtt/topic"
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzMatch(f *testing.F) {
+	f.Add("sport/tennis/+", "sport/tennis/player1")
+	f.Add("sport/#", "sport")
+	f.Add("+/+", "/finance")
+	f.Add("#", "$SYS/broker/uptime")
+	f.Add("$SYS/#", "$SYS/broker/uptime")
+
+	f.Fuzz(func(t *testing.T, filter string, name string) {
+		match := Match(filter, name)
+		if ValidateFilter(filter) != nil || ValidateName(name) != nil {
+			return
+		}
+
+		// A filter without wildcard only matches the identical topic name.
+		if !strings.ContainsAny(filter, "+#") && match != (filter == name) {
+			t.Errorf("filter without wildcard %q should only match itself, match %q = %t", filter, name, match)
+		}
+		// A valid topic name is a valid filter that matches itself.
+		if !Match(name, name) {
+			t.Errorf("topic name %q should match itself", name)
+		}
+		// '#' matches everything, except topics starting with '$'.
+		if Match("#", name) != (name[0] != '$') {
+			t.Errorf("incorrect multi-level wildcard match for %q", name)
+		}
+		// Replacing any level with '+' still matches.
+		levels := strings.Split(name, "/")
+		for i := range levels {
+			if i == 0 && name[0] == '$' {
+				continue
+			}
+			saved := levels[i]
+			levels[i] = "+"
+			if f := strings.Join(levels, "/"); !Match(f, name) {
+				t.Errorf("filter %q should match topic name %q", f, name)
+			}
+			levels[i] = saved
+		}
+	})
+}
@@ -0,0 +1,130 @@
+/*
+Package topic implements MQTT topic names and topic filters rules: Validation
+of topic names used to publish, validation of topic filters used to subscribe,
+and matching of topic names against topic filters, including wildcards.
+
+Reference: http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html#_Toc398718106
+*/
+package topic // import "gosrc.io/mqtt/topic"
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Separator splits topics into levels.
+	Separator = '/'
+	// SingleLevelWildcard matches exactly one topic level.
+	SingleLevelWildcard = '+'
+	// MultiLevelWildcard matches any number of topic levels, including zero.
+	MultiLevelWildcard = '#'
+
+	// MaxLength is the maximum size in bytes of an encoded topic.
+	MaxLength = 65535
+)
+
+// Errors returned when validating topic names and topic filters.
+var (
+	ErrEmpty                      = errors.New("topic must be at least one character long")
+	ErrTooLong                    = errors.New("topic must not be longer than 65535 bytes")
+	ErrInvalidUTF8                = errors.New("topic must be a valid UTF-8 string")
+	ErrNullCharacter              = errors.New("topic must not contain null character")
+	ErrWildcardInName             = errors.New("topic name must not contain wildcard characters")
+	ErrInvalidMultiLevelWildcard  = errors.New("multi-level wildcard must be alone in the last level of topic filter")
+	ErrInvalidSingleLevelWildcard = errors.New("single-level wildcard must occupy an entire level of topic filter")
+)
+
+// ValidateName checks that name can be used as a topic name in a PUBLISH
+// control packet.
+func ValidateName(name string) error {
+	if err := validate(name); err != nil {
+		return err
+	}
+	// [MQTT-3.3.2-2]
+	if strings.ContainsAny(name, "+#") {
+		return ErrWildcardInName
+	}
+	return nil
+}
+
+// ValidateFilter checks that filter can be used as a topic filter in a
+// SUBSCRIBE or UNSUBSCRIBE control packet.
+func ValidateFilter(filter string) error {
+	if err := validate(filter); err != nil {
+		return err
+	}
+
+	for rest, more := filter, true; more; {
+		var level string
+		level, rest, more = nextLevel(rest)
+		// [MQTT-4.7.1-2]
+		if strings.IndexByte(level, MultiLevelWildcard) >= 0 && (level != "#" || more) {
+			return ErrInvalidMultiLevelWildcard
+		}
+		// [MQTT-4.7.1-3]
+		if strings.IndexByte(level, SingleLevelWildcard) >= 0 && level != "+" {
+			return ErrInvalidSingleLevelWildcard
+		}
+	}
+	return nil
+}
+
+// validate checks rules shared by topic names and topic filters.
+func validate(topic string) error {
+	switch {
+	case len(topic) == 0: // [MQTT-4.7.3-1]
+		return ErrEmpty
+	case len(topic) > MaxLength: // [MQTT-4.7.3-3]
+		return ErrTooLong
+	case !utf8.ValidString(topic): // [MQTT-1.5.3-1]
+		return ErrInvalidUTF8
+	case strings.IndexByte(topic, 0) >= 0: // [MQTT-4.7.3-2]
+		return ErrNullCharacter
+	}
+	return nil
+}
+
+// Match reports whether topic name matches topic filter. Topic names
+// starting with '$' are not matched by filters starting with a wildcard
+// [MQTT-4.7.2-1].
+//
+// Match does not validate its parameters: The result is undefined if name
+// or filter is invalid.
+func Match(filter string, name string) bool {
+	if len(name) > 0 && name[0] == '$' && len(filter) > 0 &&
+		(filter[0] == SingleLevelWildcard || filter[0] == MultiLevelWildcard) {
+		return false
+	}
+
+	for {
+		filterLevel, filterRest, filterMore := nextLevel(filter)
+		if filterLevel == "#" {
+			return true
+		}
+		nameLevel, nameRest, nameMore := nextLevel(name)
+		if filterLevel != "+" && filterLevel != nameLevel {
+			return false
+		}
+
+		switch {
+		case !filterMore:
+			return !nameMore
+		case !nameMore:
+			// "sport/#" also matches the parent level "sport".
+			return filterRest == "#"
+		}
+		filter, name = filterRest, nameRest
+	}
+}
+
+// nextLevel splits topic on its first level. It returns the level, the
+// remaining levels and whether there was a level separator.
+func nextLevel(topic string) (level string, rest string, more bool) {
+	i := strings.IndexByte(topic, Separator)
+	if i < 0 {
+		return topic, "", false
+	}
+	return topic[:i], topic[i+1:], true
+}
@@ -0,0 +1,104 @@
+package topic // import "gosrc.io/mqtt/topic"
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"sport/tennis/player1", nil},
+		{"/", nil},
+		{"/finance", nil},
+		{"$SYS/broker/uptime", nil},
+		{"", ErrEmpty},
+		{strings.Repeat("a", MaxLength+1), ErrTooLong},
+		{"sport/\xff", ErrInvalidUTF8},
+		{"sport\x00tennis", ErrNullCharacter},
+		{"sport/+", ErrWildcardInName},
+		{"sport/#", ErrWildcardInName},
+	}
+
+	for _, test := range tests {
+		if err := ValidateName(test.name); err != test.err {
+			t.Errorf("incorrect validation result for topic name %q (%v) = %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		err    error
+	}{
+		{"sport/tennis/player1", nil},
+		{"#", nil},
+		{"sport/#", nil},
+		{"+", nil},
+		{"+/tennis/#", nil},
+		{"sport/+/player1", nil},
+		{"/+", nil},
+		{"", ErrEmpty},
+		{"sport/tennis#", ErrInvalidMultiLevelWildcard},
+		{"sport/tennis/#/ranking", ErrInvalidMultiLevelWildcard},
+		{"sport+", ErrInvalidSingleLevelWildcard},
+		{"sport/+tennis", ErrInvalidSingleLevelWildcard},
+		{"sport\x00", ErrNullCharacter},
+	}
+
+	for _, test := range tests {
+		if err := ValidateFilter(test.filter); err != test.err {
+			t.Errorf("incorrect validation result for topic filter %q (%v) = %v", test.filter, err, test.err)
+		}
+	}
+}
+
+// Examples are taken from MQTT 3.1.1 specification, section 4.7.
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		name   string
+		match  bool
+	}{
+		{"sport/tennis/player1", "sport/tennis/player1", true},
+		{"sport/tennis/player1", "sport/tennis/player2", false},
+		{"sport/tennis/player1", "sport/tennis", false},
+		{"sport/tennis/player1/#", "sport/tennis/player1", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/score/wimbledon", true},
+		{"sport/#", "sport", true},
+		{"#", "sport/tennis", true},
+		{"#", "/", true},
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+		{"sport/+", "sport", false},
+		{"sport/+", "sport/", true},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"+", "sport", true},
+		{"+/tennis/#", "sport/tennis/player1", true},
+		{"+/tennis/#", "sport/football", false},
+		// [MQTT-4.7.2-1]
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+	}
+
+	for _, test := range tests {
+		if match := Match(test.filter, test.name); match != test.match {
+			t.Errorf("incorrect match result for filter %q and name %q (%t) = %t", test.filter, test.name, match, test.match)
+		}
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Match("sensors/+/temp/#", "sensors/living-room/temp/celsius")
+	}
+}